@@ -46,7 +46,7 @@ aws dynamodb wait table-exists --table-name $DYNAMODB_TABLE --region $REGION
 # Build the Lambda function
 echo "🔨 Building Lambda function..."
 cd lambda
-GOOS=linux GOARCH=amd64 go build -o lambda_handler main.go
+GOOS=linux GOARCH=amd64 go build -o lambda_handler .
 cd ..
 
 # Create deployment package
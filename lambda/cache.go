@@ -0,0 +1,218 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+const (
+	// Cache directory inside the Lambda ephemeral storage
+	cacheDir = "/tmp/cloudsqlite-cache"
+
+	// Share of the free space in /tmp at startup the cache may use when
+	// CACHE_MAX_BYTES is not set; the rest is left for working copies
+	cacheStorageShare = 0.5
+)
+
+// cacheEntry is one cached database version
+type cacheEntry struct {
+	databaseName string
+	etag         string
+	path         string
+	size         int64
+	element      *list.Element
+}
+
+// diskCache keeps downloaded databases in /tmp across warm invocations,
+// evicting the least recently used database when over its size budget
+type diskCache struct {
+	mu        sync.Mutex
+	dir       string
+	maxBytes  int64
+	usedBytes int64
+	entries   map[string]*cacheEntry
+	lru       *list.List
+}
+
+var databaseCache = newDiskCache(cacheDir, cacheMaxBytes())
+
+// cacheMaxBytes returns CACHE_MAX_BYTES, or a share of the ephemeral
+// storage left free by whatever was there before the cache
+func cacheMaxBytes() int64 {
+	if raw := os.Getenv("CACHE_MAX_BYTES"); raw != "" {
+		if maxBytes, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return maxBytes
+		}
+		slog.Warn("Ignoring invalid CACHE_MAX_BYTES", "value", raw)
+	}
+
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs("/tmp", &stat); err != nil {
+		slog.Warn("Failed to stat /tmp, disabling cache", "error", err)
+		return 0
+	}
+	return int64(float64(int64(stat.Bavail)*int64(stat.Bsize)) * cacheStorageShare)
+}
+
+// newDiskCache creates an empty cache in this process's subdirectory of dir.
+// The index lives in memory, so the files of processes that have exited are
+// discarded; those of live processes sharing /tmp are left alone.
+func newDiskCache(dir string, maxBytes int64) *diskCache {
+	sweepDeadProcessDirs(dir)
+	return &diskCache{
+		dir:      processDir(dir),
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+		lru:      list.New(),
+	}
+}
+
+// open returns the cached copy of a database and its ETag, or nil on a miss.
+// The file is opened under the lock so a concurrent eviction cannot remove it first.
+func (c *diskCache) open(databaseName string) (*os.File, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[databaseName]
+	if !ok {
+		return nil, ""
+	}
+
+	file, err := os.Open(entry.path)
+	if err != nil {
+		c.removeLocked(entry)
+		return nil, ""
+	}
+	c.lru.MoveToFront(entry.element)
+	return file, entry.etag
+}
+
+// store writes a database version into the cache, replacing any older version
+func (c *diskCache) store(databaseName, etag string, r io.Reader, size int64) error {
+	if size > c.maxBytes {
+		return fmt.Errorf("database %s (%d bytes) exceeds cache size %d", databaseName, size, c.maxBytes)
+	}
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	// Concurrent fills of the same entry each write their own partial file
+	path := c.entryPath(databaseName, etag)
+	file, err := os.CreateTemp(c.dir, filepath.Base(path)+".partial-*")
+	if err != nil {
+		return fmt.Errorf("failed to create cache file: %v", err)
+	}
+	tmpPath := file.Name()
+	written, err := io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write cache file: %v", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to commit cache file: %v", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.entries[databaseName]; ok {
+		c.dropLocked(old)
+		if old.path != path {
+			os.Remove(old.path)
+		}
+	}
+	entry := &cacheEntry{databaseName: databaseName, etag: etag, path: path, size: written}
+	entry.element = c.lru.PushFront(entry)
+	c.entries[databaseName] = entry
+	c.usedBytes += written
+
+	for c.usedBytes > c.maxBytes && c.lru.Len() > 1 {
+		c.removeLocked(c.lru.Back().Value.(*cacheEntry))
+	}
+	return nil
+}
+
+// fits reports whether the cache is enabled and has room for a database of
+// the given size
+func (c *diskCache) fits(size int64) bool {
+	return c.maxBytes > 0 && size <= c.maxBytes
+}
+
+// storeFile caches a copy of a local database file under the given ETag.
+// A file the cache has no room for is not copied, and any older version of
+// the database is dropped.
+func (c *diskCache) storeFile(databaseName, etag, localPath string) error {
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %v", err)
+	}
+	if !c.fits(info.Size()) {
+		c.invalidate(databaseName)
+		return nil
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer file.Close()
+	return c.store(databaseName, etag, file, info.Size())
+}
+
+// invalidate drops the cached copy of a database
+func (c *diskCache) invalidate(databaseName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry, ok := c.entries[databaseName]; ok {
+		c.removeLocked(entry)
+	}
+}
+
+// removeLocked deletes an entry and its file; c.mu must be held
+func (c *diskCache) removeLocked(entry *cacheEntry) {
+	c.dropLocked(entry)
+	os.Remove(entry.path)
+}
+
+// dropLocked removes an entry from the index only; c.mu must be held
+func (c *diskCache) dropLocked(entry *cacheEntry) {
+	c.lru.Remove(entry.element)
+	if c.entries[entry.databaseName] == entry {
+		delete(c.entries, entry.databaseName)
+	}
+	c.usedBytes -= entry.size
+}
+
+// entryPath returns the cache file name for a database version
+func (c *diskCache) entryPath(databaseName, etag string) string {
+	sum := sha256.Sum256([]byte(databaseName + "\x00" + etag))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:16])+".db")
+}
+
+// writeLocalFile writes the contents of r to a new local file
+func writeLocalFile(path string, r io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create local file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("failed to write local file: %v", err)
+	}
+	return file.Close()
+}
@@ -0,0 +1,598 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Manifest format written by this version
+	manifestFormatVersion = 1
+
+	// Default chunk size - 1MB, i.e. 256 pages of 4KB
+	defaultChunkSize = 1 << 20
+
+	// Chunks transferred in parallel
+	chunkTransferConcurrency = 8
+
+	// Default number of commits between chunk garbage collections
+	defaultChunkGCInterval = 16
+
+	// Unreferenced chunks younger than this are kept, since a reader may
+	// still be applying the manifest that used them
+	chunkGCGrace = time.Hour
+)
+
+// errNotModified is returned by getManifest when the cached manifest is current
+var errNotModified = errors.New("not modified")
+
+// ChunkManifest describes a database stored as fixed-size page chunks.
+// Chunk objects are content-addressed, so a commit only uploads chunks
+// that changed and becomes visible when the manifest is replaced. With
+// encryption on, addresses are an HMAC under a key derived from the master
+// key AddressKeyID, so they do not reveal which chunks hold known contents.
+type ChunkManifest struct {
+	FormatVersion int      `json:"format_version"`
+	Generation    int64    `json:"generation"`
+	ChunkSize     int64    `json:"chunk_size"`
+	Size          int64    `json:"size"`
+	Chunks        []string `json:"chunks"`
+	AddressKeyID  string   `json:"address_key_id,omitempty"`
+	UpdatedAt     int64    `json:"updated_at"`
+}
+
+// manifestKey returns the object key of a database's manifest
+func manifestKey(databaseName string) string {
+	return databaseName + "/manifest.json"
+}
+
+// chunkKey returns the object key of a chunk with the given address
+func chunkKey(databaseName, hash string) string {
+	return databaseName + "/chunks/" + hash
+}
+
+// configuredChunkSize returns CHUNK_SIZE_BYTES or the default chunk size
+func configuredChunkSize() int64 {
+	if raw := os.Getenv("CHUNK_SIZE_BYTES"); raw != "" {
+		if size, err := strconv.ParseInt(raw, 10, 64); err == nil && size > 0 {
+			return size
+		}
+		slog.Warn("Ignoring invalid CHUNK_SIZE_BYTES", "value", raw)
+	}
+	return defaultChunkSize
+}
+
+// getManifest fetches a database's manifest, or an earlier version of it.
+// It returns a nil manifest if the database has not been stored in the
+// chunked layout yet, and errNotModified if ifNoneMatch is still the current ETag.
+func getManifest(databaseName, versionID, ifNoneMatch string) (*ChunkManifest, string, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(manifestKey(databaseName)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+	if ifNoneMatch != "" {
+		input.IfNoneMatch = aws.String(ifNoneMatch)
+	}
+
+	result, err := s3Client.GetObject(input)
+	if err != nil {
+		if ifNoneMatch != "" && isNotModified(err) {
+			return nil, "", errNotModified
+		}
+		if isNotFound(err) {
+			return nil, "", nil
+		}
+		return nil, "", fmt.Errorf("failed to get manifest from S3: %w", err)
+	}
+	defer result.Body.Close()
+
+	var manifest ChunkManifest
+	if err := json.NewDecoder(result.Body).Decode(&manifest); err != nil {
+		return nil, "", fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	if manifest.FormatVersion > manifestFormatVersion {
+		return nil, "", fmt.Errorf("manifest format %d is newer than supported format %d",
+			manifest.FormatVersion, manifestFormatVersion)
+	}
+	return &manifest, aws.StringValue(result.ETag), nil
+}
+
+// downloadChunked rebuilds the database from its manifest at localPath,
+// fetching only the chunks that differ from the locally cached copy
+func downloadChunked(ctx context.Context, databaseName, localPath string) error {
+	cached, cachedETag := databaseCache.open(databaseName)
+	if cached != nil {
+		defer cached.Close()
+	}
+
+	manifest, etag, err := getManifest(databaseName, "", cachedETag)
+	if err == errNotModified {
+		if err := writeLocalFile(localPath, cached); err != nil {
+			return err
+		}
+		slog.Debug("Using cached database", "database", databaseName, "manifest_etag", cachedETag)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if manifest == nil {
+		// Not migrated yet; the first commit writes the chunked layout
+		return downloadFromS3(ctx, databaseName, localPath)
+	}
+
+	// Start from the cached copy, whatever its version, and patch it up
+	if cached != nil {
+		err = writeLocalFile(localPath, cached)
+	} else {
+		err = writeLocalFile(localPath, bytes.NewReader(nil))
+	}
+	if err != nil {
+		return err
+	}
+
+	fetched, err := applyManifest(databaseName, manifest, localPath)
+	if err != nil {
+		return err
+	}
+
+	if err := databaseCache.storeFile(databaseName, etag, localPath); err != nil {
+		slog.Warn("Failed to cache database", "database", databaseName, "error", err)
+	}
+
+	slog.Debug("Downloaded chunked database", "database", databaseName, "generation", manifest.Generation,
+		"chunks_fetched", fetched, "chunks", len(manifest.Chunks))
+	return nil
+}
+
+// applyManifest brings the file at localPath to the manifest's contents,
+// fetching only the chunks that differ, and returns how many were fetched
+func applyManifest(databaseName string, manifest *ChunkManifest, localPath string) (int, error) {
+	file, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer file.Close()
+
+	if err := file.Truncate(manifest.Size); err != nil {
+		return 0, fmt.Errorf("failed to resize local file: %v", err)
+	}
+
+	hash, err := chunkHasher(manifest.AddressKeyID)
+	if err != nil {
+		return 0, err
+	}
+
+	// Compare local chunks with the manifest to find the ones to fetch
+	var stale []int
+	buf := make([]byte, manifest.ChunkSize)
+	for i, address := range manifest.Chunks {
+		n, err := file.ReadAt(buf, int64(i)*manifest.ChunkSize)
+		if err != nil && err != io.EOF {
+			return 0, fmt.Errorf("failed to read local chunk %d: %v", i, err)
+		}
+		if hash(buf[:n]) != address {
+			stale = append(stale, i)
+		}
+	}
+
+	err = forEachConcurrently(len(stale), chunkTransferConcurrency, func(j int) error {
+		i := stale[j]
+		data, err := getChunk(databaseName, manifest.Chunks[i], hash)
+		if err != nil {
+			return err
+		}
+		if _, err := file.WriteAt(data, int64(i)*manifest.ChunkSize); err != nil {
+			return fmt.Errorf("failed to write chunk %d: %v", i, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if err := file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close local file: %v", err)
+	}
+	return len(stale), nil
+}
+
+// uploadChunked uploads the chunks missing from the current manifest and
+// then replaces the manifest, which publishes the commit
+func uploadChunked(ctx context.Context, localPath, databaseName string) error {
+	previous, _, err := getManifest(databaseName, "", "")
+	if err != nil {
+		return err
+	}
+
+	addressKeyID, err := activeAddressKeyID()
+	if err != nil {
+		return err
+	}
+	hash, err := chunkHasher(addressKeyID)
+	if err != nil {
+		return err
+	}
+
+	// Chunks addressed under another key, after a key rotation or a change
+	// of OBJECT_ENCRYPTION, are uploaded again under their new addresses
+	stored := make(map[string]bool)
+	generation := int64(1)
+	if previous != nil {
+		if previous.AddressKeyID == addressKeyID {
+			for _, address := range previous.Chunks {
+				stored[address] = true
+			}
+		}
+		generation = previous.Generation + 1
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat local file: %v", err)
+	}
+
+	manifest := ChunkManifest{
+		FormatVersion: manifestFormatVersion,
+		Generation:    generation,
+		ChunkSize:     configuredChunkSize(),
+		Size:          info.Size(),
+		AddressKeyID:  addressKeyID,
+		UpdatedAt:     time.Now().Unix(),
+	}
+
+	// Hash every chunk and collect the ones the bucket does not have yet
+	var dirty []int
+	buf := make([]byte, manifest.ChunkSize)
+	for offset := int64(0); offset < manifest.Size; offset += manifest.ChunkSize {
+		n, err := file.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read local chunk: %v", err)
+		}
+		address := hash(buf[:n])
+		if !stored[address] {
+			stored[address] = true
+			dirty = append(dirty, len(manifest.Chunks))
+		}
+		manifest.Chunks = append(manifest.Chunks, address)
+	}
+
+	err = forEachConcurrently(len(dirty), chunkTransferConcurrency, func(j int) error {
+		i := dirty[j]
+		data := make([]byte, manifest.ChunkSize)
+		n, err := file.ReadAt(data, int64(i)*manifest.ChunkSize)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read local chunk %d: %v", i, err)
+		}
+		return putChunk(databaseName, manifest.Chunks[i], data[:n])
+	})
+	if err != nil {
+		return err
+	}
+
+	// Uploading the chunks may have taken a while; check the lease again
+	if err := fenceLease(ctx, databaseName); err != nil {
+		return err
+	}
+	etag, err := putManifest(databaseName, &manifest)
+	if err != nil {
+		databaseCache.invalidate(databaseName)
+		return err
+	}
+
+	if err := databaseCache.storeFile(databaseName, etag, localPath); err != nil {
+		slog.Warn("Failed to cache uploaded database", "database", databaseName, "error", err)
+		databaseCache.invalidate(databaseName)
+	}
+
+	slog.Debug("Uploaded chunked database", "database", databaseName, "generation", generation,
+		"chunks_changed", len(dirty), "chunks", len(manifest.Chunks))
+
+	if interval := chunkGCInterval(); interval > 0 && generation%interval == 0 {
+		deleted, err := collectChunks(databaseName, &manifest, previous)
+		if err != nil {
+			slog.Warn("Failed to collect unreferenced chunks", "database", databaseName, "error", err)
+		} else if deleted > 0 {
+			slog.Info("Collected unreferenced chunks", "database", databaseName, "deleted", deleted)
+		}
+	}
+	return nil
+}
+
+// chunkGCInterval returns CHUNK_GC_INTERVAL, the number of commits between
+// chunk garbage collections, or the default; 0 turns collection off
+func chunkGCInterval() int64 {
+	if raw := os.Getenv("CHUNK_GC_INTERVAL"); raw != "" {
+		if n, err := strconv.ParseInt(raw, 10, 64); err == nil && n >= 0 {
+			return n
+		}
+		slog.Warn("Ignoring invalid CHUNK_GC_INTERVAL", "value", raw)
+	}
+	return defaultChunkGCInterval
+}
+
+// collectChunks deletes the chunks of a database that neither the given
+// manifests nor any retained manifest version refer to, and returns how
+// many it deleted. On a versioned bucket every version and delete marker
+// of such a chunk is deleted, since no manifest can need it again. It runs
+// under the writer's lease, so no new manifest can appear while it lists.
+func collectChunks(databaseName string, current, previous *ChunkManifest) (int, error) {
+	referenced := make(map[string]bool)
+	for _, manifest := range []*ChunkManifest{current, previous} {
+		if manifest != nil {
+			for _, hash := range manifest.Chunks {
+				referenced[hash] = true
+			}
+		}
+	}
+
+	// Earlier manifest versions can still be read or restored
+	versions, err := listDatabaseVersions(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range versions {
+		if v.IsLatest {
+			continue
+		}
+		manifest, _, err := getManifest(databaseName, v.VersionID, "")
+		if err != nil {
+			return 0, err
+		}
+		if manifest != nil {
+			for _, hash := range manifest.Chunks {
+				referenced[hash] = true
+			}
+		}
+	}
+
+	prefix := chunkKey(databaseName, "")
+	return deleteUnreferencedObjects(prefix, func(key string) bool {
+		return referenced[strings.TrimPrefix(key, prefix)]
+	}, chunkGCGrace)
+}
+
+// deleteUnreferencedObjects deletes every version and delete marker of the
+// objects under prefix that are not referenced, unless one of their versions
+// was written within the grace period, and returns how many objects it deleted
+func deleteUnreferencedObjects(prefix string, referenced func(key string) bool, grace time.Duration) (int, error) {
+	objectVersions := make(map[string][]*s3.ObjectIdentifier)
+	recent := make(map[string]bool)
+	cutoff := time.Now().Add(-grace)
+	add := func(key, versionID *string, modified *time.Time) {
+		name := aws.StringValue(key)
+		if referenced(name) {
+			return
+		}
+		objectVersions[name] = append(objectVersions[name], &s3.ObjectIdentifier{Key: key, VersionId: versionID})
+		if !aws.TimeValue(modified).Before(cutoff) {
+			recent[name] = true
+		}
+	}
+	err := s3Client.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(s3BucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			add(v.Key, v.VersionId, v.LastModified)
+		}
+		for _, marker := range page.DeleteMarkers {
+			add(marker.Key, marker.VersionId, marker.LastModified)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+
+	var garbage []*s3.ObjectIdentifier
+	deleted := 0
+	for name, identifiers := range objectVersions {
+		if !recent[name] {
+			garbage = append(garbage, identifiers...)
+			deleted++
+		}
+	}
+
+	// DeleteObjects accepts up to 1000 keys per call
+	for start := 0; start < len(garbage); start += 1000 {
+		end := min(start+1000, len(garbage))
+		output, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s3BucketName),
+			Delete: &s3.Delete{Objects: garbage[start:end], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete %s: %w", prefix, err)
+		}
+		if len(output.Errors) > 0 {
+			e := output.Errors[0]
+			return 0, fmt.Errorf("failed to delete %d object versions, first %s: %s", len(output.Errors), aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+	}
+	return deleted, nil
+}
+
+// putManifest replaces a database's manifest and returns its new ETag
+func putManifest(databaseName string, manifest *ChunkManifest) (string, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal manifest: %v", err)
+	}
+
+	output, err := s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s3BucketName),
+		Key:         aws.String(manifestKey(databaseName)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload manifest to S3: %w", err)
+	}
+	return aws.StringValue(output.ETag), nil
+}
+
+// getChunk downloads one chunk and checks it against its address
+func getChunk(databaseName, address string, hash func([]byte) string) ([]byte, error) {
+	result, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(chunkKey(databaseName, address)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get chunk %s from S3: %w", address, err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read chunk %s: %v", address, err)
+	}
+	if data, err = decodeBytes(data, result.Metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode chunk %s: %v", address, err)
+	}
+	if hash(data) != address {
+		return nil, fmt.Errorf("chunk %s failed hash verification", address)
+	}
+	return data, nil
+}
+
+// putChunk uploads one chunk under its content address
+func putChunk(databaseName, address string, data []byte) error {
+	encoded, encoding, err := encodeBytes(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(chunkKey(databaseName, address)),
+		Body:     bytes.NewReader(encoded),
+		Metadata: encoding,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload chunk %s to S3: %w", address, err)
+	}
+	return nil
+}
+
+// hashChunk returns the hex SHA-256 of a chunk
+func hashChunk(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// activeAddressKeyID returns the ID of the key new chunk addresses are
+// computed with, or "" for plain SHA-256 when encryption is off
+func activeAddressKeyID() (string, error) {
+	if !slices.Contains(objectEncodings(), encodingAESGCM) {
+		return "", nil
+	}
+	provider, err := objectKeyProvider()
+	if err != nil {
+		return "", err
+	}
+	if provider == nil {
+		return "", fmt.Errorf("OBJECT_ENCRYPTION requires KEYRING_FILE")
+	}
+	keyID, _, err := provider.AddressKey("")
+	return keyID, err
+}
+
+// chunkHasher returns the function that computes chunk addresses under a
+// key: hashChunk for "", and otherwise an HMAC-SHA256
+func chunkHasher(keyID string) (func([]byte) string, error) {
+	if keyID == "" {
+		return hashChunk, nil
+	}
+	provider, err := objectKeyProvider()
+	if err != nil {
+		return nil, err
+	}
+	if provider == nil {
+		return nil, fmt.Errorf("chunk addresses are keyed but KEYRING_FILE is not set")
+	}
+	_, key, err := provider.AddressKey(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return func(data []byte) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(data)
+		return hex.EncodeToString(mac.Sum(nil))
+	}, nil
+}
+
+// isNotFound reports whether an S3 request failed because the key does not exist
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+		return true
+	}
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusNotFound
+}
+
+// forEachConcurrently calls fn for 0..n-1 on up to concurrency goroutines
+// and returns the first error
+func forEachConcurrently(n, concurrency int, fn func(i int) error) error {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	next := make(chan int)
+
+	for w := 0; w < concurrency && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return firstErr
+}
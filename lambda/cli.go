@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// cliUsage describes the command-line tool
+const cliUsage = `Usage: lambda_handler <command> [flags] <database> [sql]
+
+Commands:
+  versions <database>                   List the versions of a database
+  query [flags] <database> <sql>        Run a SQL statement
+  restore [flags] <database>            Restore a database to an earlier version
+  snapshot <database> <name>            Take a named snapshot
+  snapshots <database>                  List a database's snapshots
+  branch <database> <snapshot> <new>    Create a writable database from a snapshot
+  delete-snapshot <database> <name>     Delete a named snapshot
+  locks                                 List held locks
+  lock <database>                       Show the lock held on a database
+  force-release [flags] <database>      Release a database's lock, or one holder's lease
+  steal [flags] <database>              Take a database's lock from its holders
+  serve [-addr :8080]                   Run the HTTP server with read replicas
+
+Flags for query and restore:
+  -version ID                           S3 version ID
+  -as-of TIME                           Newest version at or before an RFC 3339 time
+
+Flags for force-release and steal:
+  -reason TEXT                          Reason recorded in the audit record
+  -holder ID                            Release only this instance's lease, or
+                                        steal only if this instance holds the lock
+`
+
+// runCLI runs a command through Handler, so the tool behaves exactly like the API
+func runCLI(args []string) int {
+	if args[0] == "serve" {
+		return runServer(args[1:])
+	}
+
+	var apiReq APIRequest
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.StringVar(&apiReq.VersionID, "version", "", "S3 version ID")
+	flags.StringVar(&apiReq.AsOf, "as-of", "", "RFC 3339 time")
+	flags.StringVar(&apiReq.Reason, "reason", "", "Reason for a forced lock change")
+	flags.StringVar(&apiReq.InstanceID, "holder", "", "Lock holder to release")
+	flags.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	if err := flags.Parse(args[1:]); err != nil {
+		return 2
+	}
+	positional := flags.Args()
+
+	switch {
+	case args[0] == "versions" && len(positional) == 1:
+		apiReq.Operation = opListVersions
+	case args[0] == "query" && len(positional) == 2:
+		apiReq.Operation = opQuery
+		apiReq.SQLStatement = positional[1]
+	case args[0] == "restore" && len(positional) == 1:
+		apiReq.Operation = opRestore
+	case args[0] == "snapshot" && len(positional) == 2:
+		apiReq.Operation = opSnapshot
+		apiReq.SnapshotName = positional[1]
+	case args[0] == "snapshots" && len(positional) == 1:
+		apiReq.Operation = opListSnapshots
+	case args[0] == "branch" && len(positional) == 3:
+		apiReq.Operation = opBranch
+		apiReq.SnapshotName = positional[1]
+		apiReq.BranchName = positional[2]
+	case args[0] == "delete-snapshot" && len(positional) == 2:
+		apiReq.Operation = opDeleteSnapshot
+		apiReq.SnapshotName = positional[1]
+	case args[0] == "locks" && len(positional) == 0:
+		apiReq.Operation = opListLocks
+		return invokeCLI(apiReq)
+	case args[0] == "lock" && len(positional) == 1:
+		apiReq.Operation = opInspectLock
+	case args[0] == "force-release" && len(positional) == 1:
+		apiReq.Operation = opForceReleaseLock
+	case args[0] == "steal" && len(positional) == 1:
+		apiReq.Operation = opStealLock
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	apiReq.DatabaseName = positional[0]
+
+	return invokeCLI(apiReq)
+}
+
+// invokeCLI sends a request to Handler and prints the response body
+func invokeCLI(apiReq APIRequest) int {
+	body, err := json.Marshal(apiReq)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to marshal request: %v\n", err)
+		return 1
+	}
+
+	// Whoever runs the tool has direct access to the bucket and lock table,
+	// so it acts with the admin role
+	request := events.APIGatewayProxyRequest{Body: string(body)}
+	request.RequestContext.Authorizer = map[string]interface{}{"role": adminRoleName}
+	request.RequestContext.Identity.Caller = "cli:" + os.Getenv("USER")
+
+	response, err := Handler(context.Background(), request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Request failed: %v\n", err)
+		return 1
+	}
+
+	var pretty bytes.Buffer
+	if json.Indent(&pretty, []byte(response.Body), "", "  ") != nil {
+		pretty.WriteString(response.Body)
+	}
+	fmt.Println(pretty.String())
+
+	if response.StatusCode >= 300 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// Storage layout for databases kept on a shared filesystem instead of S3
+	layoutEFS = "efs"
+
+	// Where the shared filesystem is mounted unless EFS_MOUNT_PATH says otherwise
+	defaultEFSMountPath = "/mnt/cloudsqlite"
+
+	// How writers to a database on the shared filesystem are kept apart
+	efsLockingSQLite = "sqlite" // SQLite's own POSIX byte-range locks
+	efsLockingLease  = "lease"  // the DynamoDB lease locker
+)
+
+var (
+	efsLockProbeOnce sync.Once
+	efsLocksWork     bool
+)
+
+// efsMountPath returns EFS_MOUNT_PATH or the default mount path
+func efsMountPath() string {
+	if path := os.Getenv("EFS_MOUNT_PATH"); path != "" {
+		return path
+	}
+	return defaultEFSMountPath
+}
+
+// efsDatabasePath returns where a database lives on the shared filesystem
+func efsDatabasePath(databaseName string) string {
+	return filepath.Join(efsMountPath(), filepath.Clean("/"+databaseName))
+}
+
+// efsLocking returns how writers to databases on the shared filesystem are
+// kept apart. The lease locker is the default: a mount that silently ignores
+// POSIX locks (NFS with nolock) looks just like one that honours them, so
+// SQLite's locks are only used when EFS_LOCKING=sqlite asks for them.
+func efsLocking() string {
+	switch mode := os.Getenv("EFS_LOCKING"); mode {
+	case efsLockingSQLite:
+		efsLockProbeOnce.Do(func() {
+			efsLocksWork = probeEFSLocks()
+			if !efsLocksWork {
+				slog.Warn("Shared filesystem refuses POSIX locks; using the lease locker for databases on it", "path", efsMountPath())
+			}
+		})
+		if efsLocksWork {
+			return efsLockingSQLite
+		}
+	case "", efsLockingLease:
+	default:
+		slog.Warn("Ignoring invalid EFS_LOCKING", "value", mode)
+	}
+	return efsLockingLease
+}
+
+// probeEFSLocks reports whether byte-range locks can be taken on the mount,
+// which SQLite needs to keep connections on different hosts apart. Success
+// does not prove other hosts see the lock, only failure is conclusive.
+func probeEFSLocks() bool {
+	probe, err := os.CreateTemp(efsMountPath(), ".lock-probe-")
+	if err != nil {
+		slog.Warn("Failed to create lock probe", "path", efsMountPath(), "error", err)
+		return false
+	}
+	defer os.Remove(probe.Name())
+	defer probe.Close()
+
+	lock := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: 0, Start: 0, Len: 1}
+	if err := syscall.FcntlFlock(probe.Fd(), syscall.F_SETLK, &lock); err != nil {
+		return false
+	}
+	lock.Type = syscall.F_UNLCK
+	syscall.FcntlFlock(probe.Fd(), syscall.F_SETLK, &lock)
+	return true
+}
+
+// efsDSN returns the data source name for a database on the shared
+// filesystem. WAL needs shared memory that other hosts cannot see, so the
+// rollback journal is always used; busy connections retry for busyTimeout.
+func efsDSN(path string, busyTimeoutMs int64) string {
+	params := url.Values{}
+	params.Set("_journal_mode", "DELETE")
+	params.Set("_busy_timeout", fmt.Sprint(busyTimeoutMs))
+	return "file:" + (&url.URL{Path: path}).EscapedPath() + "?" + params.Encode()
+}
+
+// checkEFSOperation rejects operations that need the database's history in
+// S3, which databases on the shared filesystem do not have
+func checkEFSOperation(apiReq APIRequest) error {
+	if storageLayout(apiReq.DatabaseName) != layoutEFS {
+		return nil
+	}
+	switch {
+	case apiReq.Operation == opListVersions, apiReq.Operation == opRestore,
+		apiReq.Operation == opSnapshot, apiReq.Operation == opBranch,
+		apiReq.VersionID != "", apiReq.AsOf != "":
+		return fmt.Errorf("%s is on the shared filesystem, which keeps no versions or snapshots", apiReq.DatabaseName)
+	}
+	return nil
+}
+
+// handleEFSQuery runs a SQL statement directly against a database on the
+// shared filesystem, with no download or upload
+func handleEFSQuery(ctx context.Context, apiReq APIRequest, limits QueryLimits) (events.APIGatewayProxyResponse, error) {
+	path := efsDatabasePath(apiReq.DatabaseName)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return createFailureResponse("Failed to create database directory", err), nil
+	}
+
+	// With the lease locker, SQLite's busy timeout only covers the moment
+	// another host's transaction is still finishing up
+	policy := lockWaitPolicy(apiReq)
+	leased := efsLocking() == efsLockingLease
+	var waited time.Duration
+	sqlCtx := ctx
+	if leased {
+		instanceID := newInstanceID()
+		ctx = withLogAttrs(ctx, slog.String("lock_holder", instanceID))
+		mode := leaseMode(apiReq.SQLStatement)
+		started := time.Now()
+		var err error
+		waited, err = waitForDynamoLock(ctx, apiReq.DatabaseName, instanceID, mode, policy)
+		logPhase(ctx, phaseLock, started, err, "mode", mode, "lock_wait_ms", waited.Milliseconds())
+		if err != nil {
+			return createLockErrorResponse(err, waited), nil
+		}
+		defer func() {
+			started := time.Now()
+			err := releaseDynamoLease(ctx, apiReq.DatabaseName, instanceID, mode)
+			logPhase(ctx, phaseRelease, started, err, "mode", mode)
+		}()
+		// The statement runs in place, so keep the lease for as long as it
+		// does; losing it interrupts the statement
+		var stopHeartbeat func()
+		sqlCtx, stopHeartbeat = startLeaseHeartbeat(ctx, apiReq.DatabaseName, instanceID, mode)
+		defer stopHeartbeat()
+	}
+
+	started := time.Now()
+	result, err := executeSQL(sqlCtx, efsDSN(path, policy.MaxWait.Milliseconds()), apiReq.SQLStatement, limits)
+	logPhase(ctx, phaseExecute, started, err, "layout", layoutEFS, "locking", efsLocking())
+	if err != nil {
+		if lockErr, ok := err.(*LockWaitError); ok {
+			lockErr.Waited = waited + time.Since(started)
+			return createLockErrorResponse(lockErr, lockErr.Waited), nil
+		}
+		if cause := context.Cause(sqlCtx); errors.Is(cause, errLeaseLost) {
+			err = cause
+		}
+		return createFailureResponse("SQL execution failed", err), nil
+	}
+	if leased {
+		result.LockWaitMs = lockWaitMs(waited)
+	}
+	return createSuccessResponse(result), nil
+}
+
+// isSQLiteBusy reports whether SQLite gave up waiting for another
+// connection's lock
+func isSQLiteBusy(err error) bool {
+	sqliteErr, ok := err.(sqlite3.Error)
+	return ok && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked)
+}
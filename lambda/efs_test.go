@@ -0,0 +1,60 @@
+package main
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestEFSLocking(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		mount string
+		want  string
+	}{
+		{name: "default", want: efsLockingLease},
+		{name: "lease", mode: efsLockingLease, want: efsLockingLease},
+		{name: "invalid", mode: "flock", want: efsLockingLease},
+		{name: "sqlite with working locks", mode: efsLockingSQLite, want: efsLockingSQLite},
+		{name: "sqlite on a mount that refuses the probe", mode: efsLockingSQLite, mount: "missing", want: efsLockingLease},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			efsLockProbeOnce = sync.Once{}
+			t.Cleanup(func() { efsLockProbeOnce = sync.Once{} })
+			t.Setenv("EFS_LOCKING", tt.mode)
+			t.Setenv("EFS_MOUNT_PATH", filepath.Join(t.TempDir(), tt.mount))
+
+			if got := efsLocking(); got != tt.want {
+				t.Errorf("efsLocking() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckEFSOperation(t *testing.T) {
+	t.Setenv("STORAGE_LAYOUT_OVERRIDES", "hot.db=efs")
+
+	tests := []struct {
+		name    string
+		req     APIRequest
+		wantErr bool
+	}{
+		{name: "query", req: APIRequest{DatabaseName: "hot.db", SQLStatement: "SELECT 1"}},
+		{name: "list versions", req: APIRequest{DatabaseName: "hot.db", Operation: opListVersions}, wantErr: true},
+		{name: "restore", req: APIRequest{DatabaseName: "hot.db", Operation: opRestore, VersionID: "v1"}, wantErr: true},
+		{name: "snapshot", req: APIRequest{DatabaseName: "hot.db", Operation: opSnapshot, SnapshotName: "s"}, wantErr: true},
+		{name: "branch", req: APIRequest{DatabaseName: "hot.db", Operation: opBranch, SnapshotName: "s", BranchName: "b"}, wantErr: true},
+		{name: "query at a version", req: APIRequest{DatabaseName: "hot.db", SQLStatement: "SELECT 1", VersionID: "v1"}, wantErr: true},
+		{name: "query as of a time", req: APIRequest{DatabaseName: "hot.db", SQLStatement: "SELECT 1", AsOf: "2024-01-01T00:00:00Z"}, wantErr: true},
+		{name: "database in S3", req: APIRequest{DatabaseName: "cold.db", Operation: opListVersions}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkEFSOperation(tt.req); (err != nil) != tt.wantErr {
+				t.Errorf("checkEFSOperation() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
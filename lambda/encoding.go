@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Object metadata describing how an object's body is encoded
+	encodingMetadataKey   = "Encoding"    // encodings in the order applied, e.g. "zstd,aes-gcm"
+	keyIDMetadataKey      = "Key-Id"      // master key the data key is wrapped under
+	wrappedKeyMetadataKey = "Wrapped-Key" // base64 wrapped data key
+
+	// Object encodings
+	encodingZstd   = "zstd"
+	encodingAESGCM = "aes-gcm"
+
+	// Plaintext bytes sealed per AES-GCM frame
+	encryptionFrameBytes = 64 * 1024
+)
+
+// requireEncryption reports whether objects that are not encrypted must be
+// refused: encryption is on, and OBJECT_ENCRYPTION_ALLOW_PLAINTEXT=on has
+// not been set to read objects stored before it was turned on
+func requireEncryption() bool {
+	for _, encoding := range objectEncodings() {
+		if encoding == encodingAESGCM {
+			return os.Getenv("OBJECT_ENCRYPTION_ALLOW_PLAINTEXT") != "on"
+		}
+	}
+	return false
+}
+
+// isEncrypted reports whether object metadata records AES-GCM encryption
+func isEncrypted(metadata map[string]*string) bool {
+	for _, encoding := range strings.Split(metadataValue(metadata, encodingMetadataKey), ",") {
+		if encoding == encodingAESGCM {
+			return true
+		}
+	}
+	return false
+}
+
+// checkEncodingPolicy refuses a plaintext object while encryption is
+// required, since its metadata may have been rewritten to downgrade it
+func checkEncodingPolicy(metadata map[string]*string) error {
+	if requireEncryption() && !isEncrypted(metadata) {
+		return fmt.Errorf("object is not encrypted but OBJECT_ENCRYPTION is on")
+	}
+	return nil
+}
+
+// encodingHeader returns the description of an object's encoding that every
+// AES-GCM frame authenticates, so the metadata cannot be changed to drop or
+// reorder an encoding without failing decryption
+func encodingHeader(encodings, keyID string) []byte {
+	return []byte(encodings + "\x00" + keyID)
+}
+
+// objectEncodings returns the encodings applied to new objects, from
+// OBJECT_COMPRESSION=zstd and OBJECT_ENCRYPTION=aes-gcm
+func objectEncodings() []string {
+	var encodings []string
+	switch compression := os.Getenv("OBJECT_COMPRESSION"); compression {
+	case "", "none":
+	case encodingZstd:
+		encodings = append(encodings, encodingZstd)
+	default:
+		slog.Warn("Ignoring invalid OBJECT_COMPRESSION", "value", compression)
+	}
+	switch encryption := os.Getenv("OBJECT_ENCRYPTION"); encryption {
+	case "", "none":
+	case encodingAESGCM:
+		encodings = append(encodings, encodingAESGCM)
+	default:
+		slog.Warn("Ignoring invalid OBJECT_ENCRYPTION", "value", encryption)
+	}
+	return encodings
+}
+
+// metadataValue looks up object metadata, whose key case S3 does not preserve
+func metadataValue(metadata map[string]*string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return aws.StringValue(v)
+		}
+	}
+	return ""
+}
+
+// mergeMetadata combines object metadata maps
+func mergeMetadata(maps ...map[string]*string) map[string]*string {
+	merged := make(map[string]*string)
+	for _, m := range maps {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+// encodeStream writes r to w in the configured encodings and returns the
+// metadata that describes them
+func encodeStream(w io.Writer, r io.Reader) (map[string]*string, error) {
+	encodings := objectEncodings()
+	if len(encodings) == 0 {
+		_, err := io.Copy(w, r)
+		return nil, err
+	}
+
+	metadata := map[string]*string{encodingMetadataKey: aws.String(strings.Join(encodings, ","))}
+	var closers []io.Closer
+
+	// Build the pipeline from the outside in: compression feeds encryption
+	out := w
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case encodingAESGCM:
+			provider, err := objectKeyProvider()
+			if err != nil {
+				return nil, err
+			}
+			if provider == nil {
+				return nil, fmt.Errorf("OBJECT_ENCRYPTION requires KEYRING_FILE")
+			}
+			keyID, dataKey, wrapped, err := provider.GenerateDataKey()
+			if err != nil {
+				return nil, err
+			}
+			aead, err := newGCM(dataKey)
+			if err != nil {
+				return nil, err
+			}
+			metadata[keyIDMetadataKey] = aws.String(keyID)
+			metadata[wrappedKeyMetadataKey] = aws.String(base64.StdEncoding.EncodeToString(wrapped))
+			header := encodingHeader(aws.StringValue(metadata[encodingMetadataKey]), keyID)
+			encrypter := &gcmWriter{w: out, aead: aead, header: header}
+			closers = append(closers, encrypter)
+			out = encrypter
+
+		case encodingZstd:
+			compressor, err := zstd.NewWriter(out)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create compressor: %v", err)
+			}
+			closers = append(closers, compressor)
+			out = compressor
+		}
+	}
+
+	if _, err := io.Copy(out, r); err != nil {
+		return nil, fmt.Errorf("failed to encode object: %v", err)
+	}
+	// Flush the innermost stage first
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			return nil, fmt.Errorf("failed to encode object: %v", err)
+		}
+	}
+	return metadata, nil
+}
+
+// openEncoded opens a local file for upload in the configured encodings and
+// returns the metadata describing them
+func openEncoded(localPath string) (*os.File, map[string]*string, error) {
+	if len(objectEncodings()) == 0 {
+		file, err := os.Open(localPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open local file: %v", err)
+		}
+		return file, nil, nil
+	}
+
+	source, err := os.Open(localPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer source.Close()
+
+	// The encoded copy is unlinked at once and disappears when closed
+	encoded, err := os.CreateTemp(filepath.Dir(localPath), ".encoded-*")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create encoded file: %v", err)
+	}
+	os.Remove(encoded.Name())
+
+	metadata, err := encodeStream(encoded, source)
+	if err == nil {
+		_, err = encoded.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		encoded.Close()
+		return nil, nil, err
+	}
+	return encoded, metadata, nil
+}
+
+// encodeBytes encodes an in-memory object in the configured encodings
+func encodeBytes(data []byte) ([]byte, map[string]*string, error) {
+	var buf bytes.Buffer
+	metadata, err := encodeStream(&buf, bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), metadata, nil
+}
+
+// decodeReader returns a reader of an object's original contents, undoing
+// the encodings recorded in its metadata
+func decodeReader(r io.Reader, metadata map[string]*string) (io.ReadCloser, error) {
+	if err := checkEncodingPolicy(metadata); err != nil {
+		return nil, err
+	}
+	recorded := metadataValue(metadata, encodingMetadataKey)
+	if recorded == "" {
+		return io.NopCloser(r), nil
+	}
+
+	encodings := strings.Split(recorded, ",")
+	var decoders []func()
+	closeAll := func() {
+		for _, close := range decoders {
+			close()
+		}
+	}
+
+	// Undo the encodings in reverse order
+	for i := len(encodings) - 1; i >= 0; i-- {
+		switch encodings[i] {
+		case encodingAESGCM:
+			provider, err := objectKeyProvider()
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			if provider == nil {
+				closeAll()
+				return nil, fmt.Errorf("object is encrypted but KEYRING_FILE is not set")
+			}
+			wrapped, err := base64.StdEncoding.DecodeString(metadataValue(metadata, wrappedKeyMetadataKey))
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("invalid wrapped data key: %v", err)
+			}
+			keyID := metadataValue(metadata, keyIDMetadataKey)
+			dataKey, err := provider.Decrypt(keyID, wrapped)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			aead, err := newGCM(dataKey)
+			if err != nil {
+				closeAll()
+				return nil, err
+			}
+			r = &gcmReader{r: r, aead: aead, header: encodingHeader(recorded, keyID)}
+
+		case encodingZstd:
+			decompressor, err := zstd.NewReader(r)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("failed to create decompressor: %v", err)
+			}
+			decoders = append(decoders, decompressor.Close)
+			r = decompressor
+
+		default:
+			closeAll()
+			return nil, fmt.Errorf("unsupported object encoding %q", encodings[i])
+		}
+	}
+	return &decodedReader{Reader: r, close: closeAll}, nil
+}
+
+// decodeBytes undoes the encodings of an in-memory object
+func decodeBytes(data []byte, metadata map[string]*string) ([]byte, error) {
+	if err := checkEncodingPolicy(metadata); err != nil {
+		return nil, err
+	}
+	if metadataValue(metadata, encodingMetadataKey) == "" {
+		return data, nil
+	}
+	r, err := decodeReader(bytes.NewReader(data), metadata)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode object: %v", err)
+	}
+	return decoded, nil
+}
+
+// decodeFile writes the decoded contents of a downloaded object to localPath
+func decodeFile(rawPath string, metadata map[string]*string, localPath string) error {
+	if err := checkEncodingPolicy(metadata); err != nil {
+		return err
+	}
+	if metadataValue(metadata, encodingMetadataKey) == "" {
+		if err := os.Rename(rawPath, localPath); err != nil {
+			return fmt.Errorf("failed to move download into place: %v", err)
+		}
+		return nil
+	}
+
+	raw, err := os.Open(rawPath)
+	if err != nil {
+		return fmt.Errorf("failed to open download: %v", err)
+	}
+	defer raw.Close()
+
+	body, err := decodeReader(raw, metadata)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	return writeLocalFile(localPath, body)
+}
+
+// decodedReader releases decoder resources on Close
+type decodedReader struct {
+	io.Reader
+	close func()
+}
+
+func (d *decodedReader) Close() error {
+	d.close()
+	return nil
+}
+
+// gcmWriter seals a stream in AES-GCM frames of encryptionFrameBytes. Each
+// frame is a flag byte, marking the final frame, and a 4-byte length before
+// the sealed bytes. Every object has its own data key, so the frame counter
+// alone is a unique nonce. The flag is authenticated so truncation is
+// detected, and so is the encoding header from the object's metadata.
+type gcmWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+}
+
+func (g *gcmWriter) Write(p []byte) (int, error) {
+	g.buf = append(g.buf, p...)
+	for len(g.buf) > encryptionFrameBytes {
+		if err := g.seal(g.buf[:encryptionFrameBytes], false); err != nil {
+			return 0, err
+		}
+		g.buf = g.buf[encryptionFrameBytes:]
+	}
+	return len(p), nil
+}
+
+// Close seals the remaining bytes as the final frame
+func (g *gcmWriter) Close() error {
+	return g.seal(g.buf, true)
+}
+
+func (g *gcmWriter) seal(plaintext []byte, final bool) error {
+	header := make([]byte, 5)
+	if final {
+		header[0] = 1
+	}
+	sealed := g.aead.Seal(nil, frameNonce(g.aead, g.counter), plaintext, frameAAD(header[0], g.header))
+	g.counter++
+
+	binary.BigEndian.PutUint32(header[1:], uint32(len(sealed)))
+	if _, err := g.w.Write(header); err != nil {
+		return err
+	}
+	_, err := g.w.Write(sealed)
+	return err
+}
+
+// gcmReader opens the frames written by gcmWriter
+type gcmReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	header  []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func (g *gcmReader) Read(p []byte) (int, error) {
+	for len(g.buf) == 0 {
+		if g.done {
+			return 0, io.EOF
+		}
+		if err := g.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, g.buf)
+	g.buf = g.buf[n:]
+	return n, nil
+}
+
+func (g *gcmReader) next() error {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(g.r, header); err != nil {
+		return fmt.Errorf("encrypted object is truncated: %v", err)
+	}
+	size := binary.BigEndian.Uint32(header[1:])
+	if size > encryptionFrameBytes+uint32(g.aead.Overhead()) {
+		return fmt.Errorf("encrypted frame of %d bytes is too large", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(g.r, sealed); err != nil {
+		return fmt.Errorf("encrypted object is truncated: %v", err)
+	}
+
+	plaintext, err := g.aead.Open(nil, frameNonce(g.aead, g.counter), sealed, frameAAD(header[0], g.header))
+	if err != nil {
+		return fmt.Errorf("failed to decrypt object: %v", err)
+	}
+	g.counter++
+	g.buf = plaintext
+	g.done = header[0] == 1
+	return nil
+}
+
+// frameAAD returns the data a frame authenticates besides its contents
+func frameAAD(flag byte, header []byte) []byte {
+	return append([]byte{flag}, header...)
+}
+
+// frameNonce returns the nonce of a numbered frame
+func frameNonce(aead cipher.AEAD, counter uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// useTestKeyring makes a keyring with two keys the object key provider for
+// the rest of the test
+func useTestKeyring(t *testing.T) {
+	t.Helper()
+	keys := make(map[string]string)
+	for _, id := range []string{"k1", "k2"} {
+		key := make([]byte, 32)
+		rand.Read(key)
+		keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, err := json.Marshal(keyringFile{ActiveKeyID: "k1", Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := loadKeyring(path)
+	if err != nil {
+		t.Fatalf("loadKeyring: %v", err)
+	}
+
+	keyProviderOnce.Do(func() {})
+	previous := keyProvider
+	keyProvider = keyring
+	t.Cleanup(func() { keyProvider = previous })
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	useTestKeyring(t)
+	data := bytes.Repeat([]byte("cloudsqlite page "), encryptionFrameBytes/8)
+
+	tests := []struct {
+		name        string
+		compression string
+		encryption  string
+		encoding    string
+	}{
+		{name: "plain"},
+		{name: "compressed", compression: "zstd", encoding: "zstd"},
+		{name: "encrypted", encryption: "aes-gcm", encoding: "aes-gcm"},
+		{name: "compressed and encrypted", compression: "zstd", encryption: "aes-gcm", encoding: "zstd,aes-gcm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("OBJECT_COMPRESSION", tt.compression)
+			t.Setenv("OBJECT_ENCRYPTION", tt.encryption)
+
+			encoded, metadata, err := encodeBytes(data)
+			if err != nil {
+				t.Fatalf("encodeBytes: %v", err)
+			}
+			if got := metadataValue(metadata, encodingMetadataKey); got != tt.encoding {
+				t.Errorf("encoding metadata = %q, want %q", got, tt.encoding)
+			}
+			if tt.encoding != "" && bytes.Equal(encoded, data) {
+				t.Error("encoded object is the plaintext")
+			}
+			decoded, err := decodeBytes(encoded, metadata)
+			if err != nil {
+				t.Fatalf("decodeBytes: %v", err)
+			}
+			if !bytes.Equal(decoded, data) {
+				t.Error("decoded object differs from the original")
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsTamperedObjects(t *testing.T) {
+	useTestKeyring(t)
+	t.Setenv("OBJECT_COMPRESSION", "zstd")
+	t.Setenv("OBJECT_ENCRYPTION", "aes-gcm")
+	data := bytes.Repeat([]byte("secret row "), encryptionFrameBytes/4)
+
+	encoded, metadata, err := encodeBytes(data)
+	if err != nil {
+		t.Fatalf("encodeBytes: %v", err)
+	}
+
+	// tamper returns copies of the object and its metadata with one change
+	tamper := func(key, value string) ([]byte, map[string]*string) {
+		changed := make(map[string]*string)
+		for k, v := range metadata {
+			if !strings.EqualFold(k, key) {
+				changed[k] = v
+			}
+		}
+		if value != "" {
+			changed[key] = aws.String(value)
+		}
+		return bytes.Clone(encoded), changed
+	}
+
+	tests := []struct {
+		name           string
+		object         func() ([]byte, map[string]*string)
+		allowPlaintext bool
+		wantErr        string
+	}{
+		{
+			name:    "compression dropped from metadata",
+			object:  func() ([]byte, map[string]*string) { return tamper(encodingMetadataKey, "aes-gcm") },
+			wantErr: "authentication failed",
+		},
+		{
+			name:    "encodings reordered",
+			object:  func() ([]byte, map[string]*string) { return tamper(encodingMetadataKey, "aes-gcm,zstd") },
+			wantErr: "failed to decode",
+		},
+		{
+			name:    "key ID replaced",
+			object:  func() ([]byte, map[string]*string) { return tamper(keyIDMetadataKey, "k2") },
+			wantErr: "authentication failed",
+		},
+		{
+			name:    "encoding removed",
+			object:  func() ([]byte, map[string]*string) { return tamper(encodingMetadataKey, "") },
+			wantErr: "not encrypted",
+		},
+		{
+			name:           "encoding removed while plaintext is allowed",
+			object:         func() ([]byte, map[string]*string) { return tamper(encodingMetadataKey, "") },
+			allowPlaintext: true,
+		},
+		{
+			name: "ciphertext changed",
+			object: func() ([]byte, map[string]*string) {
+				object, changed := tamper(encodingMetadataKey, metadataValue(metadata, encodingMetadataKey))
+				object[len(object)/2] ^= 1
+				return object, changed
+			},
+			wantErr: "authentication failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.allowPlaintext {
+				t.Setenv("OBJECT_ENCRYPTION_ALLOW_PLAINTEXT", "on")
+			}
+			object, changed := tt.object()
+			decoded, err := decodeBytes(object, changed)
+			if tt.allowPlaintext {
+				// Read as stored, which is not the original contents
+				if err != nil || bytes.Equal(decoded, data) {
+					t.Errorf("decodeBytes = %d bytes, %v; want the stored bytes", len(decoded), err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("tampered object was decoded")
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error %q does not mention %q", err, tt.wantErr)
+			}
+		})
+	}
+}
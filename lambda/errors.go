@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Error codes returned in the code field of a failed request's SQLResult.
+// Clients can rely on these; the error message is for people.
+const (
+	errorCodeInvalidRequest     = "INVALID_REQUEST"
+	errorCodeForbidden          = "FORBIDDEN"
+	errorCodeNotFound           = "NOT_FOUND"
+	errorCodeConflict           = "CONFLICT"
+	errorCodeLockHeld           = "LOCK_HELD"
+	errorCodeSQLSyntax          = "SQL_SYNTAX"
+	errorCodeConstraint         = "CONSTRAINT"
+	errorCodeLimitExceeded      = "LIMIT_EXCEEDED"
+	errorCodeTimeout            = "TIMEOUT"
+	errorCodeDatabaseCorrupt    = "DATABASE_CORRUPT"
+	errorCodeStorageUnavailable = "STORAGE_UNAVAILABLE"
+	errorCodeInternal           = "INTERNAL"
+)
+
+// statusErrorCodes gives the code of an error response created with only a status
+var statusErrorCodes = map[int]string{
+	http.StatusBadRequest:          errorCodeInvalidRequest,
+	http.StatusForbidden:           errorCodeForbidden,
+	http.StatusNotFound:            errorCodeNotFound,
+	http.StatusConflict:            errorCodeConflict,
+	http.StatusInternalServerError: errorCodeInternal,
+}
+
+// classifyError returns the error code and HTTP status for an error from
+// SQLite, S3 or DynamoDB; anything unrecognised is an internal error
+func classifyError(err error) (string, int) {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		if limitErr.Limit == limitTimeout {
+			return errorCodeTimeout, limitStatusCode(limitErr)
+		}
+		return errorCodeLimitExceeded, limitStatusCode(limitErr)
+	}
+	var lockErr *LockWaitError
+	if errors.As(err, &lockErr) {
+		return errorCodeLockHeld, http.StatusConflict
+	}
+	if errors.Is(err, errLeaseLost) {
+		return errorCodeConflict, http.StatusConflict
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		switch sqliteErr.Code {
+		case sqlite3.ErrError, sqlite3.ErrRange:
+			// Syntax errors, unknown tables and columns, bad parameters
+			return errorCodeSQLSyntax, http.StatusBadRequest
+		case sqlite3.ErrReadonly:
+			// A statement that writes under a shared (read) lease
+			return errorCodeInvalidRequest, http.StatusBadRequest
+		case sqlite3.ErrConstraint, sqlite3.ErrMismatch:
+			return errorCodeConstraint, http.StatusConflict
+		case sqlite3.ErrBusy, sqlite3.ErrLocked:
+			return errorCodeLockHeld, http.StatusConflict
+		case sqlite3.ErrTooBig, sqlite3.ErrNomem:
+			return errorCodeLimitExceeded, http.StatusRequestEntityTooLarge
+		case sqlite3.ErrInterrupt:
+			return errorCodeTimeout, http.StatusUnprocessableEntity
+		case sqlite3.ErrCorrupt, sqlite3.ErrNotADB:
+			return errorCodeDatabaseCorrupt, http.StatusInternalServerError
+		}
+		return errorCodeInternal, http.StatusInternalServerError
+	}
+
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch {
+		case isNotFound(awsErr):
+			return errorCodeNotFound, http.StatusNotFound
+		case isConditionalCheckFailed(awsErr):
+			return errorCodeConflict, http.StatusConflict
+		case awsErr.Code() == request.CanceledErrorCode:
+			return errorCodeTimeout, http.StatusGatewayTimeout
+		case request.IsErrorThrottle(awsErr) || request.IsErrorRetryable(awsErr):
+			return errorCodeStorageUnavailable, http.StatusServiceUnavailable
+		}
+		if reqErr, ok := awsErr.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+			return errorCodeStorageUnavailable, http.StatusServiceUnavailable
+		}
+		return errorCodeInternal, http.StatusInternalServerError
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return errorCodeTimeout, http.StatusGatewayTimeout
+	}
+	return errorCodeInternal, http.StatusInternalServerError
+}
+
+// createFailureResponse creates the error response for a failed step, with
+// the code and status that match its cause. The message, if any, names the step.
+func createFailureResponse(message string, err error) events.APIGatewayProxyResponse {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		return createLimitErrorResponse(limitErr)
+	}
+	var lockErr *LockWaitError
+	if errors.As(err, &lockErr) {
+		return createLockErrorResponse(lockErr, lockErr.Waited)
+	}
+	code, statusCode := classifyError(err)
+	if message == "" {
+		return createCodedErrorResponse(statusCode, code, err.Error())
+	}
+	return createCodedErrorResponse(statusCode, code, fmt.Sprintf("%s: %v", message, err))
+}
+
+// createCodedErrorResponse creates an error API Gateway response with an error code
+func createCodedErrorResponse(statusCode int, code, message string) events.APIGatewayProxyResponse {
+	errorBody := SQLResult{
+		Success: false,
+		Code:    code,
+		Error:   message,
+	}
+	body, _ := json.Marshal(errorBody)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
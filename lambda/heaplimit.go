@@ -0,0 +1,16 @@
+package main
+
+// SQLite itself is compiled into the go-sqlite3 driver; only this one
+// function is needed that the driver does not expose.
+
+/*
+extern long long sqlite3_hard_heap_limit64(long long);
+*/
+import "C"
+
+// setHardHeapLimit sets SQLite's process-wide hard heap limit; 0 removes it.
+// Unlike PRAGMA hard_heap_limit, which can only lower the limit, this also
+// raises it.
+func setHardHeapLimit(n int64) {
+	C.sqlite3_hard_heap_limit64(C.longlong(n))
+}
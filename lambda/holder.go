@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// HolderIdentity says who holds or waits for a lease, for conflict errors
+// and lock listings
+type HolderIdentity struct {
+	RequestID       string `json:"request_id,omitempty" dynamodbav:"request_id,omitempty"`
+	FunctionName    string `json:"function_name,omitempty" dynamodbav:"function_name,omitempty"`
+	FunctionVersion string `json:"function_version,omitempty" dynamodbav:"function_version,omitempty"`
+	Hostname        string `json:"hostname,omitempty" dynamodbav:"hostname,omitempty"`
+	PID             int    `json:"pid" dynamodbav:"pid"`
+	Principal       string `json:"principal,omitempty" dynamodbav:"principal,omitempty"`
+}
+
+func (h HolderIdentity) String() string {
+	var parts []string
+	if h.RequestID != "" {
+		parts = append(parts, "request "+h.RequestID)
+	}
+	if h.FunctionName != "" {
+		parts = append(parts, fmt.Sprintf("function %s:%s", h.FunctionName, h.FunctionVersion))
+	}
+	parts = append(parts, fmt.Sprintf("host %s pid %d", h.Hostname, h.PID))
+	if h.Principal != "" {
+		parts = append(parts, "principal "+h.Principal)
+	}
+	return strings.Join(parts, ", ")
+}
+
+type holderContextKey struct{}
+
+// processHostname is this process's hostname, looked up once
+var processHostname, _ = os.Hostname()
+
+// withHolderIdentity attaches the identity of the request's caller and of
+// this process to ctx, for the leases the request takes
+func withHolderIdentity(ctx context.Context, request events.APIGatewayProxyRequest) context.Context {
+	holder := HolderIdentity{
+		RequestID:       request.RequestContext.RequestID,
+		FunctionName:    lambdacontext.FunctionName,
+		FunctionVersion: lambdacontext.FunctionVersion,
+		Hostname:        processHostname,
+		PID:             os.Getpid(),
+		Principal:       requestPrincipal(request),
+	}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		holder.RequestID = lc.AwsRequestID
+	}
+	return context.WithValue(ctx, holderContextKey{}, holder)
+}
+
+// holderIdentity returns the identity attached by withHolderIdentity, or
+// this process's identity alone
+func holderIdentity(ctx context.Context) HolderIdentity {
+	if holder, ok := ctx.Value(holderContextKey{}).(HolderIdentity); ok {
+		return holder
+	}
+	return HolderIdentity{
+		FunctionName:    lambdacontext.FunctionName,
+		FunctionVersion: lambdacontext.FunctionVersion,
+		Hostname:        processHostname,
+		PID:             os.Getpid(),
+	}
+}
+
+// requestPrincipal names the caller from the API Gateway request context
+func requestPrincipal(request events.APIGatewayProxyRequest) string {
+	if principal, ok := request.RequestContext.Authorizer["principalId"].(string); ok && principal != "" {
+		return principal
+	}
+	if arn := request.RequestContext.Identity.UserArn; arn != "" {
+		return arn
+	}
+	if caller := request.RequestContext.Identity.Caller; caller != "" {
+		return caller
+	}
+	return ""
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+const (
+	// Object metadata holding the hex SHA-256 of the stored bytes
+	checksumMetadataKey = "Sha256"
+
+	// Integrity check modes
+	integrityQuick = "quick" // PRAGMA quick_check
+	integrityFull  = "full"  // PRAGMA integrity_check
+	integrityOff   = "off"
+)
+
+// integrityMode returns INTEGRITY_CHECK or the default quick check
+func integrityMode() string {
+	switch mode := os.Getenv("INTEGRITY_CHECK"); mode {
+	case "":
+		return integrityQuick
+	case integrityQuick, integrityFull, integrityOff:
+		return mode
+	default:
+		slog.Warn("Ignoring invalid INTEGRITY_CHECK", "value", mode)
+		return integrityQuick
+	}
+}
+
+// checkIntegrity runs SQLite's consistency check on a working copy
+func checkIntegrity(dbPath string) error {
+	pragma := "PRAGMA quick_check"
+	switch integrityMode() {
+	case integrityOff:
+		return nil
+	case integrityFull:
+		pragma = "PRAGMA integrity_check"
+	}
+
+	// Checked without a heap limit, not under a request's
+	release, _ := enterHeapLimit(context.Background(), QueryLimits{})
+	defer release()
+
+	db, err := sql.Open(sqliteDriverName, dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(pragma)
+	if err != nil {
+		return fmt.Errorf("integrity check failed: %v", err)
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return fmt.Errorf("integrity check failed: %v", err)
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("integrity check failed: %v", err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database %s is corrupt: %s", dbPath, strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 of a local file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// bytesChecksum returns the hex SHA-256 of an in-memory object
+func bytesChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// objectMetadata returns the metadata of an uploaded object: its encoding
+// and, unless it is encrypted, the checksum of its contents. AES-GCM already
+// authenticates an encrypted object, and a plaintext hash beside it would let
+// anyone who can read the metadata confirm a guessed database.
+func objectMetadata(encoding map[string]*string, checksum string) map[string]*string {
+	if isEncrypted(encoding) {
+		return encoding
+	}
+	return mergeMetadata(encoding, map[string]*string{checksumMetadataKey: aws.String(checksum)})
+}
+
+// storedChecksum returns the checksum recorded in object metadata, if any
+func storedChecksum(metadata map[string]*string) string {
+	return metadataValue(metadata, checksumMetadataKey)
+}
+
+// verifyChecksum compares the checksum of a downloaded object's decoded
+// contents with the one recorded on upload. Objects written before
+// checksums were recorded are accepted.
+func verifyChecksum(key string, metadata map[string]*string, actual string) error {
+	expected := storedChecksum(metadata)
+	if expected == "" || strings.EqualFold(expected, actual) {
+		return nil
+	}
+	return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", key, expected, actual)
+}
+
+// verifyFileChecksum checks a downloaded file against the object's checksum
+func verifyFileChecksum(key string, metadata map[string]*string, path string) error {
+	if storedChecksum(metadata) == "" {
+		return nil
+	}
+	actual, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	return verifyChecksum(key, metadata, actual)
+}
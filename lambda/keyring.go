@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Size of the AES-256 data keys that encrypt objects
+const dataKeyBytes = 32
+
+// KeyProvider issues and unwraps per-object data keys. Its methods mirror
+// KMS GenerateDataKey and Decrypt, so a KMS-backed provider can replace the
+// local keyring without changing the object format.
+type KeyProvider interface {
+	// GenerateDataKey returns a new data key in plaintext and wrapped under
+	// the active master key, along with that key's ID
+	GenerateDataKey() (keyID string, plaintext, wrapped []byte, err error)
+
+	// Decrypt unwraps a data key with the master key it was wrapped under
+	Decrypt(keyID string, wrapped []byte) ([]byte, error)
+
+	// AddressKey returns the HMAC key content addresses are computed with,
+	// derived from a master key, and that key's ID; an empty keyID selects
+	// the active master key
+	AddressKey(keyID string) (string, []byte, error)
+}
+
+// keyringFile is the JSON layout of KEYRING_FILE. Old keys stay in the file
+// after rotation so objects written under them can still be read.
+type keyringFile struct {
+	ActiveKeyID string            `json:"active_key_id"`
+	Keys        map[string]string `json:"keys"` // key ID to base64 AES-256 key
+}
+
+// localKeyring wraps data keys with AES-GCM master keys read from a file
+type localKeyring struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+	addressKeys map[string][]byte
+}
+
+var (
+	keyProviderOnce sync.Once
+	keyProvider     KeyProvider
+	keyProviderErr  error
+)
+
+// objectKeyProvider returns the key provider configured by KEYRING_FILE,
+// or nil if none is configured
+func objectKeyProvider() (KeyProvider, error) {
+	keyProviderOnce.Do(func() {
+		path := os.Getenv("KEYRING_FILE")
+		if path == "" {
+			return
+		}
+		keyring, err := loadKeyring(path)
+		if err != nil {
+			keyProviderErr = err
+			return
+		}
+		keyProvider = keyring
+	})
+	return keyProvider, keyProviderErr
+}
+
+// loadKeyring reads a keyring file
+func loadKeyring(path string) (*localKeyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+
+	var file keyringFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring: %v", err)
+	}
+
+	keyring := &localKeyring{
+		activeKeyID: file.ActiveKeyID,
+		keys:        make(map[string]cipher.AEAD),
+		addressKeys: make(map[string][]byte),
+	}
+	for id, encoded := range file.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeyBytes {
+			return nil, fmt.Errorf("keyring key %s must be %d base64-encoded bytes", id, dataKeyBytes)
+		}
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[id] = aead
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte("cloudsqlite content address"))
+		keyring.addressKeys[id] = mac.Sum(nil)
+	}
+	if _, ok := keyring.keys[keyring.activeKeyID]; !ok {
+		return nil, fmt.Errorf("keyring has no active key %q", keyring.activeKeyID)
+	}
+	return keyring, nil
+}
+
+// GenerateDataKey creates a random data key wrapped under the active master key
+func (k *localKeyring) GenerateDataKey() (string, []byte, []byte, error) {
+	plaintext := make([]byte, dataKeyBytes)
+	if _, err := rand.Read(plaintext); err != nil {
+		return "", nil, nil, fmt.Errorf("failed to generate data key: %v", err)
+	}
+
+	aead := k.keys[k.activeKeyID]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	wrapped := aead.Seal(nonce, nonce, plaintext, []byte(k.activeKeyID))
+	return k.activeKeyID, plaintext, wrapped, nil
+}
+
+// Decrypt unwraps a data key
+func (k *localKeyring) Decrypt(keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("keyring has no key %q", keyID)
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, fmt.Errorf("wrapped data key is too short")
+	}
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	return plaintext, nil
+}
+
+// AddressKey returns the content address key derived from a master key
+func (k *localKeyring) AddressKey(keyID string) (string, []byte, error) {
+	if keyID == "" {
+		keyID = k.activeKeyID
+	}
+	key, ok := k.addressKeys[keyID]
+	if !ok {
+		return "", nil, fmt.Errorf("keyring has no key %q", keyID)
+	}
+	return keyID, key, nil
+}
+
+// newGCM returns AES-GCM for a 256-bit key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCM: %v", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+const (
+	// Lease modes: any number of shared leases, or one exclusive lease
+	leaseShared    = "shared"
+	leaseExclusive = "exclusive"
+
+	// How long a writer blocked by readers keeps new readers out without
+	// renewing its claim
+	writerWaitTimeout = 10 * time.Second
+
+	// Attempts at a lock update that loses a race with another one
+	lockUpdateAttempts = 5
+)
+
+// LockHeldError reports that a lease was refused because another instance
+// holds the lock or is waiting for it. Only this error is worth waiting out.
+type LockHeldError struct {
+	Reason string
+}
+
+func (e *LockHeldError) Error() string {
+	return e.Reason
+}
+
+// lockHeld returns a LockHeldError with a formatted reason
+func lockHeld(format string, args ...any) error {
+	return &LockHeldError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// errLeaseLost is returned when a lease was released or has expired before
+// its holder finished with the database
+var errLeaseLost = errors.New("lease was lost")
+
+type leaseFenceKey struct{}
+
+// leaseFence names the exclusive lease a request holds on a database
+type leaseFence struct {
+	databaseName string
+	instanceID   string
+}
+
+// withLeaseFence records in ctx that the request holds a database's
+// exclusive lease, so its uploads check the lease before they publish
+func withLeaseFence(ctx context.Context, databaseName, instanceID string) context.Context {
+	return context.WithValue(ctx, leaseFenceKey{}, leaseFence{databaseName: databaseName, instanceID: instanceID})
+}
+
+// fenceLease confirms, right before a database's new version is published,
+// that the request still holds its exclusive lease, and renews the lease so
+// it cannot lapse while publishing. The check is a write conditional on the
+// lock item's version, so it fails if the lease is force-released or taken
+// over at the same time. Requests without a fence for the database pass.
+func fenceLease(ctx context.Context, databaseName string) error {
+	fence, ok := ctx.Value(leaseFenceKey{}).(leaseFence)
+	if !ok || fence.databaseName != databaseName {
+		return nil
+	}
+	return renewDynamoLease(ctx, databaseName, fence.instanceID, leaseExclusive)
+}
+
+// renewDynamoLease extends a lease taken with acquireDynamoLease by a full
+// lease term, or returns errLeaseLost if it is no longer held
+func renewDynamoLease(ctx context.Context, databaseName, instanceID, mode string) error {
+	err := updateLock(databaseName, func(lock *LockItem) (bool, error) {
+		if err := lock.renew(instanceID, mode, time.Now()); err != nil {
+			return false, fmt.Errorf("%w %s", err, databaseName)
+		}
+		return true, nil
+	})
+	if err == nil {
+		slog.DebugContext(ctx, "Renewed lease", "database", databaseName, "mode", mode, "lock_holder", instanceID)
+	}
+	return err
+}
+
+// startLeaseHeartbeat renews a lease every third of the lease term until the
+// returned function is called, which must happen before the lease is
+// released. If the lease is lost, the returned context is cancelled with
+// errLeaseLost as its cause, interrupting whatever runs under it.
+func startLeaseHeartbeat(ctx context.Context, databaseName, instanceID, mode string) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(time.Duration(lockTimeoutMinutes) * time.Minute / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				err := renewDynamoLease(ctx, databaseName, instanceID, mode)
+				if errors.Is(err, errLeaseLost) {
+					slog.WarnContext(ctx, "Lease lost while in use", "database", databaseName, "mode", mode, "lock_holder", instanceID, "error", err)
+					cancel(err)
+					return
+				}
+				if err != nil {
+					// Retried at the next tick, while the lease still has two thirds left
+					slog.WarnContext(ctx, "Failed to renew lease", "database", databaseName, "mode", mode, "lock_holder", instanceID, "error", err)
+				}
+			}
+		}
+	}()
+	return ctx, func() {
+		close(stop)
+		<-done
+		cancel(nil)
+	}
+}
+
+// leaseMode returns the lease a SQL statement needs
+func leaseMode(sqlStatement string) string {
+	if isSelectStatement(sqlStatement) {
+		return leaseShared
+	}
+	return leaseExclusive
+}
+
+// active drops expired leases and writer claims from a lock item
+func (l *LockItem) active(now int64) {
+	if l.Mode == "" && l.InstanceID != "" {
+		l.Mode = leaseExclusive // written before shared leases existed
+	}
+	if l.Mode == leaseExclusive && l.LeaseTimeout <= now {
+		l.Mode, l.InstanceID = "", ""
+	}
+	for id, expires := range l.Readers {
+		if expires <= now {
+			delete(l.Readers, id)
+		}
+	}
+	if l.WriterWaitingUntil <= now {
+		l.WriterWaiting, l.WriterWaitingUntil = "", 0
+	}
+	if l.Mode == leaseShared && len(l.Readers) == 0 {
+		l.Mode = ""
+	}
+	for id := range l.Holders {
+		if _, reading := l.Readers[id]; !reading && id != l.InstanceID && id != l.WriterWaiting {
+			delete(l.Holders, id)
+		}
+	}
+}
+
+// describe names an instance with its recorded identity
+func (l *LockItem) describe(instanceID string) string {
+	if holder, ok := l.Holders[instanceID]; ok {
+		return fmt.Sprintf("instance %s (%s)", instanceID, holder)
+	}
+	return "instance " + instanceID
+}
+
+// recordHolder remembers who an instance in the item is
+func (l *LockItem) recordHolder(instanceID string, holder HolderIdentity) {
+	if l.Holders == nil {
+		l.Holders = make(map[string]HolderIdentity)
+	}
+	l.Holders[instanceID] = holder
+}
+
+// grant adds a lease to a lock item. Writers are preferred: a writer blocked
+// by readers records that it is waiting, which keeps new readers out until
+// the readers drain. The result reports whether the item must be saved, which
+// is also the case when such a writer is refused. Granting a lease the
+// instance already holds renews it, so a grant whose save failed ambiguously
+// but was applied can be repeated.
+func (l *LockItem) grant(instanceID, mode string, holder HolderIdentity, now time.Time) (bool, error) {
+	l.active(now.Unix())
+	if l.holds(instanceID, mode) {
+		l.recordHolder(instanceID, holder)
+		return true, l.renew(instanceID, mode, now)
+	}
+	if l.Mode == leaseExclusive {
+		return false, lockHeld("database is locked by %s until %s", l.describe(l.InstanceID), time.Unix(l.LeaseTimeout, 0).UTC().Format(time.RFC3339))
+	}
+	otherWriterWaiting := l.WriterWaiting != "" && l.WriterWaiting != instanceID
+	lease := now.Add(time.Duration(lockTimeoutMinutes) * time.Minute).Unix()
+
+	switch mode {
+	case leaseShared:
+		if otherWriterWaiting {
+			return false, lockHeld("writer %s is waiting for the lock", l.describe(l.WriterWaiting))
+		}
+		if l.Mode == "" {
+			l.CreatedAt = now.Unix()
+		}
+		if l.Readers == nil {
+			l.Readers = make(map[string]int64)
+		}
+		l.Mode = leaseShared
+		l.Readers[instanceID] = lease
+
+	case leaseExclusive:
+		if len(l.Readers) > 0 {
+			if otherWriterWaiting {
+				return false, lockHeld("database has %d readers and writer %s is waiting", len(l.Readers), l.describe(l.WriterWaiting))
+			}
+			l.WriterWaiting = instanceID
+			l.WriterWaitingUntil = now.Add(writerWaitTimeout).Unix()
+			l.recordHolder(instanceID, holder)
+			l.updateLeaseTimeout(0)
+			return true, lockHeld("database has %d readers", len(l.Readers))
+		}
+		if otherWriterWaiting {
+			return false, lockHeld("writer %s is waiting for the lock", l.describe(l.WriterWaiting))
+		}
+		l.Mode = leaseExclusive
+		l.InstanceID = instanceID
+		l.CreatedAt = now.Unix()
+		l.WriterWaiting, l.WriterWaitingUntil = "", 0
+
+	default:
+		return false, fmt.Errorf("unknown lease mode %q", mode)
+	}
+
+	l.recordHolder(instanceID, holder)
+	l.updateLeaseTimeout(lease)
+	return true, nil
+}
+
+// withdraw removes a writer's claim from a lock item once the writer has
+// stopped waiting, and reports whether there was one
+func (l *LockItem) withdraw(instanceID string) bool {
+	l.active(time.Now().Unix())
+	if l.WriterWaiting != instanceID {
+		return false
+	}
+	l.WriterWaiting, l.WriterWaitingUntil = "", 0
+	delete(l.Holders, instanceID)
+	l.updateLeaseTimeout(0)
+	return true
+}
+
+// revoke removes a lease from a lock item
+func (l *LockItem) revoke(instanceID, mode string) error {
+	l.active(time.Now().Unix())
+	switch mode {
+	case leaseShared:
+		if _, ok := l.Readers[instanceID]; !ok {
+			return fmt.Errorf("instance %s holds no shared lease", instanceID)
+		}
+		delete(l.Readers, instanceID)
+		delete(l.Holders, instanceID)
+		if len(l.Readers) == 0 {
+			l.Mode = ""
+		}
+	default:
+		if l.Mode != leaseExclusive || l.InstanceID != instanceID {
+			return fmt.Errorf("instance %s does not hold the lock", instanceID)
+		}
+		delete(l.Holders, instanceID)
+		l.Mode, l.InstanceID = "", ""
+	}
+	l.updateLeaseTimeout(0)
+	return nil
+}
+
+// holds reports whether an instance holds a lease of the given mode
+func (l *LockItem) holds(instanceID, mode string) bool {
+	if mode == leaseShared {
+		_, ok := l.Readers[instanceID]
+		return ok
+	}
+	return l.Mode == leaseExclusive && l.InstanceID == instanceID
+}
+
+// renew extends an instance's lease by a full lease term from now, or
+// returns errLeaseLost if the instance no longer holds it
+func (l *LockItem) renew(instanceID, mode string, now time.Time) error {
+	l.active(now.Unix())
+	lease := now.Add(time.Duration(lockTimeoutMinutes) * time.Minute).Unix()
+	if !l.holds(instanceID, mode) {
+		return fmt.Errorf("%w: %s no longer holds its %s lease on", errLeaseLost, instanceID, mode)
+	}
+	if mode == leaseShared {
+		l.Readers[instanceID] = lease
+		lease = 0
+	}
+	l.updateLeaseTimeout(lease)
+	return nil
+}
+
+// updateLeaseTimeout sets lease_timeout, which the table's TTL also uses, to
+// the latest expiry of anything the item still records
+func (l *LockItem) updateLeaseTimeout(exclusiveLease int64) {
+	latest := l.WriterWaitingUntil
+	if l.Mode == leaseExclusive {
+		if exclusiveLease == 0 {
+			exclusiveLease = l.LeaseTimeout
+		}
+		latest = max(latest, exclusiveLease)
+	}
+	for _, expires := range l.Readers {
+		latest = max(latest, expires)
+	}
+	l.LeaseTimeout = latest
+}
+
+// empty reports whether a lock item records nothing
+func (l *LockItem) empty() bool {
+	return l.Mode == "" && len(l.Readers) == 0 && l.WriterWaiting == ""
+}
+
+// loadLock reads a database's lock item; a missing item is returned empty
+func loadLock(databaseName string) (*LockItem, bool, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(lockTableName),
+		Key: map[string]*dynamodb.AttributeValue{
+			"database_name": {S: aws.String(databaseName)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check existing lock: %w", err)
+	}
+	if result.Item == nil {
+		return &LockItem{DatabaseName: databaseName}, false, nil
+	}
+
+	var lock LockItem
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &lock); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal existing lock: %v", err)
+	}
+	return &lock, true, nil
+}
+
+// saveLock writes a lock item back if nobody has changed it since it was
+// read, deleting it once it records nothing
+func saveLock(lock *LockItem, existed bool) error {
+	var condition *string
+	values := map[string]*dynamodb.AttributeValue{}
+	switch {
+	case !existed:
+		condition = aws.String("attribute_not_exists(database_name)")
+	case lock.Version == 0:
+		condition = aws.String("attribute_not_exists(version)")
+	default:
+		condition = aws.String("version = :version")
+		values[":version"] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(lock.Version, 10))}
+	}
+	if len(values) == 0 {
+		values = nil
+	}
+	key := map[string]*dynamodb.AttributeValue{
+		"database_name": {S: aws.String(lock.DatabaseName)},
+	}
+
+	if lock.empty() {
+		if !existed {
+			return nil
+		}
+		_, err := dynamoClient.DeleteItem(&dynamodb.DeleteItemInput{
+			TableName:                 aws.String(lockTableName),
+			Key:                       key,
+			ConditionExpression:       condition,
+			ExpressionAttributeValues: values,
+		})
+		return err
+	}
+
+	updated := *lock
+	updated.Version++
+	item, err := dynamodbattribute.MarshalMap(updated)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock item: %v", err)
+	}
+	_, err = dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName:                 aws.String(lockTableName),
+		Item:                      item,
+		ConditionExpression:       condition,
+		ExpressionAttributeValues: values,
+	})
+	return err
+}
+
+// updateLock applies change to a database's lock item and saves it when
+// change asks to, retrying when another update wins the race
+func updateLock(databaseName string, change func(lock *LockItem) (bool, error)) error {
+	for attempt := 1; ; attempt++ {
+		lock, existed, err := loadLock(databaseName)
+		if err != nil {
+			return err
+		}
+
+		save, changeErr := change(lock)
+		if !save {
+			return changeErr
+		}
+		err = saveLock(lock, existed)
+		if err == nil {
+			return changeErr
+		}
+		// A save that may have been applied is read back rather than repeated
+		if isAmbiguousError(err) && lockSaved(lock) {
+			return changeErr
+		}
+		if !(isConditionalCheckFailed(err) || isAmbiguousError(err)) {
+			return fmt.Errorf("failed to update lock: %w", err)
+		}
+		if attempt == lockUpdateAttempts {
+			if isConditionalCheckFailed(err) {
+				return lockHeld("lock is contended: lost %d races to update it", attempt)
+			}
+			return fmt.Errorf("failed to update lock: %w", err)
+		}
+	}
+}
+
+// lockSaved reports whether a save of lock that failed ambiguously was
+// applied, by comparing the stored item with the one the save would write
+func lockSaved(lock *LockItem) bool {
+	current, exists, err := loadLock(lock.DatabaseName)
+	if err != nil {
+		slog.Warn("Failed to check lock update", "database", lock.DatabaseName, "error", err)
+		return false
+	}
+	if lock.empty() {
+		return !exists
+	}
+	expected := *lock
+	expected.Version++
+	want, err := dynamodbattribute.MarshalMap(expected)
+	if err != nil {
+		return false
+	}
+	got, err := dynamodbattribute.MarshalMap(current)
+	return err == nil && reflect.DeepEqual(want, got)
+}
+
+// acquireDynamoLease takes a shared or exclusive lease on a database for
+// the holder identified in ctx
+func acquireDynamoLease(ctx context.Context, databaseName, instanceID, mode string) (err error) {
+	ctx, span := startSpan(ctx, "lock.acquire", semconv.DBNamespace(databaseName),
+		attribute.String("cloudsqlite.lock.mode", mode), attribute.String("cloudsqlite.lock.holder", instanceID))
+	defer func() { endSpan(span, err) }()
+
+	holder := holderIdentity(ctx)
+	err = updateLock(databaseName, func(lock *LockItem) (bool, error) {
+		return lock.grant(instanceID, mode, holder, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+	slog.DebugContext(ctx, "Acquired lease", "database", databaseName, "mode", mode, "lock_holder", instanceID, "holder", holder.String())
+	return nil
+}
+
+// releaseDynamoLease gives up a lease taken with acquireDynamoLease
+func releaseDynamoLease(ctx context.Context, databaseName, instanceID, mode string) (err error) {
+	ctx, span := startSpan(ctx, "lock.release", semconv.DBNamespace(databaseName),
+		attribute.String("cloudsqlite.lock.mode", mode), attribute.String("cloudsqlite.lock.holder", instanceID))
+	defer func() { endSpan(span, err) }()
+
+	err = updateLock(databaseName, func(lock *LockItem) (bool, error) {
+		if err := lock.revoke(instanceID, mode); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to release lease", "database", databaseName, "mode", mode, "lock_holder", instanceID, "error", err)
+		return err
+	}
+	slog.DebugContext(ctx, "Released lease", "database", databaseName, "mode", mode, "lock_holder", instanceID)
+	return nil
+}
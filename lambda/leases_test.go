@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// testNow is the time lock items in these tests are evaluated at
+var testNow = time.Unix(1700000000, 0)
+
+// testLease returns an expiry that many seconds after testNow
+func testLease(seconds int64) int64 {
+	return testNow.Unix() + seconds
+}
+
+func TestLockItemGrant(t *testing.T) {
+	tests := []struct {
+		name       string
+		lock       LockItem
+		instance   string
+		mode       string
+		wantSave   bool
+		wantHeld   bool
+		wantMode   string
+		wantHolder string // exclusive holder afterwards
+		wantWriter string // waiting writer afterwards
+	}{
+		{
+			name:     "shared on a free lock",
+			instance: "r1", mode: leaseShared,
+			wantSave: true, wantMode: leaseShared,
+		},
+		{
+			name:     "exclusive on a free lock",
+			instance: "w1", mode: leaseExclusive,
+			wantSave: true, wantMode: leaseExclusive, wantHolder: "w1",
+		},
+		{
+			name:     "shared alongside readers",
+			lock:     LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)}},
+			instance: "r2", mode: leaseShared,
+			wantSave: true, wantMode: leaseShared,
+		},
+		{
+			name:     "shared under a writer",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60)},
+			instance: "r1", mode: leaseShared,
+			wantHeld: true, wantMode: leaseExclusive, wantHolder: "w1",
+		},
+		{
+			name:     "exclusive under a writer",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60)},
+			instance: "w2", mode: leaseExclusive,
+			wantHeld: true, wantMode: leaseExclusive, wantHolder: "w1",
+		},
+		{
+			name:     "exclusive after the writer's lease expired",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(-1)},
+			instance: "w2", mode: leaseExclusive,
+			wantSave: true, wantMode: leaseExclusive, wantHolder: "w2",
+		},
+		{
+			name:     "writer blocked by readers records its claim",
+			lock:     LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)}},
+			instance: "w1", mode: leaseExclusive,
+			wantSave: true, wantHeld: true, wantMode: leaseShared, wantWriter: "w1",
+		},
+		{
+			name: "new reader waits behind a waiting writer",
+			lock: LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)},
+				WriterWaiting: "w1", WriterWaitingUntil: testLease(10)},
+			instance: "r2", mode: leaseShared,
+			wantHeld: true, wantMode: leaseShared, wantWriter: "w1",
+		},
+		{
+			name: "second writer waits behind a waiting writer",
+			lock: LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)},
+				WriterWaiting: "w1", WriterWaitingUntil: testLease(10)},
+			instance: "w2", mode: leaseExclusive,
+			wantHeld: true, wantMode: leaseShared, wantWriter: "w1",
+		},
+		{
+			name:     "waiting writer gets in once the readers drain",
+			lock:     LockItem{WriterWaiting: "w1", WriterWaitingUntil: testLease(10)},
+			instance: "w1", mode: leaseExclusive,
+			wantSave: true, wantMode: leaseExclusive, wantHolder: "w1",
+		},
+		{
+			name: "readers are let in after a writer's claim lapses",
+			lock: LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)},
+				WriterWaiting: "w1", WriterWaitingUntil: testLease(-1)},
+			instance: "r2", mode: leaseShared,
+			wantSave: true, wantMode: leaseShared,
+		},
+		{
+			name:     "exclusive holder asking again renews its lease",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60)},
+			instance: "w1", mode: leaseExclusive,
+			wantSave: true, wantMode: leaseExclusive, wantHolder: "w1",
+		},
+		{
+			name: "reader asking again is not kept out by a waiting writer",
+			lock: LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)},
+				WriterWaiting: "w1", WriterWaitingUntil: testLease(10)},
+			instance: "r1", mode: leaseShared,
+			wantSave: true, wantMode: leaseShared, wantWriter: "w1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := tt.lock
+			save, err := lock.grant(tt.instance, tt.mode, HolderIdentity{PID: 1}, testNow)
+			if save != tt.wantSave {
+				t.Errorf("save = %v, want %v", save, tt.wantSave)
+			}
+			if held := isLockHeld(err); held != tt.wantHeld || (err != nil && !held) {
+				t.Errorf("error = %v, want held %v", err, tt.wantHeld)
+			}
+			if lock.Mode != tt.wantMode || lock.InstanceID != tt.wantHolder || lock.WriterWaiting != tt.wantWriter {
+				t.Errorf("lock mode %q holder %q writer %q, want %q, %q and %q",
+					lock.Mode, lock.InstanceID, lock.WriterWaiting, tt.wantMode, tt.wantHolder, tt.wantWriter)
+			}
+			if err == nil {
+				if !lock.holds(tt.instance, tt.mode) {
+					t.Errorf("%s does not hold the %s lease it was granted", tt.instance, tt.mode)
+				}
+				if lock.LeaseTimeout < testLease(int64(lockTimeoutMinutes)*60) {
+					t.Errorf("lease_timeout %d is before the new lease ends", lock.LeaseTimeout)
+				}
+			}
+		})
+	}
+}
+
+func TestLockItemRevoke(t *testing.T) {
+	readers := func() map[string]int64 {
+		return map[string]int64{"r1": testLease(60), "r2": testLease(120)}
+	}
+
+	tests := []struct {
+		name        string
+		lock        LockItem
+		instance    string
+		mode        string
+		wantErr     bool
+		wantMode    string
+		wantReaders int
+	}{
+		{
+			name:     "exclusive holder",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60)},
+			instance: "w1", mode: leaseExclusive,
+		},
+		{
+			name:     "not the exclusive holder",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60)},
+			instance: "w2", mode: leaseExclusive,
+			wantErr: true, wantMode: leaseExclusive,
+		},
+		{
+			name:     "one of two readers",
+			lock:     LockItem{Mode: leaseShared, Readers: readers()},
+			instance: "r1", mode: leaseShared,
+			wantMode: leaseShared, wantReaders: 1,
+		},
+		{
+			name:     "unknown reader",
+			lock:     LockItem{Mode: leaseShared, Readers: readers()},
+			instance: "r3", mode: leaseShared,
+			wantErr: true, wantMode: leaseShared, wantReaders: 2,
+		},
+		{
+			name:     "last reader",
+			lock:     LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)}},
+			instance: "r1", mode: leaseShared,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// revoke expires leases against the clock, so move them there
+			lock := tt.lock
+			shift := time.Now().Unix() - testNow.Unix()
+			if lock.LeaseTimeout != 0 {
+				lock.LeaseTimeout += shift
+			}
+			for id := range lock.Readers {
+				lock.Readers[id] += shift
+			}
+
+			err := lock.revoke(tt.instance, tt.mode)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("revoke error = %v, want error %v", err, tt.wantErr)
+			}
+			if lock.Mode != tt.wantMode || len(lock.Readers) != tt.wantReaders {
+				t.Errorf("lock mode %q with %d readers, want %q with %d", lock.Mode, len(lock.Readers), tt.wantMode, tt.wantReaders)
+			}
+		})
+	}
+}
+
+func TestLockItemEvict(t *testing.T) {
+	// A writer holding the lock, or two readers with a writer waiting for them
+	writing := func() LockItem {
+		return LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60),
+			Holders: map[string]HolderIdentity{"w1": {PID: 1}}}
+	}
+	reading := func() LockItem {
+		return LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60), "r2": testLease(120)},
+			WriterWaiting: "w1", WriterWaitingUntil: testLease(10), LeaseTimeout: testLease(120),
+			Holders: map[string]HolderIdentity{"r1": {PID: 1}, "r2": {PID: 2}, "w1": {PID: 3}}}
+	}
+
+	tests := []struct {
+		name        string
+		lock        LockItem
+		instance    string
+		wantFound   bool
+		wantMode    string
+		wantReaders []string
+		wantWriter  string
+		wantTimeout int64
+	}{
+		{
+			name: "exclusive holder", lock: writing(), instance: "w1",
+			wantFound: true,
+		},
+		{
+			name: "someone else", lock: writing(), instance: "w2",
+			wantMode: leaseExclusive, wantTimeout: testLease(60),
+		},
+		{
+			name: "one reader keeps the others and the waiting writer", lock: reading(), instance: "r2",
+			wantFound: true, wantMode: leaseShared, wantReaders: []string{"r1"}, wantWriter: "w1", wantTimeout: testLease(60),
+		},
+		{
+			name: "waiting writer keeps the readers", lock: reading(), instance: "w1",
+			wantFound: true, wantMode: leaseShared, wantReaders: []string{"r1", "r2"}, wantTimeout: testLease(120),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := tt.lock
+			if found := lock.evict(tt.instance); found != tt.wantFound {
+				t.Errorf("evict = %v, want %v", found, tt.wantFound)
+			}
+			if lock.Mode != tt.wantMode || lock.WriterWaiting != tt.wantWriter || lock.LeaseTimeout != tt.wantTimeout {
+				t.Errorf("lock mode %q writer %q lease_timeout %d, want %q, %q and %d",
+					lock.Mode, lock.WriterWaiting, lock.LeaseTimeout, tt.wantMode, tt.wantWriter, tt.wantTimeout)
+			}
+			if len(lock.Readers) != len(tt.wantReaders) {
+				t.Errorf("readers %v, want %v", lock.Readers, tt.wantReaders)
+			}
+			for _, id := range tt.wantReaders {
+				if _, ok := lock.Readers[id]; !ok {
+					t.Errorf("reader %s was evicted", id)
+				}
+			}
+			if _, ok := lock.Holders[tt.instance]; ok && tt.wantFound {
+				t.Errorf("identity of evicted %s is still recorded", tt.instance)
+			}
+		})
+	}
+}
+
+func TestLockItemSteal(t *testing.T) {
+	writing := LockItem{DatabaseName: "a.db", Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(60),
+		Holders: map[string]HolderIdentity{"w1": {PID: 1}}, Version: 3}
+	reading := LockItem{DatabaseName: "a.db", Mode: leaseShared, Readers: map[string]int64{"r1": testLease(60)},
+		WriterWaiting: "w1", WriterWaitingUntil: testLease(10), LeaseTimeout: testLease(60),
+		Holders: map[string]HolderIdentity{"r1": {PID: 1}, "w1": {PID: 2}}, Version: 3}
+
+	tests := []struct {
+		name     string
+		lock     LockItem
+		previous string
+		wantTook bool
+	}{
+		{name: "from the exclusive holder", lock: writing, wantTook: true},
+		{name: "from readers and a waiting writer", lock: reading, wantTook: true},
+		{name: "unlocked", lock: LockItem{DatabaseName: "a.db"}, wantTook: true},
+		{name: "named holder holds it", lock: writing, previous: "w1", wantTook: true},
+		{name: "named waiting writer holds a claim", lock: reading, previous: "w1", wantTook: true},
+		{name: "named holder does not hold it", lock: writing, previous: "w2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := tt.lock
+			if took := lock.steal(tt.previous, "admin-1", HolderIdentity{PID: 9}, testNow); took != tt.wantTook {
+				t.Fatalf("steal = %v, want %v", took, tt.wantTook)
+			}
+			if !tt.wantTook {
+				if lock.Mode != tt.lock.Mode || lock.InstanceID != tt.lock.InstanceID {
+					t.Errorf("refused steal changed the lock to %q held by %q", lock.Mode, lock.InstanceID)
+				}
+				return
+			}
+			if !lock.holds("admin-1", leaseExclusive) || lock.LeaseTimeout != testLease(int64(lockTimeoutMinutes)*60) {
+				t.Errorf("lock %q held by %q until %d, want an exclusive lease for admin-1", lock.Mode, lock.InstanceID, lock.LeaseTimeout)
+			}
+			if len(lock.Readers) != 0 || lock.WriterWaiting != "" {
+				t.Errorf("readers %v and writer %q survived the steal", lock.Readers, lock.WriterWaiting)
+			}
+			if lock.DatabaseName != "a.db" || lock.Version != tt.lock.Version {
+				t.Errorf("steal changed the key or version to %q, %d", lock.DatabaseName, lock.Version)
+			}
+			if len(lock.Holders) != 1 || lock.Holders["admin-1"].PID != 9 {
+				t.Errorf("holders %v, want only admin-1's identity", lock.Holders)
+			}
+			// The previous holders are fenced: they can no longer renew
+			for id := range tt.lock.Holders {
+				if err := lock.renew(id, leaseExclusive, testNow); !errors.Is(err, errLeaseLost) {
+					t.Errorf("renew by %s after the steal = %v, want errLeaseLost", id, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLockItemRenew(t *testing.T) {
+	term := int64(lockTimeoutMinutes) * 60
+
+	tests := []struct {
+		name        string
+		lock        LockItem
+		instance    string
+		mode        string
+		wantLost    bool
+		wantTimeout int64
+	}{
+		{
+			name:     "exclusive holder",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(10)},
+			instance: "w1", mode: leaseExclusive,
+			wantTimeout: testLease(term),
+		},
+		{
+			name:     "exclusive lease taken over",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w2", LeaseTimeout: testLease(10)},
+			instance: "w1", mode: leaseExclusive,
+			wantLost: true, wantTimeout: testLease(10),
+		},
+		{
+			name:     "exclusive lease expired",
+			lock:     LockItem{Mode: leaseExclusive, InstanceID: "w1", LeaseTimeout: testLease(-1)},
+			instance: "w1", mode: leaseExclusive,
+			wantLost: true,
+		},
+		{
+			name:     "reader",
+			lock:     LockItem{Mode: leaseShared, Readers: map[string]int64{"r1": testLease(10), "r2": testLease(20)}, LeaseTimeout: testLease(20)},
+			instance: "r1", mode: leaseShared,
+			wantTimeout: testLease(term),
+		},
+		{
+			name:     "released reader",
+			lock:     LockItem{Mode: leaseShared, Readers: map[string]int64{"r2": testLease(20)}, LeaseTimeout: testLease(20)},
+			instance: "r1", mode: leaseShared,
+			wantLost: true, wantTimeout: testLease(20),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lock := tt.lock
+			err := lock.renew(tt.instance, tt.mode, testNow)
+			if lost := errors.Is(err, errLeaseLost); lost != tt.wantLost || (err != nil && !lost) {
+				t.Errorf("renew error = %v, want lost %v", err, tt.wantLost)
+			}
+			if tt.wantTimeout != 0 && lock.LeaseTimeout != tt.wantTimeout {
+				t.Errorf("lease_timeout = %d, want %d", lock.LeaseTimeout, tt.wantTimeout)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// Role used when the request carries no authorizer role
+	defaultRoleName = "default"
+
+	// Role allowed to administer locks
+	adminRoleName = "admin"
+
+	// Names reported in LimitError.Limit
+	limitTimeout     = "timeout"
+	limitMaxRows     = "max_rows"
+	limitResultBytes = "max_result_bytes"
+	limitHeapBytes   = "max_heap_bytes"
+)
+
+// QueryLimits bounds the resources a single SQL request may consume
+type QueryLimits struct {
+	Timeout        time.Duration
+	MaxRows        int
+	MaxResultBytes int64
+	MaxHeapBytes   int64
+}
+
+// roleLimitsConfig is the JSON form of QueryLimits used in ROLE_LIMITS
+type roleLimitsConfig struct {
+	TimeoutMs      int64 `json:"timeout_ms"`
+	MaxRows        int   `json:"max_rows"`
+	MaxResultBytes int64 `json:"max_result_bytes"`
+	MaxHeapBytes   int64 `json:"max_heap_bytes"`
+}
+
+// LimitError reports which query limit a request exceeded
+type LimitError struct {
+	Limit     string `json:"limit"`
+	Threshold int64  `json:"threshold"`
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("query exceeded %s limit of %d", e.Limit, e.Threshold)
+}
+
+// defaultRoleLimits keeps results under the 6MB API Gateway payload limit
+// and SQLite's heap well inside the Lambda memory size
+var defaultRoleLimits = map[string]QueryLimits{
+	defaultRoleName: {
+		Timeout:        30 * time.Second,
+		MaxRows:        10000,
+		MaxResultBytes: 5 << 20,
+		MaxHeapBytes:   256 << 20,
+	},
+	adminRoleName: {
+		Timeout:        240 * time.Second,
+		MaxRows:        100000,
+		MaxResultBytes: 5 << 20,
+		MaxHeapBytes:   384 << 20,
+	},
+}
+
+var roleLimits = loadRoleLimits()
+
+// heapSlot lets one statement at a time use SQLite's heap. The hard heap
+// limit is process-wide, so it can only hold a statement to that
+// statement's own limit while no other statement is running.
+var heapSlot = make(chan struct{}, 1)
+
+// enterHeapLimit waits for the heap, then sets SQLite's hard heap limit to
+// the request's, or removes it if the request has none. The returned
+// function lets the next statement in.
+func enterHeapLimit(ctx context.Context, limits QueryLimits) (func(), error) {
+	select {
+	case heapSlot <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	setHardHeapLimit(max(limits.MaxHeapBytes, 0))
+	return func() { <-heapSlot }, nil
+}
+
+// maxValueBytes returns the largest string or blob a request may build, a
+// quarter of its heap limit
+func maxValueBytes(limits QueryLimits) int64 {
+	return min(limits.MaxHeapBytes/4, 1<<30)
+}
+
+// applyConnectionLimits keeps a statement well inside its heap limit, which
+// enterHeapLimit enforces: half of it for the page cache, a quarter for any
+// single string or blob, and temporary tables and sorts are spilled to
+// disk. The pool must be limited to this one connection.
+func applyConnectionLimits(ctx context.Context, db *sql.DB, limits QueryLimits) error {
+	if limits.MaxHeapBytes <= 0 {
+		return nil
+	}
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to open connection: %v", err)
+	}
+	defer conn.Close()
+
+	err = conn.Raw(func(driverConn any) error {
+		if c, ok := driverConn.(*sqlite3.SQLiteConn); ok {
+			c.SetLimit(sqlite3.SQLITE_LIMIT_LENGTH, int(maxValueBytes(limits)))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set length limit: %v", err)
+	}
+	pragmas := fmt.Sprintf("PRAGMA cache_size = %d; PRAGMA temp_store = FILE", -max(limits.MaxHeapBytes/2/1024, 1))
+	if _, err := conn.ExecContext(ctx, pragmas); err != nil {
+		return fmt.Errorf("failed to set cache size: %v", err)
+	}
+	return nil
+}
+
+// loadRoleLimits merges ROLE_LIMITS (a JSON object keyed by role) over the defaults
+func loadRoleLimits() map[string]QueryLimits {
+	limits := make(map[string]QueryLimits, len(defaultRoleLimits))
+	for role, l := range defaultRoleLimits {
+		limits[role] = l
+	}
+
+	raw := os.Getenv("ROLE_LIMITS")
+	if raw == "" {
+		return limits
+	}
+
+	var configured map[string]roleLimitsConfig
+	if err := json.Unmarshal([]byte(raw), &configured); err != nil {
+		slog.Warn("Ignoring invalid ROLE_LIMITS", "error", err)
+		return limits
+	}
+
+	for role, c := range configured {
+		limits[role] = QueryLimits{
+			Timeout:        time.Duration(c.TimeoutMs) * time.Millisecond,
+			MaxRows:        c.MaxRows,
+			MaxResultBytes: c.MaxResultBytes,
+			MaxHeapBytes:   c.MaxHeapBytes,
+		}
+	}
+	return limits
+}
+
+// requestRole returns the caller's role from the API Gateway authorizer context
+func requestRole(request events.APIGatewayProxyRequest) string {
+	if role, ok := request.RequestContext.Authorizer["role"].(string); ok && role != "" {
+		return role
+	}
+	if role := os.Getenv("DEFAULT_ROLE"); role != "" {
+		return role
+	}
+	return defaultRoleName
+}
+
+// resolveLimits returns the role's limits, lowered by any limits set on the request
+func resolveLimits(role string, apiReq APIRequest) QueryLimits {
+	limits, ok := roleLimits[role]
+	if !ok {
+		limits = roleLimits[defaultRoleName]
+	}
+
+	if apiReq.TimeoutMs > 0 {
+		limits.Timeout = minPositive(limits.Timeout, time.Duration(apiReq.TimeoutMs)*time.Millisecond)
+	}
+	if apiReq.MaxRows > 0 {
+		limits.MaxRows = int(minPositive(int64(limits.MaxRows), int64(apiReq.MaxRows)))
+	}
+	if apiReq.MaxResultBytes > 0 {
+		limits.MaxResultBytes = minPositive(limits.MaxResultBytes, apiReq.MaxResultBytes)
+	}
+	if apiReq.MaxHeapBytes > 0 {
+		limits.MaxHeapBytes = minPositive(limits.MaxHeapBytes, apiReq.MaxHeapBytes)
+	}
+	return limits
+}
+
+// minPositive returns the smaller of a and b, treating zero as unlimited
+func minPositive[T int64 | time.Duration](a, b T) T {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// limitStatusCode maps an exceeded limit to its HTTP status. A query that
+// ran out of time is the client's to fix, so it is a 422, not a 408, which
+// would mean the client was too slow to send its request.
+func limitStatusCode(limitErr *LimitError) int {
+	if limitErr.Limit == limitTimeout {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusRequestEntityTooLarge
+}
+
+// createLimitErrorResponse creates an error response naming the exceeded limit
+func createLimitErrorResponse(limitErr *LimitError) events.APIGatewayProxyResponse {
+	code := errorCodeLimitExceeded
+	if limitErr.Limit == limitTimeout {
+		code = errorCodeTimeout
+	}
+	errorBody := SQLResult{
+		Success:       false,
+		Error:         limitErr.Error(),
+		Code:          code,
+		LimitExceeded: limitErr,
+	}
+	body, _ := json.Marshal(errorBody)
+	return events.APIGatewayProxyResponse{
+		StatusCode: limitStatusCode(limitErr),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveLimits(t *testing.T) {
+	defaults := defaultRoleLimits[defaultRoleName]
+	admin := defaultRoleLimits[adminRoleName]
+
+	tests := []struct {
+		name string
+		role string
+		req  APIRequest
+		want QueryLimits
+	}{
+		{
+			name: "role defaults",
+			role: adminRoleName,
+			want: admin,
+		},
+		{
+			name: "unknown role falls back to default",
+			role: "nobody",
+			want: defaults,
+		},
+		{
+			name: "request lowers limits",
+			role: defaultRoleName,
+			req:  APIRequest{TimeoutMs: 1000, MaxRows: 10, MaxResultBytes: 1024, MaxHeapBytes: 1 << 20},
+			want: QueryLimits{Timeout: time.Second, MaxRows: 10, MaxResultBytes: 1024, MaxHeapBytes: 1 << 20},
+		},
+		{
+			name: "request cannot raise limits",
+			role: defaultRoleName,
+			req:  APIRequest{TimeoutMs: 3600000, MaxRows: 1 << 30, MaxResultBytes: 1 << 40, MaxHeapBytes: 1 << 40},
+			want: defaults,
+		},
+		{
+			name: "request lowers only what it sets",
+			role: defaultRoleName,
+			req:  APIRequest{MaxRows: 5},
+			want: QueryLimits{Timeout: defaults.Timeout, MaxRows: 5, MaxResultBytes: defaults.MaxResultBytes, MaxHeapBytes: defaults.MaxHeapBytes},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolveLimits(tt.role, tt.req); got != tt.want {
+				t.Errorf("resolveLimits(%q) = %+v, want %+v", tt.role, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinPositive(t *testing.T) {
+	tests := []struct {
+		a, b, want int64
+	}{
+		{0, 5, 5},
+		{5, 0, 5},
+		{3, 5, 3},
+		{5, 3, 3},
+		{0, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := minPositive(tt.a, tt.b); got != tt.want {
+			t.Errorf("minPositive(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestExecuteSQLHeapLimit(t *testing.T) {
+	dbPath := filepath.Join(t.TempDir(), "heap.db")
+
+	tests := []struct {
+		name      string
+		sql       string
+		heapBytes int64
+		wantHeap  int64 // hard heap limit seen by the statement
+		wantLimit *LimitError
+	}{
+		{name: "own limit", sql: "SELECT * FROM pragma_hard_heap_limit", heapBytes: 8 << 20, wantHeap: 8 << 20},
+		{name: "no limit", sql: "SELECT * FROM pragma_hard_heap_limit", wantHeap: 0},
+		{name: "smaller limit", sql: "SELECT * FROM pragma_hard_heap_limit", heapBytes: 4 << 20, wantHeap: 4 << 20},
+		{
+			name: "value too large", sql: "SELECT randomblob(3000000)", heapBytes: 8 << 20,
+			wantLimit: &LimitError{Limit: limitHeapBytes, Threshold: 2 << 20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := executeSQL(context.Background(), dbPath, tt.sql, QueryLimits{MaxHeapBytes: tt.heapBytes})
+			if tt.wantLimit != nil {
+				var limitErr *LimitError
+				if !errors.As(err, &limitErr) || *limitErr != *tt.wantLimit {
+					t.Fatalf("executeSQL error = %v, want %v", err, tt.wantLimit)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("executeSQL: %v", err)
+			}
+			rows := result.Data.([]map[string]interface{})
+			if got := rows[0]["hard_heap_limit"]; got != tt.wantHeap {
+				t.Errorf("hard_heap_limit = %v, want %d", got, tt.wantHeap)
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// Lock administration operations, allowed to the admin role only
+	opListLocks        = "list_locks"
+	opInspectLock      = "inspect_lock"
+	opForceReleaseLock = "force_release_lock"
+	opStealLock        = "steal_lock"
+
+	// Prefix under which lock administration audit records are stored
+	lockAuditPrefix = ".audit/locks/"
+)
+
+// LockStatus describes the leases held on a database
+type LockStatus struct {
+	DatabaseName          string          `json:"database_name"`
+	Mode                  string          `json:"mode"`
+	Holder                string          `json:"holder,omitempty"`
+	HolderIdentity        *HolderIdentity `json:"holder_identity,omitempty"`
+	AgeSeconds            int64           `json:"age_seconds"`
+	RemainingLeaseSeconds int64           `json:"remaining_lease_seconds"`
+	Readers               []ReaderLease   `json:"readers,omitempty"`
+	WriterWaiting         string          `json:"writer_waiting,omitempty"`
+	WriterIdentity        *HolderIdentity `json:"writer_identity,omitempty"`
+}
+
+// ReaderLease describes one shared lease
+type ReaderLease struct {
+	InstanceID            string          `json:"instance_id"`
+	RemainingLeaseSeconds int64           `json:"remaining_lease_seconds"`
+	Identity              *HolderIdentity `json:"identity,omitempty"`
+}
+
+// LockAudit records a forced change to a lock
+type LockAudit struct {
+	Action       string    `json:"action"`
+	DatabaseName string    `json:"database_name"`
+	Previous     *LockItem `json:"previous,omitempty"`
+	Released     string    `json:"released,omitempty"`
+	NewHolder    string    `json:"new_holder,omitempty"`
+	Reason       string    `json:"reason,omitempty"`
+	Principal    string    `json:"principal"`
+	At           time.Time `json:"at"`
+}
+
+// lockStatus summarizes a lock item, or returns nil if nothing is held
+func lockStatus(lock *LockItem, now time.Time) *LockStatus {
+	lock.active(now.Unix())
+	if lock.empty() {
+		return nil
+	}
+
+	status := &LockStatus{
+		DatabaseName:          lock.DatabaseName,
+		Mode:                  lock.Mode,
+		WriterWaiting:         lock.WriterWaiting,
+		RemainingLeaseSeconds: lock.LeaseTimeout - now.Unix(),
+	}
+	if status.Mode == "" {
+		status.Mode = "waiting"
+	}
+	if lock.CreatedAt > 0 {
+		status.AgeSeconds = now.Unix() - lock.CreatedAt
+	}
+	if lock.Mode == leaseExclusive {
+		status.Holder = lock.InstanceID
+		status.HolderIdentity = lock.holderIdentity(lock.InstanceID)
+	}
+	if lock.WriterWaiting != "" {
+		status.WriterIdentity = lock.holderIdentity(lock.WriterWaiting)
+	}
+	for id, expires := range lock.Readers {
+		status.Readers = append(status.Readers, ReaderLease{
+			InstanceID:            id,
+			RemainingLeaseSeconds: expires - now.Unix(),
+			Identity:              lock.holderIdentity(id),
+		})
+	}
+	sort.Slice(status.Readers, func(i, j int) bool { return status.Readers[i].InstanceID < status.Readers[j].InstanceID })
+	return status
+}
+
+// holderIdentity returns the recorded identity of an instance, if any
+func (l *LockItem) holderIdentity(instanceID string) *HolderIdentity {
+	if holder, ok := l.Holders[instanceID]; ok {
+		return &holder
+	}
+	return nil
+}
+
+// listLocks returns the status of every database with a lease held
+func listLocks() ([]LockStatus, error) {
+	var locks []LockStatus
+	var unmarshalErr error
+	now := time.Now()
+	err := dynamoClient.ScanPages(&dynamodb.ScanInput{
+		TableName:      aws.String(lockTableName),
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.ScanOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			var lock LockItem
+			if unmarshalErr = dynamodbattribute.UnmarshalMap(item, &lock); unmarshalErr != nil {
+				return false
+			}
+			if strings.HasSuffix(lock.DatabaseName, lockTicketSuffix) {
+				continue
+			}
+			if status := lockStatus(&lock, now); status != nil {
+				locks = append(locks, *status)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan locks: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal lock: %v", unmarshalErr)
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].DatabaseName < locks[j].DatabaseName })
+	return locks, nil
+}
+
+// handleLockAdmin runs a lock administration operation for an admin caller
+func handleLockAdmin(ctx context.Context, request events.APIGatewayProxyRequest, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	if requestRole(request) != adminRoleName {
+		return createErrorResponse(403, "Lock administration requires the admin role"), nil
+	}
+
+	switch apiReq.Operation {
+	case opListLocks:
+		locks, err := listLocks()
+		if err != nil {
+			return createFailureResponse("", err), nil
+		}
+		return createSuccessResponse(&SQLResult{
+			Success: true,
+			Data:    locks,
+			Message: fmt.Sprintf("%d databases are locked", len(locks)),
+		}), nil
+
+	case opInspectLock:
+		lock, _, err := loadLock(apiReq.DatabaseName)
+		if err != nil {
+			return createFailureResponse("", err), nil
+		}
+		status := lockStatus(lock, time.Now())
+		if status == nil {
+			return createSuccessResponse(&SQLResult{
+				Success: true,
+				Message: fmt.Sprintf("Database %s is not locked", apiReq.DatabaseName),
+			}), nil
+		}
+		return createSuccessResponse(&SQLResult{
+			Success: true,
+			Data:    status,
+			Message: fmt.Sprintf("Database %s is locked (%s)", apiReq.DatabaseName, status.Mode),
+		}), nil
+
+	default:
+		return forceLockChange(ctx, request, apiReq)
+	}
+}
+
+// forceLockChange force-releases a database's lock, or steals it by giving
+// an exclusive lease to the admin caller, and records who did it and why.
+// With an instance ID only that instance's lease or writer claim is
+// released, and a steal only goes ahead if that instance holds the lock.
+// A released holder cannot publish afterwards, since uploads check the
+// lease first (see fenceLease).
+func forceLockChange(ctx context.Context, request events.APIGatewayProxyRequest, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	audit := LockAudit{
+		Action:       apiReq.Operation,
+		DatabaseName: apiReq.DatabaseName,
+		Released:     apiReq.InstanceID,
+		Reason:       apiReq.Reason,
+		Principal:    requestPrincipal(request),
+	}
+	if audit.Principal == "" {
+		audit.Principal = "unknown"
+	}
+	if apiReq.Operation == opStealLock {
+		audit.NewHolder = fmt.Sprintf("admin-%d", time.Now().UnixNano())
+	}
+
+	var previous LockItem
+	err := updateLock(apiReq.DatabaseName, func(lock *LockItem) (bool, error) {
+		now := time.Now()
+		lock.active(now.Unix())
+		previous = *lock
+		if audit.NewHolder != "" {
+			if !lock.steal(apiReq.InstanceID, audit.NewHolder, holderIdentity(ctx), now) {
+				return false, fmt.Errorf("instance %s does not hold the lock on %s", apiReq.InstanceID, apiReq.DatabaseName)
+			}
+			return true, nil
+		}
+		if lock.empty() {
+			return false, fmt.Errorf("database %s is not locked", apiReq.DatabaseName)
+		}
+		if apiReq.InstanceID == "" {
+			*lock = LockItem{DatabaseName: lock.DatabaseName, Version: lock.Version}
+			return true, nil
+		}
+		if !lock.evict(apiReq.InstanceID) {
+			return false, fmt.Errorf("instance %s does not hold the lock on %s", apiReq.InstanceID, apiReq.DatabaseName)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return createErrorResponse(409, fmt.Sprintf("Failed to change lock: %v", err)), nil
+	}
+
+	audit.Previous = &previous
+	audit.At = time.Now().UTC()
+	if err := recordLockAudit(audit); err != nil {
+		slog.WarnContext(ctx, "Failed to record lock audit", "error", err)
+	}
+	slog.WarnContext(ctx, "Lock changed by administrator", "action", audit.Action, "principal", audit.Principal,
+		"previous_holder", previous.describe(previous.InstanceID), "released", audit.Released, "new_holder", audit.NewHolder, "reason", audit.Reason)
+
+	message := fmt.Sprintf("Lock on %s released", apiReq.DatabaseName)
+	switch {
+	case audit.NewHolder != "":
+		message = fmt.Sprintf("Lock on %s is now held by %s until it is released or expires", apiReq.DatabaseName, audit.NewHolder)
+	case audit.Released != "":
+		message = fmt.Sprintf("Lease of %s on %s released", audit.Released, apiReq.DatabaseName)
+	}
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Data:    audit,
+		Message: message,
+	}), nil
+}
+
+// evict removes whatever one instance holds in a lock item: the exclusive
+// lease, a shared lease or a writer's claim. It reports whether there was any.
+func (l *LockItem) evict(instanceID string) bool {
+	found := false
+	if l.Mode == leaseExclusive && l.InstanceID == instanceID {
+		l.Mode, l.InstanceID = "", ""
+		found = true
+	}
+	if _, reading := l.Readers[instanceID]; reading {
+		delete(l.Readers, instanceID)
+		if l.Mode == leaseShared && len(l.Readers) == 0 {
+			l.Mode = ""
+		}
+		found = true
+	}
+	if l.WriterWaiting == instanceID {
+		l.WriterWaiting, l.WriterWaitingUntil = "", 0
+		found = true
+	}
+	if found {
+		delete(l.Holders, instanceID)
+		l.updateLeaseTimeout(0)
+	}
+	return found
+}
+
+// steal replaces every lease and writer claim in a lock item with a new
+// exclusive lease for newHolder. With a previous holder named, it does
+// nothing unless that instance holds a lease or claim, and reports whether
+// the lock was taken.
+func (l *LockItem) steal(previousHolder, newHolder string, holder HolderIdentity, now time.Time) bool {
+	if previousHolder != "" && !l.holdsAny(previousHolder) {
+		return false
+	}
+	*l = LockItem{
+		DatabaseName: l.DatabaseName,
+		InstanceID:   newHolder,
+		Mode:         leaseExclusive,
+		CreatedAt:    now.Unix(),
+		LeaseTimeout: now.Add(time.Duration(lockTimeoutMinutes) * time.Minute).Unix(),
+		Version:      l.Version,
+	}
+	l.recordHolder(newHolder, holder)
+	return true
+}
+
+// holdsAny reports whether an instance holds any lease or writer claim
+func (l *LockItem) holdsAny(instanceID string) bool {
+	_, reading := l.Readers[instanceID]
+	return reading || l.WriterWaiting == instanceID || (l.Mode == leaseExclusive && l.InstanceID == instanceID)
+}
+
+// recordLockAudit stores an audit record of a forced lock change in S3
+func recordLockAudit(audit LockAudit) error {
+	data, err := json.Marshal(audit)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock audit record: %v", err)
+	}
+	key := fmt.Sprintf("%s%s/%s-%s.json", lockAuditPrefix, audit.DatabaseName, audit.At.Format("20060102T150405.000000000Z"), audit.Action)
+	if err := putObjectBytes(key, data); err != nil {
+		return fmt.Errorf("failed to record lock audit: %w", err)
+	}
+	return nil
+}
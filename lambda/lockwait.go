@@ -0,0 +1,313 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	// Default lock wait policy
+	defaultLockWait           = 10 * time.Second
+	defaultLockBackoffInitial = 50 * time.Millisecond
+	defaultLockBackoffMax     = time.Second
+
+	// A waiter whose turn has come but has not checked in for this long is
+	// skipped, so an abandoned ticket cannot stall the queue
+	lockTicketTurnTimeout = 5 * time.Second
+
+	// Suffix of the lock table item holding a database's ticket counters
+	lockTicketSuffix = "#tickets"
+
+	// The ticket counters are removed by the table's TTL once nobody has
+	// taken or moved on a ticket for this long
+	lockTicketsTTL = time.Hour
+)
+
+// LockWaitPolicy controls how long and how often a request retries a held lock
+type LockWaitPolicy struct {
+	MaxWait        time.Duration
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// Fair serves waiters in arrival order through a ticket queue
+	Fair bool
+}
+
+// LockWaitError reports that the lock was still held when the wait ended
+type LockWaitError struct {
+	Waited time.Duration
+	Err    error
+}
+
+func (e *LockWaitError) Error() string {
+	return fmt.Sprintf("gave up after waiting %v: %v", e.Waited.Round(time.Millisecond), e.Err)
+}
+
+func (e *LockWaitError) Unwrap() error {
+	return e.Err
+}
+
+// lockWaitPolicy returns the policy from LOCK_WAIT_MS, LOCK_BACKOFF_INITIAL_MS,
+// LOCK_BACKOFF_MAX_MS and LOCK_FAIR, with the wait lowered by the request's lock_wait_ms
+func lockWaitPolicy(apiReq APIRequest) LockWaitPolicy {
+	policy := LockWaitPolicy{
+		MaxWait:        envMilliseconds("LOCK_WAIT_MS", defaultLockWait),
+		InitialBackoff: envMilliseconds("LOCK_BACKOFF_INITIAL_MS", defaultLockBackoffInitial),
+		MaxBackoff:     envMilliseconds("LOCK_BACKOFF_MAX_MS", defaultLockBackoffMax),
+		Fair:           os.Getenv("LOCK_FAIR") == "on",
+	}
+	if apiReq.LockWaitMs != nil && *apiReq.LockWaitMs >= 0 {
+		if requested := time.Duration(*apiReq.LockWaitMs) * time.Millisecond; requested < policy.MaxWait {
+			policy.MaxWait = requested
+		}
+	}
+	if policy.InitialBackoff <= 0 {
+		policy.InitialBackoff = defaultLockBackoffInitial
+	}
+	if policy.MaxBackoff < policy.InitialBackoff {
+		policy.MaxBackoff = policy.InitialBackoff
+	}
+	return policy
+}
+
+// backoff returns a random delay up to the attempt's exponential backoff
+func (p LockWaitPolicy) backoff(attempt int) time.Duration {
+	ceiling := p.MaxBackoff
+	if attempt < 30 {
+		if exp := p.InitialBackoff << attempt; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// waitForDynamoLock takes a lease on a database, retrying under the policy
+// while it is held, and returns how long it waited. Any other failure is
+// returned at once. Only exclusive leases queue for tickets; shared leases
+// are held back by waiting writers instead, so a writer that gives up
+// withdraws its claim.
+func waitForDynamoLock(ctx context.Context, databaseName, instanceID, mode string, policy LockWaitPolicy) (waited time.Duration, err error) {
+	defer func() {
+		_, conflict := err.(*LockWaitError)
+		recordLockWait(ctx, mode, waited, conflict)
+		if err != nil && mode == leaseExclusive {
+			withdrawWriterClaim(ctx, databaseName, instanceID)
+		}
+	}()
+
+	if policy.Fair && mode == leaseExclusive {
+		return waitForDynamoLockFair(ctx, databaseName, instanceID, policy)
+	}
+
+	started := time.Now()
+	deadline := started.Add(policy.MaxWait)
+	for attempt := 0; ; attempt++ {
+		err = acquireDynamoLease(ctx, databaseName, instanceID, mode)
+		if err == nil {
+			return time.Since(started), nil
+		}
+		// Failing to reach or update the lock table is not contention
+		if !isLockHeld(err) {
+			return time.Since(started), err
+		}
+
+		delay := policy.backoff(attempt)
+		if ctx.Err() != nil || time.Now().Add(delay).After(deadline) {
+			return time.Since(started), &LockWaitError{Waited: time.Since(started), Err: err}
+		}
+		sleepContext(ctx, delay)
+	}
+}
+
+// waitForDynamoLockFair takes a ticket and tries for the lock only when its
+// number is being served. The serving waiter checks in on every attempt and
+// moves the queue on however it returns: with the lock, giving up or failing.
+func waitForDynamoLockFair(ctx context.Context, databaseName, instanceID string, policy LockWaitPolicy) (time.Duration, error) {
+	started := time.Now()
+	deadline := started.Add(policy.MaxWait)
+
+	ticket, err := takeLockTicket(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	// No-op unless it is our turn; a ticket not yet served is skipped once
+	// its turn comes and it does not check in
+	defer func() { advanceLockTickets(databaseName, ticket) }()
+
+	lastErr := fmt.Errorf("waiting for earlier tickets")
+	for attempt := 0; ; attempt++ {
+		serving, servingSince, err := lockTicketsServing(databaseName)
+		if err != nil {
+			return time.Since(started), err
+		}
+
+		switch {
+		case serving == ticket:
+			checkInLockTicket(databaseName, ticket)
+			if lastErr = acquireDynamoLock(ctx, databaseName, instanceID); lastErr == nil {
+				return time.Since(started), nil
+			}
+			if !isLockHeld(lastErr) {
+				return time.Since(started), lastErr
+			}
+
+		case serving > ticket:
+			// Skipped as abandoned; rejoin at the back
+			if ticket, err = takeLockTicket(databaseName); err != nil {
+				return time.Since(started), err
+			}
+
+		case time.Since(servingSince) > lockTicketTurnTimeout:
+			advanceLockTickets(databaseName, serving)
+		}
+
+		delay := policy.backoff(attempt)
+		if ctx.Err() != nil || time.Now().Add(delay).After(deadline) {
+			return time.Since(started), &LockWaitError{Waited: time.Since(started), Err: lastErr}
+		}
+		sleepContext(ctx, delay)
+	}
+}
+
+// withdrawWriterClaim clears a writer's claim on a lock it stopped waiting
+// for, if the claim is still its own, so the readers it held back are let in
+func withdrawWriterClaim(ctx context.Context, databaseName, instanceID string) {
+	err := updateLock(databaseName, func(lock *LockItem) (bool, error) {
+		return lock.withdraw(instanceID), nil
+	})
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to withdraw writer claim", "database", databaseName, "lock_holder", instanceID, "error", err)
+	}
+}
+
+// isLockHeld reports whether a lease was refused because of another holder
+func isLockHeld(err error) bool {
+	var held *LockHeldError
+	return errors.As(err, &held)
+}
+
+// lockTicketsKey returns the lock table key of a database's ticket counters
+func lockTicketsKey(databaseName string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"database_name": {S: aws.String(databaseName + lockTicketSuffix)},
+	}
+}
+
+// lockTicketsExpiry returns the lease_timeout, which the table's TTL uses,
+// of ticket counters updated now
+func lockTicketsExpiry() *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(time.Now().Add(lockTicketsTTL).Unix(), 10))}
+}
+
+// takeLockTicket returns the next ticket number for a database's lock
+func takeLockTicket(databaseName string) (int64, error) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	output, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(lockTableName),
+		Key:              lockTicketsKey(databaseName),
+		UpdateExpression: aws.String("ADD next_ticket :one SET serving = if_not_exists(serving, :one), serving_since = if_not_exists(serving_since, :now), lease_timeout = :expires"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":     {N: aws.String("1")},
+			":now":     {N: aws.String(now)},
+			":expires": lockTicketsExpiry(),
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to take lock ticket: %w", err)
+	}
+	return numberAttribute(output.Attributes["next_ticket"]), nil
+}
+
+// lockTicketsServing returns the ticket being served and when its turn began
+// or it last checked in
+func lockTicketsServing(databaseName string) (int64, time.Time, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(lockTableName),
+		Key:            lockTicketsKey(databaseName),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to check lock tickets: %w", err)
+	}
+	return numberAttribute(result.Item["serving"]), time.UnixMilli(numberAttribute(result.Item["serving_since"])), nil
+}
+
+// checkInLockTicket shows that the serving waiter is still trying
+func checkInLockTicket(databaseName string, ticket int64) {
+	updateLockTickets(databaseName, ticket, ticket)
+}
+
+// advanceLockTickets moves the queue past a ticket if it is being served
+func advanceLockTickets(databaseName string, ticket int64) {
+	updateLockTickets(databaseName, ticket, ticket+1)
+}
+
+// updateLockTickets sets the serving ticket if it is still current
+func updateLockTickets(databaseName string, current, next int64) {
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(lockTableName),
+		Key:                 lockTicketsKey(databaseName),
+		UpdateExpression:    aws.String("SET serving = :next, serving_since = :now, lease_timeout = :expires"),
+		ConditionExpression: aws.String("serving = :current"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":current": {N: aws.String(strconv.FormatInt(current, 10))},
+			":next":    {N: aws.String(strconv.FormatInt(next, 10))},
+			":now":     {N: aws.String(strconv.FormatInt(time.Now().UnixMilli(), 10))},
+			":expires": lockTicketsExpiry(),
+		},
+	})
+	if err != nil && !isConditionalCheckFailed(err) {
+		slog.Warn("Failed to update lock tickets", "database", databaseName, "error", err)
+	}
+}
+
+// numberAttribute returns the integer value of a DynamoDB number attribute
+func numberAttribute(value *dynamodb.AttributeValue) int64 {
+	if value == nil {
+		return 0
+	}
+	n, _ := strconv.ParseInt(aws.StringValue(value.N), 10, 64)
+	return n
+}
+
+// lockWaitMs returns a wait time for the lock_wait_ms response field
+func lockWaitMs(waited time.Duration) *int64 {
+	ms := waited.Milliseconds()
+	return &ms
+}
+
+// createLockErrorResponse creates the response for a lock that could not be
+// acquired, with how long the request waited for it. A lock that stayed held
+// is a 409; failing to reach the lock table is reported as its cause.
+func createLockErrorResponse(err error, waited time.Duration) events.APIGatewayProxyResponse {
+	code, statusCode := errorCodeLockHeld, 409
+	if _, ok := err.(*LockWaitError); !ok {
+		code, statusCode = classifyError(err)
+	}
+	errorBody := SQLResult{
+		Success:    false,
+		Error:      fmt.Sprintf("Failed to acquire lock: %v", err),
+		Code:       code,
+		LockWaitMs: lockWaitMs(waited),
+	}
+	body, _ := json.Marshal(errorBody)
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: string(body),
+	}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/private/protocol/json/jsonutil"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// fakeItem is an item stored by fakeDynamoDB
+type fakeItem = map[string]*dynamodb.AttributeValue
+
+// fakeKeySchema names the key attributes of each table the code uses
+var fakeKeySchema = map[string][]string{
+	lockTableName:       {"database_name"},
+	writeQueueTableName: {"database_name", "request_id"},
+}
+
+// fakeDynamoDB serves the item operations, queries and scans the lock table
+// and write queue use from memory. It understands just the condition and
+// update expressions found in this package.
+type fakeDynamoDB struct {
+	mu     sync.Mutex
+	tables map[string]map[string]fakeItem
+
+	// intercept, if set, sees each request before it is served and can fail
+	// it, or change items behind the caller's back
+	intercept func(operation string, body []byte) *fakeDynamoError
+}
+
+func (f *fakeDynamoDB) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "DynamoDB_20120810.")
+	body, _ := io.ReadAll(r.Body)
+
+	var output any
+	var err *fakeDynamoError
+	if f.intercept != nil {
+		err = f.intercept(operation, body)
+	}
+	if err == nil {
+		f.mu.Lock()
+		output, err = f.serve(operation, body)
+		f.mu.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/x-amz-json-1.0")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, `{"__type": "com.amazonaws.dynamodb.v20120810#%s", "message": %q}`, err.code, err.message)
+		return
+	}
+	data, _ := jsonutil.BuildJSON(output)
+	w.Write(data)
+}
+
+// fakeDynamoError is an error response from fakeDynamoDB
+type fakeDynamoError struct {
+	code, message string
+}
+
+var errFakeConditionFailed = &fakeDynamoError{dynamodb.ErrCodeConditionalCheckFailedException, "The conditional request failed"}
+
+// serve runs one operation on a request body and returns its output
+func (f *fakeDynamoDB) serve(operation string, body []byte) (any, *fakeDynamoError) {
+	decode := func(input any) *fakeDynamoError {
+		if err := jsonutil.UnmarshalJSON(input, strings.NewReader(string(body))); err != nil {
+			return &fakeDynamoError{"ValidationException", err.Error()}
+		}
+		return nil
+	}
+	expression := func(names map[string]*string, values fakeItem) fakeExpression {
+		return fakeExpression{names: names, values: values}
+	}
+
+	switch operation {
+	case "GetItem":
+		var input dynamodb.GetItemInput
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		return &dynamodb.GetItemOutput{Item: f.table(input.TableName)[f.key(input.TableName, input.Key)]}, nil
+
+	case "PutItem":
+		var input dynamodb.PutItemInput
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		key := f.key(input.TableName, input.Item)
+		if !expression(input.ExpressionAttributeNames, input.ExpressionAttributeValues).holds(input.ConditionExpression, f.table(input.TableName)[key]) {
+			return nil, errFakeConditionFailed
+		}
+		f.table(input.TableName)[key] = input.Item
+		return &dynamodb.PutItemOutput{}, nil
+
+	case "DeleteItem":
+		var input dynamodb.DeleteItemInput
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		key := f.key(input.TableName, input.Key)
+		if !expression(input.ExpressionAttributeNames, input.ExpressionAttributeValues).holds(input.ConditionExpression, f.table(input.TableName)[key]) {
+			return nil, errFakeConditionFailed
+		}
+		delete(f.table(input.TableName), key)
+		return &dynamodb.DeleteItemOutput{}, nil
+
+	case "UpdateItem":
+		var input dynamodb.UpdateItemInput
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		key := f.key(input.TableName, input.Key)
+		expr := expression(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		current := f.table(input.TableName)[key]
+		if !expr.holds(input.ConditionExpression, current) {
+			return nil, errFakeConditionFailed
+		}
+		item := make(fakeItem)
+		for name, value := range current {
+			item[name] = value
+		}
+		for name, value := range input.Key {
+			item[name] = value
+		}
+		updated := expr.update(aws.StringValue(input.UpdateExpression), item)
+		f.table(input.TableName)[key] = item
+		if aws.StringValue(input.ReturnValues) == dynamodb.ReturnValueUpdatedNew {
+			return &dynamodb.UpdateItemOutput{Attributes: updated}, nil
+		}
+		return &dynamodb.UpdateItemOutput{}, nil
+
+	case "Query":
+		var input dynamodb.QueryInput
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		expr := expression(input.ExpressionAttributeNames, input.ExpressionAttributeValues)
+		items := f.sorted(input.TableName, func(item fakeItem) bool {
+			return expr.holds(input.KeyConditionExpression, item) && expr.holds(input.FilterExpression, item)
+		})
+		return &dynamodb.QueryOutput{Items: items, Count: aws.Int64(int64(len(items)))}, nil
+
+	case "Scan":
+		var input dynamodb.ScanInput
+		if err := decode(&input); err != nil {
+			return nil, err
+		}
+		items := f.sorted(input.TableName, func(fakeItem) bool { return true })
+		return &dynamodb.ScanOutput{Items: items, Count: aws.Int64(int64(len(items)))}, nil
+
+	default:
+		return nil, &fakeDynamoError{"UnknownOperationException", operation}
+	}
+}
+
+// table returns a table's items by key
+func (f *fakeDynamoDB) table(name *string) map[string]fakeItem {
+	items, ok := f.tables[aws.StringValue(name)]
+	if !ok {
+		items = make(map[string]fakeItem)
+		f.tables[aws.StringValue(name)] = items
+	}
+	return items
+}
+
+// key returns the stored key of an item, from its key attributes
+func (f *fakeDynamoDB) key(table *string, item fakeItem) string {
+	var parts []string
+	for _, name := range fakeKeySchema[aws.StringValue(table)] {
+		parts = append(parts, aws.StringValue(item[name].S))
+	}
+	return strings.Join(parts, "\x00")
+}
+
+// sorted returns the items of a table that match, in key order
+func (f *fakeDynamoDB) sorted(table *string, match func(fakeItem) bool) []fakeItem {
+	items := f.table(table)
+	keys := make([]string, 0, len(items))
+	for key, item := range items {
+		if match(item) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	matched := make([]fakeItem, 0, len(keys))
+	for _, key := range keys {
+		matched = append(matched, items[key])
+	}
+	return matched
+}
+
+// item returns a stored item, or nil
+func (f *fakeDynamoDB) item(table string, key ...string) fakeItem {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.tables[table][strings.Join(key, "\x00")]
+}
+
+// set changes one attribute of a stored item
+func (f *fakeDynamoDB) set(table, key, name string, value *dynamodb.AttributeValue) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tables[table][key][name] = value
+}
+
+// fakeExpression evaluates expressions against their attribute names and values
+type fakeExpression struct {
+	names  map[string]*string
+	values fakeItem
+}
+
+// name resolves an attribute name placeholder
+func (e fakeExpression) name(token string) string {
+	if strings.HasPrefix(token, "#") {
+		return aws.StringValue(e.names[token])
+	}
+	return token
+}
+
+var fakeNotExists = regexp.MustCompile(`^attribute_not_exists\((\S+)\)$`)
+
+// holds evaluates a condition of clauses joined by AND, each either
+// attribute_not_exists(name) or name = :value; an empty condition holds
+func (e fakeExpression) holds(condition *string, item fakeItem) bool {
+	if aws.StringValue(condition) == "" {
+		return true
+	}
+	for _, clause := range strings.Split(aws.StringValue(condition), " AND ") {
+		clause = strings.TrimSpace(clause)
+		if m := fakeNotExists.FindStringSubmatch(clause); m != nil {
+			if _, ok := item[e.name(m[1])]; ok {
+				return false
+			}
+			continue
+		}
+		name, value, ok := strings.Cut(clause, " = ")
+		if !ok || item == nil || !reflect.DeepEqual(item[e.name(name)], e.values[value]) {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	fakeUpdateAction = regexp.MustCompile(`(?:^|\s)(SET|ADD|REMOVE)\s`)
+	fakeIfNotExists  = regexp.MustCompile(`^if_not_exists\((\S+), (:\S+)\)$`)
+)
+
+// update applies SET, ADD and REMOVE sections to item and returns the
+// attributes it set
+func (e fakeExpression) update(expression string, item fakeItem) fakeItem {
+	updated := make(fakeItem)
+	sections := fakeUpdateAction.Split(expression, -1)
+	actions := fakeUpdateAction.FindAllStringSubmatch(expression, -1)
+	for i, action := range actions {
+		for _, part := range splitTopLevel(sections[i+1]) {
+			switch action[1] {
+			case "SET":
+				name, value, _ := strings.Cut(part, " = ")
+				name = e.name(name)
+				if m := fakeIfNotExists.FindStringSubmatch(value); m != nil {
+					if existing, ok := item[e.name(m[1])]; ok {
+						item[name] = existing
+					} else {
+						item[name] = e.values[m[2]]
+					}
+				} else {
+					item[name] = e.values[value]
+				}
+				updated[name] = item[name]
+			case "ADD":
+				name, value, _ := strings.Cut(part, " ")
+				name = e.name(name)
+				sum := numberAttribute(item[name]) + numberAttribute(e.values[value])
+				item[name] = &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(sum, 10))}
+				updated[name] = item[name]
+			case "REMOVE":
+				delete(item, e.name(part))
+			}
+		}
+	}
+	return updated
+}
+
+// splitTopLevel splits a list on the commas outside parentheses
+func splitTopLevel(list string) []string {
+	var parts []string
+	depth, start := 0, 0
+	for i, c := range list {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(list[start:]))
+}
+
+// useFakeDynamoDB points dynamoClient at an in-memory DynamoDB for the rest
+// of the test
+func useFakeDynamoDB(t *testing.T) *fakeDynamoDB {
+	t.Helper()
+	fake := &fakeDynamoDB{tables: make(map[string]map[string]fakeItem)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("test", "test", ""),
+		MaxRetries:  aws.Int(0),
+	}))
+	previous := dynamoClient
+	dynamoClient = dynamodb.New(sess)
+	t.Cleanup(func() { dynamoClient = previous })
+	return fake
+}
+
+func TestWriterGivesUpThenReaderIsGranted(t *testing.T) {
+	useFakeDynamoDB(t)
+
+	tests := []struct {
+		name   string
+		policy LockWaitPolicy
+		cancel bool
+	}{
+		{name: "no wait", policy: LockWaitPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}},
+		{name: "wait runs out", policy: LockWaitPolicy{MaxWait: 20 * time.Millisecond, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}},
+		{name: "request cancelled", policy: LockWaitPolicy{MaxWait: time.Minute, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond}, cancel: true},
+		{name: "fair queue", policy: LockWaitPolicy{MaxWait: 20 * time.Millisecond, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, Fair: true}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			databaseName := fmt.Sprintf("give-up-%d.db", i)
+			ctx := context.Background()
+			if err := acquireDynamoLease(ctx, databaseName, "r1", leaseShared); err != nil {
+				t.Fatalf("first reader: %v", err)
+			}
+
+			writerCtx, cancel := context.WithCancel(ctx)
+			if tt.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			defer cancel()
+			_, err := waitForDynamoLock(writerCtx, databaseName, "w1", leaseExclusive, tt.policy)
+			var waitErr *LockWaitError
+			if !errors.As(err, &waitErr) {
+				t.Fatalf("writer: %v, want a LockWaitError", err)
+			}
+
+			lock, _, err := loadLock(databaseName)
+			if err != nil {
+				t.Fatalf("loadLock: %v", err)
+			}
+			if lock.WriterWaiting != "" {
+				t.Errorf("writer %s still claims the lock after giving up", lock.WriterWaiting)
+			}
+			if _, ok := lock.Holders["w1"]; ok {
+				t.Error("identity of the writer that gave up is still recorded")
+			}
+			if _, err := waitForDynamoLock(ctx, databaseName, "r2", leaseShared, LockWaitPolicy{InitialBackoff: time.Millisecond, MaxBackoff: time.Millisecond}); err != nil {
+				t.Errorf("second reader was not granted at once: %v", err)
+			}
+		})
+	}
+}
+
+func TestFairLockQueue(t *testing.T) {
+	fake := useFakeDynamoDB(t)
+	policy := LockWaitPolicy{MaxWait: 50 * time.Millisecond, InitialBackoff: time.Millisecond, MaxBackoff: 5 * time.Millisecond, Fair: true}
+	ctx := context.Background()
+
+	// serving returns the ticket a database's queue is serving
+	serving := func(databaseName string) int64 {
+		return numberAttribute(fake.item(lockTableName, databaseName+lockTicketSuffix)["serving"])
+	}
+
+	tests := []struct {
+		name string
+		// run queues w1 behind the holder w0 in some way, and returns the
+		// error w1 should end with
+		run        func(t *testing.T, databaseName string) error
+		wantErr    bool
+		wantServed int64 // ticket served once w1 returns
+	}{
+		{
+			name: "gives up on its turn",
+			run: func(t *testing.T, databaseName string) error {
+				_, err := waitForDynamoLock(ctx, databaseName, "w1", leaseExclusive, policy)
+				return err
+			},
+			wantErr:    true,
+			wantServed: 2,
+		},
+		{
+			name: "lock table fails on its turn",
+			run: func(t *testing.T, databaseName string) error {
+				fake.intercept = func(operation string, body []byte) *fakeDynamoError {
+					if operation == "GetItem" && strings.Contains(string(body), databaseName+"\"") {
+						return &fakeDynamoError{"ValidationException", "lock table unavailable"}
+					}
+					return nil
+				}
+				defer func() { fake.intercept = nil }()
+				_, err := waitForDynamoLock(ctx, databaseName, "w1", leaseExclusive, policy)
+				return err
+			},
+			wantErr:    true,
+			wantServed: 2,
+		},
+		{
+			name: "counters cannot be read after taking a ticket",
+			run: func(t *testing.T, databaseName string) error {
+				fake.intercept = func(operation string, body []byte) *fakeDynamoError {
+					if operation == "GetItem" && strings.Contains(string(body), lockTicketSuffix) {
+						return &fakeDynamoError{"ValidationException", "lock table unavailable"}
+					}
+					return nil
+				}
+				defer func() { fake.intercept = nil }()
+				_, err := waitForDynamoLock(ctx, databaseName, "w1", leaseExclusive, policy)
+				return err
+			},
+			wantErr:    true,
+			wantServed: 2,
+		},
+		{
+			name: "abandoned ticket ahead is skipped",
+			run: func(t *testing.T, databaseName string) error {
+				if _, err := takeLockTicket(databaseName); err != nil {
+					t.Fatal(err)
+				}
+				stale := time.Now().Add(-2 * lockTicketTurnTimeout).UnixMilli()
+				fake.set(lockTableName, databaseName+lockTicketSuffix, "serving_since",
+					&dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(stale, 10))})
+				if err := releaseDynamoLock(ctx, databaseName, "w0"); err != nil {
+					t.Fatal(err)
+				}
+				_, err := waitForDynamoLock(ctx, databaseName, "w1", leaseExclusive, policy)
+				return err
+			},
+			wantServed: 3,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			databaseName := fmt.Sprintf("fair-%d.db", i)
+			if err := acquireDynamoLock(ctx, databaseName, "w0"); err != nil {
+				t.Fatalf("holder: %v", err)
+			}
+
+			err := tt.run(t, databaseName)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("w1 error = %v, want error %v", err, tt.wantErr)
+			}
+			if got := serving(databaseName); got != tt.wantServed {
+				t.Errorf("serving ticket %d after w1 returned, want %d", got, tt.wantServed)
+			}
+			expires := numberAttribute(fake.item(lockTableName, databaseName+lockTicketSuffix)["lease_timeout"])
+			if until := time.Until(time.Unix(expires, 0)); until < lockTicketsTTL-time.Minute || until > lockTicketsTTL {
+				t.Errorf("ticket counters expire in %v, want %v", until, lockTicketsTTL)
+			}
+			if tt.wantErr {
+				// The next waiter is served at once when the holder leaves
+				releaseDynamoLock(ctx, databaseName, "w0")
+				if _, err := waitForDynamoLock(ctx, databaseName, "w2", leaseExclusive, policy); err != nil {
+					t.Errorf("next waiter: %v", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// Phases of a request, logged with how long each took
+	phaseLock     = "lock"
+	phaseDownload = "download"
+	phaseExecute  = "execute"
+	phaseUpload   = "upload"
+	phaseRelease  = "release"
+
+	// How SQL statements appear in logs, set with LOG_SQL
+	logSQLRedacted = "redacted" // literals replaced with ?
+	logSQLFull     = "full"
+	logSQLOff      = "off"
+)
+
+type logAttrsKey struct{}
+
+// contextHandler adds the attributes attached to a context with
+// withLogAttrs to every record logged with that context
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		record.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func init() {
+	// JSON records on stderr, which Lambda sends to CloudWatch Logs; the
+	// standard logger writes through the same handler
+	handler := slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: logLevel()})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// logLevel returns the level set with LOG_LEVEL (debug, info, warn or
+// error), or info
+func logLevel() slog.Level {
+	var level slog.Level
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			slog.Warn("Ignoring invalid LOG_LEVEL", "value", raw)
+			return slog.LevelInfo
+		}
+	}
+	return level
+}
+
+// withLogAttrs returns a context whose log records carry attrs as well as
+// any attached before
+func withLogAttrs(ctx context.Context, attrs ...slog.Attr) context.Context {
+	existing, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	combined := make([]slog.Attr, 0, len(existing)+len(attrs))
+	combined = append(append(combined, existing...), attrs...)
+	return context.WithValue(ctx, logAttrsKey{}, combined)
+}
+
+// logPhase logs and records the end of a phase of a request, with how long
+// it took and whether it failed
+func logPhase(ctx context.Context, phase string, started time.Time, err error, args ...any) {
+	duration := time.Since(started)
+	recordPhase(ctx, phase, duration, err)
+	args = append(args, "phase", phase, "duration_ms", duration.Milliseconds())
+	if err != nil {
+		slog.ErrorContext(ctx, "Phase failed", append(args, "error", err)...)
+		return
+	}
+	slog.InfoContext(ctx, "Phase completed", args...)
+}
+
+// fileSize returns the size of a file, or 0 if it cannot be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+// logSQL returns a SQL statement as LOG_SQL says it may be logged: with
+// its literal values redacted (the default), in full, or not at all
+func logSQL(sqlStatement string) string {
+	switch mode := os.Getenv("LOG_SQL"); mode {
+	case logSQLFull:
+		return sqlStatement
+	case logSQLOff:
+		return ""
+	case "", logSQLRedacted:
+	default:
+		slog.Warn("Ignoring invalid LOG_SQL", "value", mode)
+	}
+	return redactSQL(sqlStatement)
+}
+
+// redactSQL replaces the string, blob and numeric literals in a SQL
+// statement with ?, leaving keywords, identifiers and comments
+func redactSQL(sqlStatement string) string {
+	var b strings.Builder
+	s := sqlStatement
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\'' || ((c == 'x' || c == 'X') && i+1 < len(s) && s[i+1] == '\'' && !continuesIdentifier(s, i)):
+			// String or blob literal; '' inside one is an escaped quote
+			if c != '\'' {
+				i++
+			}
+			for i++; i < len(s); i++ {
+				if s[i] == '\'' {
+					if i+1 < len(s) && s[i+1] == '\'' {
+						i++
+						continue
+					}
+					i++
+					break
+				}
+			}
+			b.WriteByte('?')
+
+		case c == '"' || c == '`' || c == '[':
+			// Quoted identifier, kept as written
+			closing := c
+			if c == '[' {
+				closing = ']'
+			}
+			end := strings.IndexByte(s[i+1:], closing)
+			if end < 0 {
+				b.WriteString(s[i:])
+				return b.String()
+			}
+			b.WriteString(s[i : i+end+2])
+			i += end + 2
+
+		case (isDigit(c) || (c == '.' && i+1 < len(s) && isDigit(s[i+1]))) && !continuesIdentifier(s, i):
+			// Numeric literal, including hex and exponents
+			for i < len(s) && (isIdentifierByte(s[i]) || s[i] == '.' ||
+				((s[i] == '+' || s[i] == '-') && (s[i-1] == 'e' || s[i-1] == 'E'))) {
+				i++
+			}
+			b.WriteByte('?')
+
+		default:
+			b.WriteByte(c)
+			i++
+		}
+	}
+	return b.String()
+}
+
+// continuesIdentifier reports whether the byte at i follows an identifier
+// character, as the digits in t1 or the x in max'...' would
+func continuesIdentifier(s string, i int) bool {
+	return i > 0 && (isIdentifierByte(s[i-1]) || s[i-1] >= 0x80)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentifierByte(c byte) bool {
+	return isDigit(c) || c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
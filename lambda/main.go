@@ -5,18 +5,24 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
 	"os"
 	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
-	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
 	"github.com/aws/aws-sdk-go/service/s3"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 )
 
 const (
@@ -31,18 +37,60 @@ const (
 	lockTimeoutMinutes = 5
 )
 
-// LockItem represents a DynamoDB lock item
+// LockItem represents a DynamoDB lock item. InstanceID holds the exclusive
+// lease; shared leases are kept in Readers with their expiry times.
 type LockItem struct {
 	DatabaseName string `json:"database_name" dynamodbav:"database_name"`
-	InstanceID   string `json:"instance_id" dynamodbav:"instance_id"`
+	InstanceID   string `json:"instance_id" dynamodbav:"instance_id,omitempty"`
 	LeaseTimeout int64  `json:"lease_timeout" dynamodbav:"lease_timeout"`
 	CreatedAt    int64  `json:"created_at" dynamodbav:"created_at"`
+
+	Mode    string           `json:"mode,omitempty" dynamodbav:"mode,omitempty"`
+	Readers map[string]int64 `json:"readers,omitempty" dynamodbav:"readers,omitempty"`
+
+	// A writer blocked by readers, which keeps new readers out until it gets in
+	WriterWaiting      string `json:"writer_waiting,omitempty" dynamodbav:"writer_waiting,omitempty"`
+	WriterWaitingUntil int64  `json:"writer_waiting_until,omitempty" dynamodbav:"writer_waiting_until,omitempty"`
+
+	// Who each instance above is, keyed by instance ID
+	Holders map[string]HolderIdentity `json:"holders,omitempty" dynamodbav:"holders,omitempty"`
+
+	// Version guards read-modify-write updates of the item
+	Version int64 `json:"version" dynamodbav:"version"`
 }
 
 // APIRequest represents the incoming API Gateway request
 type APIRequest struct {
+	Operation    string `json:"operation,omitempty"`
 	SQLStatement string `json:"sql_statement"`
 	DatabaseName string `json:"database_name,omitempty"`
+
+	// Earlier version to query or restore, by S3 version ID or RFC 3339 timestamp
+	VersionID string `json:"version_id,omitempty"`
+	AsOf      string `json:"as_of,omitempty"`
+
+	// Snapshot to create, delete or branch from, and the name of a new branch
+	SnapshotName string `json:"snapshot_name,omitempty"`
+	BranchName   string `json:"branch_name,omitempty"`
+
+	// Optional per-request limits; these can only tighten the role's limits
+	TimeoutMs      int64 `json:"timeout_ms,omitempty"`
+	MaxRows        int   `json:"max_rows,omitempty"`
+	MaxResultBytes int64 `json:"max_result_bytes,omitempty"`
+	MaxHeapBytes   int64 `json:"max_heap_bytes,omitempty"`
+
+	// RemoteRead runs a SELECT through the S3 VFS instead of downloading the database
+	RemoteRead bool `json:"remote_read,omitempty"`
+
+	// MaxStalenessMs bounds how old a replica may be to answer a SELECT in server mode
+	MaxStalenessMs int64 `json:"max_staleness_ms,omitempty"`
+
+	// LockWaitMs lowers how long the request waits for a held lock; 0 fails at once
+	LockWaitMs *int64 `json:"lock_wait_ms,omitempty"`
+
+	// For force_release_lock: the one instance whose lease to release; and the audited reason
+	InstanceID string `json:"instance_id,omitempty"`
+	Reason     string `json:"reason,omitempty"`
 }
 
 // APIResponse represents the API Gateway response
@@ -58,6 +106,17 @@ type SQLResult struct {
 	Data    interface{} `json:"data,omitempty"`
 	Message string      `json:"message,omitempty"`
 	Error   string      `json:"error,omitempty"`
+
+	// Code classifies a failure, such as LOCK_HELD or SQL_SYNTAX
+	Code string `json:"code,omitempty"`
+
+	LimitExceeded *LimitError `json:"limit_exceeded,omitempty"`
+
+	// StalenessMs is set when a replica answered: the data is at most this old
+	StalenessMs *int64 `json:"staleness_ms,omitempty"`
+
+	// LockWaitMs is how long the request waited for the lock
+	LockWaitMs *int64 `json:"lock_wait_ms,omitempty"`
 }
 
 var (
@@ -66,8 +125,10 @@ var (
 )
 
 func init() {
-	// Initialize AWS session
-	sess := session.Must(session.NewSession())
+	// Initialize AWS session; every S3 and DynamoDB request retries
+	// throttling and 5xx errors under the storage retry policy
+	config := request.WithRetryer(&aws.Config{EnforceShouldRetryCheck: aws.Bool(true)}, newStorageRetryer())
+	sess := session.Must(session.NewSession(config))
 	dynamoClient = dynamodb.New(sess)
 	s3Client = s3.New(sess)
 }
@@ -80,215 +141,322 @@ func Handler(ctx context.Context, request events.APIGatewayProxyRequest) (events
 		return createErrorResponse(400, "Invalid JSON in request body"), nil
 	}
 
+	// Leases taken for this request record who it came from
+	ctx = withHolderIdentity(ctx, request)
+
 	// Use default database name if not provided
 	if apiReq.DatabaseName == "" {
 		apiReq.DatabaseName = dbFileName
 	}
 
-	// Validate SQL statement
-	if apiReq.SQLStatement == "" {
-		return createErrorResponse(400, "SQL statement is required"), nil
+	// Everything logged for this request carries its ID and database
+	ctx = withLogAttrs(ctx,
+		slog.String("request_id", holderIdentity(ctx).RequestID),
+		slog.String("database", apiReq.DatabaseName))
+	operation := apiReq.Operation
+	if operation == "" {
+		operation = opQuery
 	}
+	ctx, requestMetrics := withRequestMetrics(ctx)
 
-	// Generate unique instance ID for this Lambda invocation
-	instanceID := fmt.Sprintf("lambda-%d", time.Now().UnixNano())
-
-	// Step 1: Acquire lock in DynamoDB
-	if err := acquireDynamoLock(apiReq.DatabaseName, instanceID); err != nil {
-		return createErrorResponse(409, fmt.Sprintf("Failed to acquire lock: %v", err)), nil
+	// The request's span continues the caller's trace, if it sent a traceparent
+	ctx, span := startRequestSpan(ctx, request.Headers, operation, apiReq.DatabaseName)
+	if spanContext := span.SpanContext(); spanContext.IsValid() {
+		ctx = withLogAttrs(ctx, slog.String("trace_id", spanContext.TraceID().String()))
 	}
+	started := time.Now()
+	slog.InfoContext(ctx, "Request received", "operation", operation, "sql", logSQL(apiReq.SQLStatement))
 
-	// Ensure lock is released
-	defer releaseDynamoLock(apiReq.DatabaseName, instanceID)
+	response, err := dispatch(ctx, request, apiReq)
 
-	// Step 2: Download database from S3
-	localDBPath, err := downloadFromS3(apiReq.DatabaseName)
-	if err != nil {
-		return createErrorResponse(500, fmt.Sprintf("Failed to download database: %v", err)), nil
+	level := slog.LevelInfo
+	if response.StatusCode >= 500 {
+		level = slog.LevelError
+	} else if response.StatusCode >= 400 {
+		level = slog.LevelWarn
 	}
-	defer os.Remove(localDBPath) // Clean up local file
+	slog.Log(ctx, level, "Request completed", "operation", operation, "status", response.StatusCode,
+		"duration_ms", time.Since(started).Milliseconds(), "response_bytes", len(response.Body))
+	recordRequest(ctx, requestMetrics, operation, apiReq.DatabaseName, response.StatusCode, time.Since(started))
 
-	// Step 3: Execute SQL statement
-	result, err := executeSQL(localDBPath, apiReq.SQLStatement)
-	if err != nil {
-		return createErrorResponse(500, fmt.Sprintf("SQL execution failed: %v", err)), nil
+	span.SetAttributes(semconv.HTTPResponseStatusCode(response.StatusCode))
+	if response.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(response.StatusCode))
 	}
+	span.End()
+	if inLambda {
+		flushTracing(ctx)
+	}
+	return response, err
+}
 
-	// Step 4: Upload modified database back to S3
-	if err := uploadToS3(localDBPath, apiReq.DatabaseName); err != nil {
-		return createErrorResponse(500, fmt.Sprintf("Failed to upload database: %v", err)), nil
+// dispatch runs a request's operation
+func dispatch(ctx context.Context, request events.APIGatewayProxyRequest, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	// Databases on the shared filesystem have no history in S3
+	if err := checkEFSOperation(apiReq); err != nil {
+		return createErrorResponse(400, err.Error()), nil
 	}
 
-	// Step 5: Return results
-	return createSuccessResponse(result), nil
+	switch apiReq.Operation {
+	case "", opQuery:
+		return handleQuery(ctx, request, apiReq)
+	case opListVersions:
+		return handleListVersions(apiReq)
+	case opRestore:
+		return handleRestore(ctx, apiReq)
+	case opSnapshot:
+		return handleSnapshot(ctx, apiReq)
+	case opBranch:
+		return handleBranch(ctx, apiReq)
+	case opListSnapshots:
+		return handleListSnapshots(apiReq)
+	case opDeleteSnapshot:
+		return handleDeleteSnapshot(apiReq)
+	case opListLocks, opInspectLock, opForceReleaseLock, opStealLock:
+		return handleLockAdmin(ctx, request, apiReq)
+	default:
+		return createErrorResponse(400, fmt.Sprintf("Unknown operation %q", apiReq.Operation)), nil
+	}
 }
 
-// acquireDynamoLock attempts to acquire a lock in DynamoDB
-func acquireDynamoLock(databaseName, instanceID string) error {
-	// Check if lock already exists
-	getItemInput := &dynamodb.GetItemInput{
-		TableName: aws.String(lockTableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"database_name": {
-				S: aws.String(databaseName),
-			},
-		},
+// handleQuery runs a SQL statement with the download-execute-upload cycle
+func handleQuery(ctx context.Context, request events.APIGatewayProxyRequest, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	// Validate SQL statement
+	if apiReq.SQLStatement == "" {
+		return createErrorResponse(400, "SQL statement is required"), nil
 	}
 
-	result, err := dynamoClient.GetItem(getItemInput)
-	if err != nil {
-		return fmt.Errorf("failed to check existing lock: %v", err)
+	limits := resolveLimits(requestRole(request), apiReq)
+
+	// Queries against an earlier version read an immutable copy, without the lock
+	if apiReq.VersionID != "" || apiReq.AsOf != "" {
+		return handleHistoricalQuery(ctx, apiReq, limits)
 	}
 
-	// If item exists, check if it's still valid
-	if result.Item != nil {
-		var existingLock LockItem
-		if err := dynamodbattribute.UnmarshalMap(result.Item, &existingLock); err != nil {
-			return fmt.Errorf("failed to unmarshal existing lock: %v", err)
-		}
+	// Snapshots are immutable
+	if isSnapshotDatabase(apiReq.DatabaseName) && !isSelectStatement(apiReq.SQLStatement) {
+		return createErrorResponse(400, "Snapshots are read-only; create a branch to modify one"), nil
+	}
 
-		// Check if lock is still valid (not expired)
-		currentTime := time.Now().Unix()
-		if existingLock.LeaseTimeout > currentTime {
-			return fmt.Errorf("database is locked by instance %s until %d",
-				existingLock.InstanceID, existingLock.LeaseTimeout)
+	// Databases on the shared filesystem are queried in place
+	if storageLayout(apiReq.DatabaseName) == layoutEFS {
+		return handleEFSQuery(ctx, apiReq, limits)
+	}
+
+	// In server mode, SELECTs on replicated databases are answered locally
+	if r := lookupReplica(apiReq.DatabaseName); r != nil && isSelectStatement(apiReq.SQLStatement) {
+		result, served, err := r.query(ctx, apiReq.SQLStatement, limits, time.Duration(apiReq.MaxStalenessMs)*time.Millisecond)
+		if err != nil {
+			return createFailureResponse("SQL execution failed", err), nil
+		}
+		if served {
+			return createSuccessResponse(result), nil
 		}
+	}
 
-		// Lock is expired, remove it
-		if err := releaseDynamoLock(databaseName, existingLock.InstanceID); err != nil {
-			log.Printf("Warning: Failed to remove expired lock: %v", err)
+	// Read-only queries on large databases run against S3 in place, without the lock
+	if useRemoteRead(apiReq) {
+		result, err := executeRemoteSQL(ctx, apiReq.DatabaseName, apiReq.SQLStatement, limits)
+		if err != nil {
+			return createFailureResponse("SQL execution failed", err), nil
 		}
+		return createSuccessResponse(result), nil
 	}
 
-	// Create new lock item
-	now := time.Now()
-	leaseTimeout := now.Add(time.Duration(lockTimeoutMinutes) * time.Minute).Unix()
+	// Nothing writes to a snapshot, so it is read without the lock
+	if isSnapshotDatabase(apiReq.DatabaseName) {
+		return handleSnapshotQuery(ctx, apiReq, limits)
+	}
 
-	lockItem := LockItem{
-		DatabaseName: databaseName,
-		InstanceID:   instanceID,
-		LeaseTimeout: leaseTimeout,
-		CreatedAt:    now.Unix(),
+	// Queued writes are applied in batches by whichever request holds the lock
+	if writeQueueEnabled() && !isSelectStatement(apiReq.SQLStatement) {
+		return handleQueuedWrite(ctx, apiReq, limits)
 	}
 
-	// Put item with condition to prevent race conditions
-	item, err := dynamodbattribute.MarshalMap(lockItem)
+	// Generate unique instance ID for this Lambda invocation
+	instanceID := newInstanceID()
+	ctx = withLogAttrs(ctx, slog.String("lock_holder", instanceID))
+
+	// Step 1: Acquire lock in DynamoDB, waiting for it under the lock wait policy.
+	// SELECTs share the lock; anything else needs it exclusively.
+	mode := leaseMode(apiReq.SQLStatement)
+	started := time.Now()
+	waited, err := waitForDynamoLock(ctx, apiReq.DatabaseName, instanceID, mode, lockWaitPolicy(apiReq))
+	logPhase(ctx, phaseLock, started, err, "mode", mode, "lock_wait_ms", waited.Milliseconds())
 	if err != nil {
-		return fmt.Errorf("failed to marshal lock item: %v", err)
+		return createLockErrorResponse(err, waited), nil
 	}
 
-	putItemInput := &dynamodb.PutItemInput{
-		TableName:           aws.String(lockTableName),
-		Item:                item,
-		ConditionExpression: aws.String("attribute_not_exists(database_name)"),
+	// Ensure lock is released
+	defer func() {
+		started := time.Now()
+		err := releaseDynamoLease(ctx, apiReq.DatabaseName, instanceID, mode)
+		logPhase(ctx, phaseRelease, started, err, "mode", mode)
+	}()
+	if mode == leaseExclusive {
+		ctx = withLeaseFence(ctx, apiReq.DatabaseName, instanceID)
 	}
 
-	_, err = dynamoClient.PutItem(putItemInput)
+	// Step 2: Download database from S3
+	started = time.Now()
+	localDBPath, err := downloadDatabase(ctx, apiReq.DatabaseName)
+	logPhase(ctx, phaseDownload, started, err, "bytes", fileSize(localDBPath), "layout", storageLayout(apiReq.DatabaseName))
 	if err != nil {
-		return fmt.Errorf("failed to acquire lock (race condition): %v", err)
+		return createFailureResponse("Failed to download database", err), nil
+	}
+	defer removeWorkingCopy(localDBPath) // Clean up local files
+	recordBytes(ctx, directionDownload, fileSize(localDBPath))
+
+	// Step 3: Execute SQL statement. Under a shared lease the connection is
+	// read-only, so a write hidden behind a SELECT prefix fails.
+	dsn := localDBPath
+	if mode == leaseShared {
+		dsn = readOnlyDSN(localDBPath)
+	}
+	started = time.Now()
+	result, err := executeSQL(ctx, dsn, apiReq.SQLStatement, limits)
+	logPhase(ctx, phaseExecute, started, err)
+	if err != nil {
+		return createFailureResponse("SQL execution failed", err), nil
 	}
 
-	log.Printf("Lock acquired for database %s by instance %s", databaseName, instanceID)
-	return nil
+	// Step 4: Upload modified database back to S3. Readers changed nothing,
+	// and concurrent readers must not race each other to re-upload it.
+	if mode == leaseExclusive {
+		started = time.Now()
+		err = uploadDatabase(ctx, localDBPath, apiReq.DatabaseName)
+		logPhase(ctx, phaseUpload, started, err, "bytes", fileSize(localDBPath), "layout", storageLayout(apiReq.DatabaseName))
+		if err != nil {
+			return createFailureResponse("Failed to upload database", err), nil
+		}
+		recordBytes(ctx, directionUpload, fileSize(localDBPath))
+	}
+
+	// Step 5: Return results
+	result.LockWaitMs = lockWaitMs(waited)
+	return createSuccessResponse(result), nil
 }
 
-// releaseDynamoLock removes the lock from DynamoDB
-func releaseDynamoLock(databaseName, instanceID string) error {
-	deleteItemInput := &dynamodb.DeleteItemInput{
-		TableName: aws.String(lockTableName),
-		Key: map[string]*dynamodb.AttributeValue{
-			"database_name": {
-				S: aws.String(databaseName),
-			},
-		},
-		ConditionExpression: aws.String("instance_id = :instance_id"),
-		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-			":instance_id": {
-				S: aws.String(instanceID),
-			},
-		},
-	}
+// newInstanceID generates a unique ID for a lock holder
+func newInstanceID() string {
+	return fmt.Sprintf("lambda-%d", time.Now().UnixNano())
+}
 
-	_, err := dynamoClient.DeleteItem(deleteItemInput)
-	if err != nil {
-		log.Printf("Warning: Failed to release lock: %v", err)
-		return err
-	}
+// acquireDynamoLock takes the exclusive lease on a database in DynamoDB
+func acquireDynamoLock(ctx context.Context, databaseName, instanceID string) error {
+	return acquireDynamoLease(ctx, databaseName, instanceID, leaseExclusive)
+}
 
-	log.Printf("Lock released for database %s by instance %s", databaseName, instanceID)
-	return nil
+// releaseDynamoLock gives up the exclusive lease on a database
+func releaseDynamoLock(ctx context.Context, databaseName, instanceID string) error {
+	return releaseDynamoLease(ctx, databaseName, instanceID, leaseExclusive)
 }
 
-// downloadFromS3 downloads the database file from S3
-func downloadFromS3(databaseName string) (string, error) {
-	localPath := fmt.Sprintf("/tmp/%s", databaseName)
+// downloadFromS3 downloads the database file from S3 to localPath, reusing
+// the local cache when the object's ETag has not changed
+func downloadFromS3(ctx context.Context, databaseName, localPath string) (err error) {
+	_, span := startSpan(ctx, "s3.download", attribute.String("aws.s3.bucket", s3BucketName), attribute.String("aws.s3.key", databaseName))
+	defer func() { endSpan(span, err) }()
 
 	downloadInput := &s3.GetObjectInput{
 		Bucket: aws.String(s3BucketName),
 		Key:    aws.String(databaseName),
 	}
 
-	result, err := s3Client.GetObject(downloadInput)
-	if err != nil {
-		return "", fmt.Errorf("failed to get object from S3: %v", err)
+	// Revalidate the cached copy with a conditional GET
+	cached, cachedETag := databaseCache.open(databaseName)
+	if cached != nil {
+		defer cached.Close()
+		downloadInput.IfNoneMatch = aws.String(cachedETag)
 	}
-	defer result.Body.Close()
 
-	// Create local file
-	file, err := os.Create(localPath)
+	info, err := downloadObjectFile(downloadInput, localPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create local file: %v", err)
+		if cached != nil && isNotModified(err) {
+			if err := writeLocalFile(localPath, cached); err != nil {
+				return err
+			}
+			span.SetAttributes(attribute.Bool("cloudsqlite.cache_hit", true))
+			slog.Debug("Using cached database", "database", databaseName, "etag", cachedETag)
+			return nil
+		}
+		databaseCache.invalidate(databaseName)
+		return fmt.Errorf("failed to get object from S3: %w", err)
 	}
-	defer file.Close()
 
-	// Copy S3 object to local file
-	if _, err := file.ReadFrom(result.Body); err != nil {
-		return "", fmt.Errorf("failed to copy S3 object to local file: %v", err)
+	if info.ETag != "" && databaseCache.fits(info.Size) {
+		if err := databaseCache.storeFile(databaseName, info.ETag, localPath); err != nil {
+			slog.Warn("Failed to cache database", "database", databaseName, "error", err)
+		}
 	}
 
-	log.Printf("Downloaded database %s from S3 to %s", databaseName, localPath)
-	return localPath, nil
+	span.SetAttributes(attribute.Int64("cloudsqlite.bytes", info.Size))
+	slog.Debug("Downloaded database from S3", "database", databaseName, "path", localPath, "bytes", info.Size)
+	return nil
 }
 
-// uploadToS3 uploads the modified database file back to S3
-func uploadToS3(localPath, databaseName string) error {
-	file, err := os.Open(localPath)
-	if err != nil {
-		return fmt.Errorf("failed to open local file: %v", err)
-	}
-	defer file.Close()
+// uploadToS3 uploads the modified database file back to S3 and caches
+// the uploaded version under its new ETag
+func uploadToS3(ctx context.Context, localPath, databaseName string) (err error) {
+	_, span := startSpan(ctx, "s3.upload", attribute.String("aws.s3.bucket", s3BucketName), attribute.String("aws.s3.key", databaseName),
+		attribute.Int64("cloudsqlite.bytes", fileSize(localPath)))
+	defer func() { endSpan(span, err) }()
 
-	uploadInput := &s3.PutObjectInput{
-		Bucket: aws.String(s3BucketName),
-		Key:    aws.String(databaseName),
-		Body:   file,
+	etag, err := uploadObjectFile(databaseName, localPath)
+	if err != nil {
+		databaseCache.invalidate(databaseName)
+		return err
 	}
 
-	_, err = s3Client.PutObject(uploadInput)
-	if err != nil {
-		return fmt.Errorf("failed to upload object to S3: %v", err)
+	if err := databaseCache.storeFile(databaseName, etag, localPath); err != nil {
+		slog.Warn("Failed to cache uploaded database", "database", databaseName, "error", err)
+		databaseCache.invalidate(databaseName)
 	}
 
-	log.Printf("Uploaded database %s to S3", databaseName)
+	slog.Debug("Uploaded database to S3", "database", databaseName, "etag", etag)
 	return nil
 }
 
-// executeSQL executes the SQL statement on the local database
-func executeSQL(dbPath, sqlStatement string) (*SQLResult, error) {
-	db, err := sql.Open("sqlite3", dbPath)
+// isNotModified reports whether a conditional GET found the object unchanged
+func isNotModified(err error) bool {
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == http.StatusNotModified
+}
+
+// executeSQL executes the SQL statement on the local database within the given limits
+func executeSQL(ctx context.Context, dbPath, sqlStatement string, limits QueryLimits) (result *SQLResult, err error) {
+	ctx, span := startSpan(ctx, "sql.execute", semconv.DBSystemSqlite, semconv.DBQueryText(logSQL(sqlStatement)))
+	defer func() { endSpan(span, err) }()
+
+	// The driver interrupts the running statement when the context is done
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	release, err := enterHeapLimit(ctx, limits)
+	if err != nil {
+		return nil, limitOrError(ctx, err, limits, "failed to start statement")
+	}
+	defer release()
+
+	db, err := sql.Open(sqliteDriverName, dbPath)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %v", err)
 	}
-	defer db.Close()
+	defer db.Close() // before the next statement sets its own heap limit
+	db.SetMaxOpenConns(1)
 
-	// Determine if this is a SELECT query
-	isSelect := len(sqlStatement) > 6 && sqlStatement[:6] == "SELECT"
+	if err := applyConnectionLimits(ctx, db, limits); err != nil {
+		return nil, err
+	}
 
-	if isSelect {
+	if isSelectStatement(sqlStatement) {
 		// Execute SELECT query
-		rows, err := db.Query(sqlStatement)
+		rows, err := db.QueryContext(ctx, sqlStatement)
 		if err != nil {
-			return nil, fmt.Errorf("SELECT query failed: %v", err)
+			return nil, limitOrError(ctx, err, limits, "SELECT query failed")
 		}
 		defer rows.Close()
 
@@ -300,7 +468,12 @@ func executeSQL(dbPath, sqlStatement string) (*SQLResult, error) {
 
 		// Scan results
 		var results []map[string]interface{}
+		var resultBytes int64
 		for rows.Next() {
+			if limits.MaxRows > 0 && len(results) >= limits.MaxRows {
+				return nil, &LimitError{Limit: limitMaxRows, Threshold: int64(limits.MaxRows)}
+			}
+
 			values := make([]interface{}, len(columns))
 			valuePtrs := make([]interface{}, len(columns))
 			for i := range values {
@@ -315,8 +488,22 @@ func executeSQL(dbPath, sqlStatement string) (*SQLResult, error) {
 			for i, col := range columns {
 				row[col] = values[i]
 			}
+
+			// Measure the row as it will appear in the response body
+			if limits.MaxResultBytes > 0 {
+				encoded, _ := json.Marshal(row)
+				resultBytes += int64(len(encoded))
+				if resultBytes > limits.MaxResultBytes {
+					return nil, &LimitError{Limit: limitResultBytes, Threshold: limits.MaxResultBytes}
+				}
+			}
 			results = append(results, row)
 		}
+		if err := rows.Err(); err != nil {
+			return nil, limitOrError(ctx, err, limits, "failed to read rows")
+		}
+		recordRows(ctx, len(results))
+		span.SetAttributes(attribute.Int("cloudsqlite.rows_returned", len(results)))
 
 		return &SQLResult{
 			Success: true,
@@ -325,12 +512,13 @@ func executeSQL(dbPath, sqlStatement string) (*SQLResult, error) {
 		}, nil
 	} else {
 		// Execute non-SELECT query (INSERT, UPDATE, DELETE, etc.)
-		result, err := db.Exec(sqlStatement)
+		execResult, err := db.ExecContext(ctx, sqlStatement)
 		if err != nil {
-			return nil, fmt.Errorf("query execution failed: %v", err)
+			return nil, limitOrError(ctx, err, limits, "query execution failed")
 		}
 
-		rowsAffected, _ := result.RowsAffected()
+		rowsAffected, _ := execResult.RowsAffected()
+		span.SetAttributes(attribute.Int64("cloudsqlite.rows_affected", rowsAffected))
 		return &SQLResult{
 			Success: true,
 			Message: fmt.Sprintf("Query executed successfully, %d rows affected", rowsAffected),
@@ -338,6 +526,36 @@ func executeSQL(dbPath, sqlStatement string) (*SQLResult, error) {
 	}
 }
 
+// readOnlyDSN returns the data source name that opens a local database read-only
+func readOnlyDSN(path string) string {
+	return fmt.Sprintf("file:%s?mode=ro", url.PathEscape(path))
+}
+
+// isSelectStatement determines if this is a SELECT query
+func isSelectStatement(sqlStatement string) bool {
+	return len(sqlStatement) > 6 && sqlStatement[:6] == "SELECT"
+}
+
+// limitOrError converts interrupts and out-of-memory failures into a
+// LimitError, and another connection's lock into a LockWaitError
+func limitOrError(ctx context.Context, err error, limits QueryLimits, message string) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &LimitError{Limit: limitTimeout, Threshold: limits.Timeout.Milliseconds()}
+	}
+	if sqliteErr, ok := err.(sqlite3.Error); ok && limits.MaxHeapBytes > 0 {
+		switch sqliteErr.Code {
+		case sqlite3.ErrNomem:
+			return &LimitError{Limit: limitHeapBytes, Threshold: limits.MaxHeapBytes}
+		case sqlite3.ErrTooBig:
+			return &LimitError{Limit: limitHeapBytes, Threshold: maxValueBytes(limits)}
+		}
+	}
+	if isSQLiteBusy(err) {
+		return &LockWaitError{Err: fmt.Errorf("%s: %w", message, err)}
+	}
+	return fmt.Errorf("%s: %w", message, err)
+}
+
 // createSuccessResponse creates a successful API Gateway response
 func createSuccessResponse(data interface{}) events.APIGatewayProxyResponse {
 	body, _ := json.Marshal(data)
@@ -350,22 +568,23 @@ func createSuccessResponse(data interface{}) events.APIGatewayProxyResponse {
 	}
 }
 
-// createErrorResponse creates an error API Gateway response
+// createErrorResponse creates an error API Gateway response with the
+// error code for its status
 func createErrorResponse(statusCode int, message string) events.APIGatewayProxyResponse {
-	errorBody := SQLResult{
-		Success: false,
-		Error:   message,
-	}
-	body, _ := json.Marshal(errorBody)
-	return events.APIGatewayProxyResponse{
-		StatusCode: statusCode,
-		Headers: map[string]string{
-			"Content-Type": "application/json",
-		},
-		Body: string(body),
+	code, ok := statusErrorCodes[statusCode]
+	if !ok {
+		code = errorCodeInternal
 	}
+	return createCodedErrorResponse(statusCode, code, message)
 }
 
 func main() {
+	// Arguments mean the binary was started as the command-line tool
+	if len(os.Args) > 1 {
+		code := runCLI(os.Args[1:])
+		shutdownTracing()
+		os.Exit(code)
+	}
+	inLambda = true
 	lambda.Start(Handler)
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// CloudWatch namespace of the Embedded Metric Format records
+	metricsNamespace = "CloudSQLite"
+
+	// Directions of database transfers
+	directionDownload = "download"
+	directionUpload   = "upload"
+)
+
+// Upper bounds, in seconds, of the histogram buckets
+var histogramBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Help text of each Prometheus metric, which also lists the metric types
+var metricHelp = map[string][2]string{
+	"cloudsqlite_requests_total":           {"counter", "Requests handled, by operation and HTTP status"},
+	"cloudsqlite_request_duration_seconds": {"histogram", "Time to handle a request, by operation"},
+	"cloudsqlite_phase_duration_seconds":   {"histogram", "Time spent in each phase of a request, by phase and outcome"},
+	"cloudsqlite_lock_wait_seconds":        {"histogram", "Time spent waiting for a lock, by lease mode"},
+	"cloudsqlite_lock_conflicts_total":     {"counter", "Requests that gave up waiting for a held lock, by lease mode"},
+	"cloudsqlite_bytes_transferred_total":  {"counter", "Database bytes downloaded and uploaded, by direction"},
+	"cloudsqlite_rows_returned_total":      {"counter", "Rows returned by SELECT statements"},
+	"cloudsqlite_storage_retries_total":    {"counter", "S3 and DynamoDB requests retried after a transient failure, by operation"},
+}
+
+// inLambda is set when running in Lambda, where each request prints its
+// metrics as a CloudWatch Embedded Metric Format record and flushes its spans
+var inLambda bool
+
+type metricKey struct {
+	name   string
+	labels string // rendered as name="value",...
+}
+
+type histogram struct {
+	counts []uint64 // per bucket, plus +Inf
+	sum    float64
+	count  uint64
+}
+
+// metricsRegistry holds the process-wide counters and histograms served at
+// /metrics in server mode
+type metricsRegistry struct {
+	mu         sync.Mutex
+	counters   map[metricKey]float64
+	histograms map[metricKey]*histogram
+}
+
+var metrics = &metricsRegistry{
+	counters:   make(map[metricKey]float64),
+	histograms: make(map[metricKey]*histogram),
+}
+
+// add increases a counter
+func (r *metricsRegistry) add(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.counters[metricKey{name, renderLabels(labels)}] += value
+}
+
+// observe records a value in a histogram
+func (r *metricsRegistry) observe(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key := metricKey{name, renderLabels(labels)}
+	h := r.histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(histogramBuckets)+1)}
+		r.histograms[key] = h
+	}
+	i := sort.SearchFloat64s(histogramBuckets, value)
+	h.counts[i]++
+	h.sum += value
+	h.count++
+}
+
+// writePrometheus writes every metric in the Prometheus text format
+func (r *metricsRegistry) writePrometheus(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	byName := make(map[string][]metricKey)
+	for key := range r.counters {
+		byName[key.name] = append(byName[key.name], key)
+	}
+	for key := range r.histograms {
+		byName[key.name] = append(byName[key.name], key)
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		keys := byName[name]
+		sort.Slice(keys, func(i, j int) bool { return keys[i].labels < keys[j].labels })
+		help := metricHelp[name]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help[1], name, help[0])
+		for _, key := range keys {
+			h, ok := r.histograms[key]
+			if !ok {
+				fmt.Fprintf(w, "%s%s %g\n", name, wrapLabels(key.labels), r.counters[key])
+				continue
+			}
+			var cumulative uint64
+			for i, bound := range histogramBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(w, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(key.labels, fmt.Sprintf(`le="%g"`, bound))), cumulative)
+			}
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(key.labels, `le="+Inf"`)), h.count)
+			fmt.Fprintf(w, "%s_sum%s %g\n", name, wrapLabels(key.labels), h.sum)
+			fmt.Fprintf(w, "%s_count%s %d\n", name, wrapLabels(key.labels), h.count)
+		}
+	}
+}
+
+// renderLabels renders name, value pairs as Prometheus labels
+func renderLabels(pairs []string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(pairs[i+1])
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, pairs[i], value))
+	}
+	return strings.Join(parts, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// serveMetrics serves the process's metrics to Prometheus
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writePrometheus(w)
+}
+
+type requestMetricsKey struct{}
+
+// requestMetrics collects the metrics of one request for its EMF record.
+// Values recorded more than once, such as two downloads, are summed.
+type requestMetrics struct {
+	mu     sync.Mutex
+	values map[string]float64
+	units  map[string]string
+}
+
+// withRequestMetrics attaches a metrics collector for one request to ctx
+func withRequestMetrics(ctx context.Context) (context.Context, *requestMetrics) {
+	m := &requestMetrics{values: make(map[string]float64), units: make(map[string]string)}
+	return context.WithValue(ctx, requestMetricsKey{}, m), m
+}
+
+// recordRequestMetric adds a value to the request's EMF record, if it has one
+func recordRequestMetric(ctx context.Context, name, unit string, value float64) {
+	m, ok := ctx.Value(requestMetricsKey{}).(*requestMetrics)
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values[name] += value
+	m.units[name] = unit
+}
+
+// writeEMF writes the request's metrics as one CloudWatch Embedded Metric
+// Format record, with the operation as the only dimension so the number of
+// metric series stays fixed; the request ID and database are properties
+func (m *requestMetrics) writeEMF(w io.Writer, operation, requestID, database string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, 0, len(names))
+	record := map[string]interface{}{
+		"Operation":  operation,
+		"RequestId":  requestID,
+		"Database":   database,
+		"StatusCode": status,
+	}
+	for _, name := range names {
+		definitions = append(definitions, map[string]string{"Name": name, "Unit": m.units[name]})
+		record[name] = m.values[name]
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  metricsNamespace,
+			"Dimensions": [][]string{{"Operation"}},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Warn("Failed to marshal metrics", "error", err)
+		return
+	}
+	fmt.Fprintln(w, string(line))
+}
+
+// recordRequest records a handled request, and in Lambda prints its EMF record
+func recordRequest(ctx context.Context, m *requestMetrics, operation, database string, status int, duration time.Duration) {
+	metrics.add("cloudsqlite_requests_total", 1, "operation", operation, "status", fmt.Sprint(status))
+	metrics.observe("cloudsqlite_request_duration_seconds", duration.Seconds(), "operation", operation)
+	if inLambda {
+		recordRequestMetric(ctx, "RequestMs", "Milliseconds", float64(duration.Milliseconds()))
+		m.writeEMF(os.Stdout, operation, holderIdentity(ctx).RequestID, database, status)
+	}
+}
+
+// recordPhase records how long a phase of a request took
+func recordPhase(ctx context.Context, phase string, duration time.Duration, err error) {
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	metrics.observe("cloudsqlite_phase_duration_seconds", duration.Seconds(), "phase", phase, "outcome", outcome)
+	recordRequestMetric(ctx, strings.ToUpper(phase[:1])+phase[1:]+"Ms", "Milliseconds", float64(duration.Milliseconds()))
+}
+
+// recordLockWait records how long a request waited for a lock, and whether
+// it gave up because the lock stayed held
+func recordLockWait(ctx context.Context, mode string, waited time.Duration, conflict bool) {
+	metrics.observe("cloudsqlite_lock_wait_seconds", waited.Seconds(), "mode", mode)
+	recordRequestMetric(ctx, "LockWaitMs", "Milliseconds", float64(waited.Milliseconds()))
+	if conflict {
+		metrics.add("cloudsqlite_lock_conflicts_total", 1, "mode", mode)
+		recordRequestMetric(ctx, "LockConflicts", "Count", 1)
+	}
+}
+
+// recordBytes records database bytes moved between S3 and a working copy
+func recordBytes(ctx context.Context, direction string, bytes int64) {
+	metrics.add("cloudsqlite_bytes_transferred_total", float64(bytes), "direction", direction)
+	if direction == directionDownload {
+		recordRequestMetric(ctx, "BytesDownloaded", "Bytes", float64(bytes))
+	} else {
+		recordRequestMetric(ctx, "BytesUploaded", "Bytes", float64(bytes))
+	}
+}
+
+// recordRows records the rows a SELECT returned
+func recordRows(ctx context.Context, rows int) {
+	metrics.add("cloudsqlite_rows_returned_total", float64(rows))
+	recordRequestMetric(ctx, "RowsReturned", "Count", float64(rows))
+}
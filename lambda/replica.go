@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Default interval between checks for a newer version of a replicated database
+	defaultReplicaRefreshInterval = 5 * time.Second
+
+	// Refresh intervals a replica may miss before a SELECT that sets no
+	// max_staleness_ms takes the normal path instead
+	replicaStaleIntervals = 3
+
+	// Shortest time between refreshes of a replica triggered by notifications
+	replicaMinNotifyGap = time.Second
+)
+
+// replica is a local read-only copy of a database kept current by a
+// long-lived process
+type replica struct {
+	databaseName string
+
+	mu         sync.RWMutex
+	localPath  string
+	etag       string
+	verifiedAt time.Time // when the copy was last known to match the bucket
+
+	refresh chan struct{}
+}
+
+var (
+	replicasMu sync.RWMutex
+	replicas   = make(map[string]*replica)
+)
+
+// replicaDatabases returns the databases listed in REPLICA_DATABASES
+func replicaDatabases() []string {
+	var names []string
+	for _, name := range strings.Split(os.Getenv("REPLICA_DATABASES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// replicaRefreshInterval returns REPLICA_REFRESH_INTERVAL or the default
+func replicaRefreshInterval() time.Duration {
+	if raw := os.Getenv("REPLICA_REFRESH_INTERVAL"); raw != "" {
+		if interval, err := time.ParseDuration(raw); err == nil && interval > 0 {
+			return interval
+		}
+		slog.Warn("Ignoring invalid REPLICA_REFRESH_INTERVAL", "value", raw)
+	}
+	return defaultReplicaRefreshInterval
+}
+
+// databaseETag returns the ETag of the object that changes with every commit
+// to a database, falling back to the single object of an unmigrated database
+func databaseETag(databaseName string) (string, bool, error) {
+	keys := []string{rootObjectKey(databaseName)}
+	if keys[0] != databaseName {
+		keys = append(keys, databaseName)
+	}
+
+	for _, key := range keys {
+		head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(s3BucketName),
+			Key:    aws.String(key),
+		})
+		if err == nil {
+			return aws.StringValue(head.ETag), true, nil
+		}
+		if !isNotFound(err) {
+			return "", false, fmt.Errorf("failed to check database %s: %w", databaseName, err)
+		}
+	}
+	return "", false, nil
+}
+
+// startReplicas loads every database in REPLICA_DATABASES and keeps it
+// refreshed until ctx is done
+func startReplicas(ctx context.Context) {
+	interval := replicaRefreshInterval()
+	for _, name := range replicaDatabases() {
+		r := &replica{databaseName: name, refresh: make(chan struct{}, 1)}
+		if err := r.update(ctx); err != nil {
+			slog.Warn("Initial load of replica failed", "database", name, "error", err)
+		}
+
+		replicasMu.Lock()
+		replicas[name] = r
+		replicasMu.Unlock()
+
+		go r.run(ctx, interval)
+		slog.Info("Replicating database", "database", name, "interval", interval.String())
+	}
+}
+
+// lookupReplica returns the replica of a database, if one is kept
+func lookupReplica(databaseName string) *replica {
+	replicasMu.RLock()
+	defer replicasMu.RUnlock()
+	return replicas[databaseName]
+}
+
+// notifyReplicas schedules an immediate refresh of the replicas whose
+// database a changed object key belongs to
+func notifyReplicas(key string) int {
+	replicasMu.RLock()
+	defer replicasMu.RUnlock()
+
+	notified := 0
+	for name, r := range replicas {
+		if key == name || key == rootObjectKey(name) {
+			select {
+			case r.refresh <- struct{}{}:
+			default: // a refresh is already pending
+			}
+			notified++
+		}
+	}
+	return notified
+}
+
+// run polls for new versions until ctx is done. Notifications are
+// coalesced, so a burst of them costs at most one refresh per replicaMinNotifyGap.
+func (r *replica) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var lastUpdate time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			r.mu.Lock()
+			if r.localPath != "" {
+				removeWorkingCopy(r.localPath)
+			}
+			r.mu.Unlock()
+			return
+		case <-ticker.C:
+		case <-r.refresh:
+			if wait := replicaMinNotifyGap - time.Since(lastUpdate); wait > 0 {
+				select {
+				case <-ctx.Done():
+					continue
+				case <-time.After(wait):
+				}
+			}
+		}
+		lastUpdate = time.Now()
+		if err := r.update(ctx); err != nil {
+			slog.Warn("Refresh of replica failed", "database", r.databaseName, "error", err)
+		}
+	}
+}
+
+// update replaces the local copy if the database has changed
+func (r *replica) update(ctx context.Context) error {
+	checkedAt := time.Now()
+	etag, found, err := databaseETag(r.databaseName)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("database %s not found", r.databaseName)
+	}
+
+	r.mu.RLock()
+	current := r.localPath != "" && etag == r.etag
+	r.mu.RUnlock()
+	if current {
+		r.mu.Lock()
+		r.verifiedAt = checkedAt
+		r.mu.Unlock()
+		return nil
+	}
+
+	localPath, err := downloadDatabase(ctx, r.databaseName)
+	if err != nil {
+		return err
+	}
+	// Checkpoint a WAL working copy so it can be opened read-only
+	if guard := takeWALGuard(localPath); guard != nil {
+		guard.close()
+	}
+
+	// Swap in the new copy; queries still reading the old one hold the read lock
+	r.mu.Lock()
+	oldPath := r.localPath
+	r.localPath, r.etag, r.verifiedAt = localPath, etag, checkedAt
+	r.mu.Unlock()
+	if oldPath != "" {
+		removeWorkingCopy(oldPath)
+	}
+
+	slog.Info("Refreshed replica", "database", r.databaseName, "etag", etag)
+	return nil
+}
+
+// query runs a SELECT against the local copy if it is fresh enough and
+// reports how stale the answer may be. Without a maxStaleness, a copy that
+// has missed replicaStaleIntervals refreshes is not used, so a replica whose
+// refreshes keep failing stops answering instead of serving old data.
+func (r *replica) query(ctx context.Context, sqlStatement string, limits QueryLimits, maxStaleness time.Duration) (*SQLResult, bool, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.localPath == "" {
+		return nil, false, nil
+	}
+	if maxStaleness <= 0 {
+		maxStaleness = replicaStaleIntervals * replicaRefreshInterval()
+	}
+	staleness := time.Since(r.verifiedAt)
+	if staleness > maxStaleness {
+		return nil, false, nil
+	}
+
+	result, err := executeSQL(ctx, readOnlyDSN(r.localPath), sqlStatement, limits)
+	if err != nil {
+		return nil, true, err
+	}
+	stalenessMs := staleness.Milliseconds()
+	result.StalenessMs = &stalenessMs
+	return result, true, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Default retry policy for S3 and DynamoDB requests
+	defaultStorageMaxRetries     = 5
+	defaultStorageBackoffInitial = 50 * time.Millisecond
+	defaultStorageBackoffMax     = 5 * time.Second
+
+	// Object metadata naming the upload that wrote an object, so an upload
+	// that failed ambiguously can be checked
+	uploadIDMetadataKey = "Upload-Id"
+
+	// S3's throttling error, which the SDK only recognises by its 503 status
+	s3SlowDownCode = "SlowDown"
+)
+
+// storageRetryer retries throttled, 5xx and failed network requests with
+// exponential backoff. Writes that may have been applied although they
+// failed are not resent blindly; their callers check whether they took effect.
+type storageRetryer struct {
+	client.DefaultRetryer
+}
+
+// newStorageRetryer returns the retryer configured with STORAGE_MAX_RETRIES,
+// STORAGE_BACKOFF_INITIAL_MS and STORAGE_BACKOFF_MAX_MS
+func newStorageRetryer() storageRetryer {
+	maxDelay := storageBackoffMax()
+	return storageRetryer{client.DefaultRetryer{
+		NumMaxRetries:    storageMaxRetries(),
+		MinRetryDelay:    storageBackoffInitial(),
+		MaxRetryDelay:    maxDelay,
+		MinThrottleDelay: min(client.DefaultRetryerMinThrottleDelay, maxDelay),
+		MaxThrottleDelay: maxDelay,
+	}}
+}
+
+// ShouldRetry decides whether a failed request is sent again
+func (r storageRetryer) ShouldRetry(req *request.Request) bool {
+	if !isIdempotentRequest(req) && isAmbiguousError(req.Error) {
+		return false
+	}
+	if !r.DefaultRetryer.ShouldRetry(req) {
+		return false
+	}
+	if req.RetryCount < r.MaxRetries() {
+		recordStorageRetry(req.Operation.Name, req.Error)
+	}
+	return true
+}
+
+// storageMaxRetries returns STORAGE_MAX_RETRIES or the default
+func storageMaxRetries() int {
+	if raw := os.Getenv("STORAGE_MAX_RETRIES"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n >= 0 {
+			return n
+		}
+		slog.Warn("Ignoring invalid STORAGE_MAX_RETRIES", "value", raw)
+	}
+	return defaultStorageMaxRetries
+}
+
+func storageBackoffInitial() time.Duration {
+	if initial := envMilliseconds("STORAGE_BACKOFF_INITIAL_MS", defaultStorageBackoffInitial); initial > 0 {
+		return initial
+	}
+	return defaultStorageBackoffInitial
+}
+
+func storageBackoffMax() time.Duration {
+	return max(envMilliseconds("STORAGE_BACKOFF_MAX_MS", defaultStorageBackoffMax), storageBackoffInitial())
+}
+
+// storageBackoff returns a random delay up to the attempt's exponential backoff
+func storageBackoff(attempt int) time.Duration {
+	ceiling := storageBackoffMax()
+	if attempt < 30 {
+		if exp := storageBackoffInitial() << attempt; exp > 0 && exp < ceiling {
+			ceiling = exp
+		}
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
+
+// recordStorageRetry counts and logs a storage request that is being retried
+func recordStorageRetry(operation string, err error) {
+	metrics.add("cloudsqlite_storage_retries_total", 1, "operation", operation)
+	slog.Info("Retrying storage request", "operation", operation, "error", err)
+}
+
+// isIdempotentRequest reports whether sending a request twice has the same
+// effect as sending it once. Conditional writes and counter updates are not:
+// a retry of one that was applied would fail its condition or count twice.
+// Database uploads, which carry an upload ID, are checked by putVerified
+// instead; a completed multipart upload cannot be completed again.
+func isIdempotentRequest(req *request.Request) bool {
+	switch params := req.Params.(type) {
+	case *s3.PutObjectInput:
+		return metadataValue(params.Metadata, uploadIDMetadataKey) == ""
+	case *s3.CompleteMultipartUploadInput:
+		return false
+	case *dynamodb.PutItemInput:
+		return params.ConditionExpression == nil
+	case *dynamodb.DeleteItemInput:
+		return params.ConditionExpression == nil
+	case *dynamodb.UpdateItemInput:
+		return params.ConditionExpression == nil && !strings.Contains(aws.StringValue(params.UpdateExpression), "ADD ")
+	}
+	return true
+}
+
+// isAmbiguousError reports whether a request failed in a way that leaves open
+// whether it was applied: no response arrived, a successful response could
+// not be read, or the service failed with a 5xx error, which it may return
+// after applying the request. Throttling errors are refused before any work.
+func isAmbiguousError(err error) bool {
+	var awsErr awserr.Error
+	if err == nil || !errors.As(err, &awsErr) || awsErr.Code() == request.CanceledErrorCode {
+		return false
+	}
+	if request.IsErrorThrottle(awsErr) || awsErr.Code() == s3SlowDownCode {
+		return false
+	}
+	if reqErr, ok := awsErr.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 300 && reqErr.StatusCode() < 500 {
+		return false
+	}
+	return true
+}
+
+// newUploadID returns an ID recorded with an uploaded object
+func newUploadID() string {
+	return fmt.Sprintf("%x-%08x", time.Now().UnixNano(), rand.Uint32())
+}
+
+// putVerified runs a write of an object that S3 may have applied even though
+// it failed. After an ambiguous failure the object is checked for the
+// upload's ID, and the write is tried again only if it is not there.
+func putVerified(operation, key, uploadID string, put func() (string, error)) (string, error) {
+	for attempt := 0; ; attempt++ {
+		etag, err := put()
+		if err == nil {
+			return etag, nil
+		}
+		// A completed multipart upload is gone, so retrying its completion
+		// fails even though it was applied
+		if !isAmbiguousError(err) && (attempt == 0 || !isNoSuchUpload(err)) {
+			return "", err
+		}
+		if etag, ok := uploadApplied(key, uploadID); ok {
+			slog.Info("Upload was applied despite an error", "key", key, "error", err)
+			return etag, nil
+		}
+		if attempt >= storageMaxRetries() {
+			return "", err
+		}
+		recordStorageRetry(operation, err)
+		time.Sleep(storageBackoff(attempt))
+	}
+}
+
+// uploadApplied reports whether an object was last written by the given
+// upload, and returns its ETag
+func uploadApplied(key, uploadID string) (string, bool) {
+	output, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if !isNotFound(err) {
+			slog.Warn("Failed to check upload", "key", key, "error", err)
+		}
+		return "", false
+	}
+	if metadataValue(output.Metadata, uploadIDMetadataKey) != uploadID {
+		return "", false
+	}
+	return aws.StringValue(output.ETag), true
+}
+
+// isNoSuchUpload reports whether a multipart upload no longer exists
+func isNoSuchUpload(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == s3.ErrCodeNoSuchUpload
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestIsAmbiguousError(t *testing.T) {
+	failure := func(code string, status int) error {
+		return awserr.NewRequestFailure(awserr.New(code, "failed", nil), status, "request-1")
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "no error", err: nil, want: false},
+		{name: "not from AWS", err: errors.New("disk full"), want: false},
+		{name: "canceled", err: awserr.New(request.CanceledErrorCode, "canceled", context.Canceled), want: false},
+		{name: "no response", err: awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset")), want: true},
+		{name: "response not read", err: awserr.New(request.ErrCodeSerialization, "failed to decode", nil), want: true},
+		{name: "conditional check failed", err: failure(dynamodb.ErrCodeConditionalCheckFailedException, http.StatusBadRequest), want: false},
+		{name: "not found", err: failure(s3.ErrCodeNoSuchKey, http.StatusNotFound), want: false},
+		{name: "precondition failed", err: failure("PreconditionFailed", http.StatusPreconditionFailed), want: false},
+		{name: "internal error", err: failure("InternalError", http.StatusInternalServerError), want: true},
+		{name: "service unavailable", err: failure("ServiceUnavailable", http.StatusServiceUnavailable), want: true},
+		{name: "throttled", err: failure("SlowDown", http.StatusServiceUnavailable), want: false},
+		{name: "throughput exceeded", err: failure(dynamodb.ErrCodeProvisionedThroughputExceededException, http.StatusBadRequest), want: false},
+		{name: "wrapped", err: fmt.Errorf("failed to update lock: %w", failure("InternalError", http.StatusInternalServerError)), want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isAmbiguousError(tt.err); got != tt.want {
+				t.Errorf("isAmbiguousError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsIdempotentRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		params any
+		want   bool
+	}{
+		{name: "get", params: &s3.GetObjectInput{}, want: true},
+		{name: "plain put", params: &s3.PutObjectInput{}, want: true},
+		{name: "database upload", params: &s3.PutObjectInput{Metadata: map[string]*string{uploadIDMetadataKey: aws.String("u1")}}, want: false},
+		{name: "complete multipart upload", params: &s3.CompleteMultipartUploadInput{}, want: false},
+		{name: "conditional put item", params: &dynamodb.PutItemInput{ConditionExpression: aws.String("version = :v")}, want: false},
+		{name: "put item", params: &dynamodb.PutItemInput{}, want: true},
+		{name: "counter update", params: &dynamodb.UpdateItemInput{UpdateExpression: aws.String("ADD next_ticket :one")}, want: false},
+		{name: "set update", params: &dynamodb.UpdateItemInput{UpdateExpression: aws.String("SET serving = :t")}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &request.Request{Params: tt.params}
+			if got := isIdempotentRequest(req); got != tt.want {
+				t.Errorf("isIdempotentRequest(%T) = %v, want %v", tt.params, got, tt.want)
+			}
+		})
+	}
+}
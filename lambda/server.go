@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Largest request body the server accepts
+const maxServerRequestBytes = 10 * 1024 * 1024
+
+// s3EventNotification is the part of an S3 event notification, delivered
+// directly or through SNS or EventBridge, that names the changed objects
+type s3EventNotification struct {
+	Records []struct {
+		S3 struct {
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+
+	// EventBridge "Object Created" events
+	Detail struct {
+		Object struct {
+			Key string `json:"key"`
+		} `json:"object"`
+	} `json:"detail"`
+
+	// SNS wraps the S3 event in Message
+	Message string `json:"Message"`
+}
+
+// runServer runs the long-lived HTTP server mode: the API is served at POST /
+// and the databases in REPLICA_DATABASES are kept as local read replicas
+func runServer(args []string) int {
+	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := flags.String("addr", ":8080", "Address to listen on")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	startReplicas(ctx)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", serveAPI)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/replicas/notify", serveReplicaNotification)
+	mux.HandleFunc("/metrics", serveMetrics)
+
+	server := &http.Server{Addr: *addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving", "addr", *addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		slog.Error("Server failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// serveAPI passes a request to Handler as if it came through API Gateway
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST a JSON request", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxServerRequestBytes))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	headers := make(map[string]string)
+	for name := range r.Header {
+		headers[name] = r.Header.Get(name)
+	}
+
+	request := events.APIGatewayProxyRequest{
+		HTTPMethod: r.Method,
+		Path:       r.URL.Path,
+		Headers:    headers,
+		Body:       string(body),
+	}
+	request.RequestContext.RequestID = r.Header.Get("X-Request-Id")
+	request.RequestContext.Identity.SourceIP = r.RemoteAddr
+
+	response, err := Handler(r.Context(), request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for name, value := range response.Headers {
+		w.Header().Set(name, value)
+	}
+	w.WriteHeader(response.StatusCode)
+	io.WriteString(w, response.Body)
+}
+
+// serveReplicaNotification refreshes replicas as soon as an S3 event
+// notification reports that one of their objects changed. Callers must
+// present REPLICA_NOTIFY_TOKEN; without one configured the endpoint is off.
+func serveReplicaNotification(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "POST an S3 event notification", http.StatusMethodNotAllowed)
+		return
+	}
+	token := os.Getenv("REPLICA_NOTIFY_TOKEN")
+	if token == "" {
+		http.Error(w, "Replica notifications are disabled", http.StatusNotFound)
+		return
+	}
+	if !notificationAuthorized(r, token) {
+		http.Error(w, "Invalid notification token", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxServerRequestBytes))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		return
+	}
+
+	keys, err := notificationKeys(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	notified := 0
+	for _, key := range keys {
+		notified += notifyReplicas(key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"refreshed": notified})
+}
+
+// notificationAuthorized reports whether a notification carries the token,
+// as a bearer token or, for SNS subscriptions, as the basic auth password
+func notificationAuthorized(r *http.Request, token string) bool {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		_, presented, ok = r.BasicAuth()
+	}
+	return ok && subtle.ConstantTimeCompare([]byte(presented), []byte(token)) == 1
+}
+
+// notificationKeys returns the object keys named in an S3 event notification
+func notificationKeys(body []byte) ([]string, error) {
+	var event s3EventNotification
+	if err := json.Unmarshal(body, &event); err != nil {
+		return nil, fmt.Errorf("invalid event notification: %v", err)
+	}
+	if event.Message != "" {
+		return notificationKeys([]byte(event.Message))
+	}
+
+	var keys []string
+	for _, record := range event.Records {
+		keys = append(keys, decodeEventKey(record.S3.Object.Key))
+	}
+	if event.Detail.Object.Key != "" {
+		keys = append(keys, event.Detail.Object.Key)
+	}
+	return keys, nil
+}
+
+// decodeEventKey undoes the form encoding of keys in S3 event records
+func decodeEventKey(key string) string {
+	decoded, err := url.QueryUnescape(key)
+	if err != nil {
+		return key
+	}
+	return decoded
+}
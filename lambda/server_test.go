@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNotificationKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "S3 event records",
+			body: `{"Records": [{"s3": {"object": {"key": "a.db"}}}, {"s3": {"object": {"key": "dir/my+db%281%29.db"}}}]}`,
+			want: []string{"a.db", "dir/my db(1).db"},
+		},
+		{
+			name: "SNS message wrapping S3 records",
+			body: `{"Type": "Notification", "Message": "{\"Records\": [{\"s3\": {\"object\": {\"key\": \"b.db\"}}}]}"}`,
+			want: []string{"b.db"},
+		},
+		{
+			name: "EventBridge event",
+			body: `{"detail-type": "Object Created", "detail": {"object": {"key": "c.db/manifest.json"}}}`,
+			want: []string{"c.db/manifest.json"},
+		},
+		{
+			name: "no objects",
+			body: `{}`,
+		},
+		{
+			name:    "not JSON",
+			body:    `a.db`,
+			wantErr: true,
+		},
+		{
+			name:    "SNS message that is not JSON",
+			body:    `{"Message": "a.db"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := notificationKeys([]byte(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("notificationKeys error = %v, want error %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("notificationKeys = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServeReplicaNotification(t *testing.T) {
+	const token = "notify-secret"
+	body := `{"Records": []}`
+
+	tests := []struct {
+		name       string
+		token      string
+		method     string
+		authorize  func(r *http.Request)
+		wantStatus int
+	}{
+		{
+			name:       "disabled without a token",
+			method:     http.MethodPost,
+			authorize:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) },
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "GET",
+			token:      token,
+			method:     http.MethodGet,
+			authorize:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) },
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+		{
+			name:       "no credentials",
+			token:      token,
+			method:     http.MethodPost,
+			authorize:  func(r *http.Request) {},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "wrong bearer token",
+			token:      token,
+			method:     http.MethodPost,
+			authorize:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token+"x") },
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "bearer token",
+			token:      token,
+			method:     http.MethodPost,
+			authorize:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+token) },
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "basic auth password",
+			token:      token,
+			method:     http.MethodPost,
+			authorize:  func(r *http.Request) { r.SetBasicAuth("sns", token) },
+			wantStatus: http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("REPLICA_NOTIFY_TOKEN", tt.token)
+			r := httptest.NewRequest(tt.method, "/replicas/notify", strings.NewReader(body))
+			tt.authorize(r)
+			w := httptest.NewRecorder()
+			serveReplicaNotification(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// API operations
+	opSnapshot       = "snapshot"
+	opBranch         = "branch"
+	opListSnapshots  = "list_snapshots"
+	opDeleteSnapshot = "delete_snapshot"
+
+	// Prefix under which snapshots are stored
+	snapshotPrefix = ".snapshots/"
+
+	// Objects copied in parallel
+	copyConcurrency = 16
+)
+
+// SnapshotInfo describes a named, immutable copy of a database
+type SnapshotInfo struct {
+	Name         string    `json:"name"`
+	DatabaseName string    `json:"database_name"`
+	Layout       string    `json:"layout"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// snapshotRoot returns the prefix holding everything for one snapshot
+func snapshotRoot(databaseName, snapshotName string) string {
+	return snapshotPrefix + databaseName + "/" + snapshotName + "/"
+}
+
+// snapshotDatabaseName returns the name under which a snapshot's data is
+// stored; it is an ordinary database in the same layout as its source
+func snapshotDatabaseName(databaseName, snapshotName string) string {
+	return snapshotRoot(databaseName, snapshotName) + "data"
+}
+
+// snapshotInfoKey returns the object key of a snapshot's description
+func snapshotInfoKey(databaseName, snapshotName string) string {
+	return snapshotRoot(databaseName, snapshotName) + "snapshot.json"
+}
+
+// snapshotSource returns the database a snapshot database was taken from
+func snapshotSource(databaseName string) (string, bool) {
+	if !strings.HasPrefix(databaseName, snapshotPrefix) || !strings.HasSuffix(databaseName, "/data") {
+		return "", false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(databaseName, snapshotPrefix), "/data")
+	slash := strings.LastIndex(rest, "/")
+	if slash <= 0 {
+		return "", false
+	}
+	return rest[:slash], true
+}
+
+// isSnapshotDatabase reports whether a database name refers to snapshot data
+func isSnapshotDatabase(databaseName string) bool {
+	return strings.HasPrefix(databaseName, snapshotPrefix)
+}
+
+// validSnapshotName rejects names that would escape the snapshot prefix
+func validSnapshotName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\") && name != "." && name != ".."
+}
+
+// copyObject copies an object, or one version of it, server-side. Objects
+// larger than CopyObject allows are copied in parts.
+func copyObject(srcKey, srcVersionID, dstKey string) error {
+	source := (&url.URL{Path: s3BucketName + "/" + srcKey}).EscapedPath()
+	if srcVersionID != "" {
+		source += "?versionId=" + url.QueryEscape(srcVersionID)
+	}
+
+	head := &s3.HeadObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(srcKey),
+	}
+	if srcVersionID != "" {
+		head.VersionId = aws.String(srcVersionID)
+	}
+	info, err := s3Client.HeadObject(head)
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	if aws.Int64Value(info.ContentLength) > maxCopyObjectSize {
+		stats, err := copyObjectMultipart(source, dstKey, info)
+		if err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+		}
+		logTransfer("Copied", dstKey, stats)
+		return nil
+	}
+
+	_, err = s3Client.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(s3BucketName),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(source),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", srcKey, dstKey, err)
+	}
+	return nil
+}
+
+// databaseExists reports whether a database has been stored, in its layout
+// or as a single object not yet migrated to it
+func databaseExists(databaseName string) (bool, error) {
+	_, found, err := databaseETag(databaseName)
+	return found, err
+}
+
+// copyDatabase copies the current version of src to dst. Databases in the
+// same layout are copied server-side object by object; otherwise the data
+// is downloaded once and stored in dst's layout.
+func copyDatabase(ctx context.Context, src, dst string) error {
+	layout := storageLayout(src)
+	if layout != storageLayout(dst) {
+		return convertDatabase(ctx, src, dst)
+	}
+
+	switch layout {
+	case layoutChunked:
+		manifest, _, err := getManifest(src, "", "")
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			return convertDatabase(ctx, src, dst)
+		}
+
+		unique := make(map[string]bool)
+		var hashes []string
+		for _, hash := range manifest.Chunks {
+			if !unique[hash] {
+				unique[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+		err = forEachConcurrently(len(hashes), copyConcurrency, func(i int) error {
+			return copyObject(chunkKey(src, hashes[i]), "", chunkKey(dst, hashes[i]))
+		})
+		if err != nil {
+			return err
+		}
+		_, err = putManifest(dst, manifest)
+		return err
+
+	case layoutWAL:
+		state, err := getWALState(src, "")
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			return convertDatabase(ctx, src, dst)
+		}
+
+		copied := &WALState{
+			FormatVersion: walFormatVersion,
+			Generation:    state.Generation,
+			Base:          walBaseKey(dst, state.Generation),
+			UpdatedAt:     time.Now().Unix(),
+		}
+		for i := range state.Segments {
+			copied.Segments = append(copied.Segments, walSegmentKey(dst, state.Generation, i+1))
+		}
+
+		sources := append([]string{state.Base}, state.Segments...)
+		targets := append([]string{copied.Base}, copied.Segments...)
+		err = forEachConcurrently(len(sources), copyConcurrency, func(i int) error {
+			return copyObject(sources[i], "", targets[i])
+		})
+		if err != nil {
+			return err
+		}
+		return putWALState(dst, copied)
+
+	default:
+		return copyObject(src, "", dst)
+	}
+}
+
+// convertDatabase copies src to dst through a local working copy
+func convertDatabase(ctx context.Context, src, dst string) error {
+	localPath, err := downloadDatabase(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer removeWorkingCopy(localPath)
+
+	// Checkpoint a WAL working copy so the file holds every page
+	if guard := takeWALGuard(localPath); guard != nil {
+		guard.close()
+	}
+	if storageLayout(dst) == layoutWAL {
+		if err := openWALGuard(localPath, nil); err != nil {
+			return err
+		}
+	}
+	return uploadDatabase(ctx, localPath, dst)
+}
+
+// listSnapshots returns the snapshots of a database
+func listSnapshots(databaseName string) ([]SnapshotInfo, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket:    aws.String(s3BucketName),
+		Prefix:    aws.String(snapshotPrefix + databaseName + "/"),
+		Delimiter: aws.String("/"),
+	}
+
+	var names []string
+	err := s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, prefix := range page.CommonPrefixes {
+			name := strings.TrimSuffix(strings.TrimPrefix(aws.StringValue(prefix.Prefix), aws.StringValue(input.Prefix)), "/")
+			names = append(names, name)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	snapshots := make([]SnapshotInfo, 0, len(names))
+	for _, name := range names {
+		data, err := getObjectBytes(snapshotInfoKey(databaseName, name))
+		if err != nil {
+			// A snapshot still being written or deleted has no description yet
+			continue
+		}
+		var info SnapshotInfo
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("failed to decode snapshot %s: %v", name, err)
+		}
+		snapshots = append(snapshots, info)
+	}
+	return snapshots, nil
+}
+
+// deleteSnapshot removes every object stored for a snapshot
+func deleteSnapshot(databaseName, snapshotName string) (int, error) {
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(s3BucketName),
+		Prefix: aws.String(snapshotRoot(databaseName, snapshotName)),
+	}
+
+	var keys []*s3.ObjectIdentifier
+	err := s3Client.ListObjectsV2Pages(input, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			keys = append(keys, &s3.ObjectIdentifier{Key: object.Key})
+		}
+		return true
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list snapshot objects: %w", err)
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	// Delete the description first so a partly deleted snapshot is not listed
+	if err := deleteObjectKey(snapshotInfoKey(databaseName, snapshotName)); err != nil {
+		return 0, err
+	}
+
+	// DeleteObjects accepts up to 1000 keys per call
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		_, err := s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(s3BucketName),
+			Delete: &s3.Delete{Objects: keys[start:end], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to delete snapshot objects: %w", err)
+		}
+	}
+	return len(keys), nil
+}
+
+// deleteObjectKey deletes a single object
+func deleteObjectKey(key string) error {
+	_, err := s3Client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", key, err)
+	}
+	return nil
+}
+
+// handleSnapshot copies the current version of a database into a named snapshot
+func handleSnapshot(ctx context.Context, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	if !validSnapshotName(apiReq.SnapshotName) {
+		return createErrorResponse(400, "A valid snapshot_name is required"), nil
+	}
+	if isSnapshotDatabase(apiReq.DatabaseName) {
+		return createErrorResponse(400, "Cannot snapshot a snapshot"), nil
+	}
+
+	if exists, err := databaseExists(apiReq.DatabaseName); err != nil {
+		return createFailureResponse("", err), nil
+	} else if !exists {
+		return createErrorResponse(404, fmt.Sprintf("Database %s not found", apiReq.DatabaseName)), nil
+	}
+
+	target := snapshotDatabaseName(apiReq.DatabaseName, apiReq.SnapshotName)
+	if exists, err := databaseExists(target); err != nil {
+		return createFailureResponse("", err), nil
+	} else if exists {
+		return createErrorResponse(409, fmt.Sprintf("Snapshot %s already exists", apiReq.SnapshotName)), nil
+	}
+
+	// Hold a shared lease so the snapshot is a consistent commit
+	instanceID := newInstanceID()
+	if waited, err := waitForDynamoLock(ctx, apiReq.DatabaseName, instanceID, leaseShared, lockWaitPolicy(apiReq)); err != nil {
+		return createLockErrorResponse(err, waited), nil
+	}
+	defer releaseDynamoLease(ctx, apiReq.DatabaseName, instanceID, leaseShared)
+
+	if err := copyDatabase(ctx, apiReq.DatabaseName, target); err != nil {
+		return createFailureResponse("Failed to create snapshot", err), nil
+	}
+
+	info := SnapshotInfo{
+		Name:         apiReq.SnapshotName,
+		DatabaseName: apiReq.DatabaseName,
+		Layout:       storageLayout(apiReq.DatabaseName),
+		CreatedAt:    time.Now().UTC(),
+	}
+	data, _ := json.Marshal(info)
+	if err := putObjectBytes(snapshotInfoKey(apiReq.DatabaseName, apiReq.SnapshotName), data); err != nil {
+		return createFailureResponse("Failed to record snapshot", err), nil
+	}
+
+	slog.InfoContext(ctx, "Created snapshot", "snapshot", apiReq.SnapshotName)
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Data:    info,
+		Message: fmt.Sprintf("Snapshot %s of %s created", apiReq.SnapshotName, apiReq.DatabaseName),
+	}), nil
+}
+
+// handleBranch creates a new writable database from a snapshot
+func handleBranch(ctx context.Context, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	if !validSnapshotName(apiReq.SnapshotName) {
+		return createErrorResponse(400, "A valid snapshot_name is required"), nil
+	}
+	if apiReq.BranchName == "" || isSnapshotDatabase(apiReq.BranchName) {
+		return createErrorResponse(400, "A valid branch_name is required"), nil
+	}
+
+	source := snapshotDatabaseName(apiReq.DatabaseName, apiReq.SnapshotName)
+	if exists, err := databaseExists(source); err != nil {
+		return createFailureResponse("", err), nil
+	} else if !exists {
+		return createErrorResponse(404, fmt.Sprintf("Snapshot %s not found", apiReq.SnapshotName)), nil
+	}
+
+	// Lock the new database so nothing writes to it while it is being created
+	instanceID := newInstanceID()
+	if waited, err := waitForDynamoLock(ctx, apiReq.BranchName, instanceID, leaseExclusive, lockWaitPolicy(apiReq)); err != nil {
+		return createLockErrorResponse(err, waited), nil
+	}
+	defer releaseDynamoLock(ctx, apiReq.BranchName, instanceID)
+	ctx = withLeaseFence(ctx, apiReq.BranchName, instanceID)
+
+	if exists, err := databaseExists(apiReq.BranchName); err != nil {
+		return createFailureResponse("", err), nil
+	} else if exists {
+		return createErrorResponse(409, fmt.Sprintf("Database %s already exists", apiReq.BranchName)), nil
+	}
+
+	if err := copyDatabase(ctx, source, apiReq.BranchName); err != nil {
+		return createFailureResponse("Failed to create branch", err), nil
+	}
+	databaseCache.invalidate(apiReq.BranchName)
+
+	slog.InfoContext(ctx, "Created branch", "branch", apiReq.BranchName, "snapshot", apiReq.SnapshotName)
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Message: fmt.Sprintf("Branch %s created from snapshot %s", apiReq.BranchName, apiReq.SnapshotName),
+	}), nil
+}
+
+// handleListSnapshots returns the snapshots of a database
+func handleListSnapshots(apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	snapshots, err := listSnapshots(apiReq.DatabaseName)
+	if err != nil {
+		return createFailureResponse("Failed to list snapshots", err), nil
+	}
+
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Data:    snapshots,
+		Message: fmt.Sprintf("Database %s has %d snapshots", apiReq.DatabaseName, len(snapshots)),
+	}), nil
+}
+
+// handleDeleteSnapshot deletes a named snapshot
+func handleDeleteSnapshot(apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	if !validSnapshotName(apiReq.SnapshotName) {
+		return createErrorResponse(400, "A valid snapshot_name is required"), nil
+	}
+
+	deleted, err := deleteSnapshot(apiReq.DatabaseName, apiReq.SnapshotName)
+	if err != nil {
+		return createFailureResponse("Failed to delete snapshot", err), nil
+	}
+	if deleted == 0 {
+		return createErrorResponse(404, fmt.Sprintf("Snapshot %s not found", apiReq.SnapshotName)), nil
+	}
+
+	slog.Info("Deleted snapshot", "database", apiReq.DatabaseName, "snapshot", apiReq.SnapshotName, "objects", deleted)
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Message: fmt.Sprintf("Snapshot %s of %s deleted", apiReq.SnapshotName, apiReq.DatabaseName),
+	}), nil
+}
+
+// handleSnapshotQuery runs a SELECT against a snapshot without the lock or an upload
+func handleSnapshotQuery(ctx context.Context, apiReq APIRequest, limits QueryLimits) (events.APIGatewayProxyResponse, error) {
+	localDBPath, err := downloadDatabase(ctx, apiReq.DatabaseName)
+	if err != nil {
+		return createFailureResponse("Failed to download snapshot", err), nil
+	}
+	defer removeWorkingCopy(localDBPath)
+
+	// Read-only, so a write hidden behind a SELECT prefix fails
+	result, err := executeSQL(ctx, readOnlyDSN(localDBPath), apiReq.SQLStatement, limits)
+	if err != nil {
+		return createFailureResponse("SQL execution failed", err), nil
+	}
+	return createSuccessResponse(result), nil
+}
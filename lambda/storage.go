@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// Directory holding a subdirectory per process, which holds one per working copy
+const workingCopyRoot = "/tmp/cloudsqlite-work"
+
+// workingCopyDir holds this process's working copies
+var workingCopyDir = processDir(workingCopyRoot)
+
+const (
+	// Storage layouts for a database in the bucket; layoutEFS keeps it on the
+	// shared filesystem instead
+	layoutFile    = "file"    // the whole database as one object
+	layoutChunked = "chunked" // fixed-size page chunks plus a manifest
+	layoutWAL     = "wal"     // base snapshot plus shipped WAL segments
+)
+
+func init() {
+	// Working copies left by processes that timed out or crashed. Other
+	// live processes sharing /tmp, such as the CLI next to a server, keep theirs.
+	sweepDeadProcessDirs(workingCopyRoot)
+}
+
+// processDir returns this process's subdirectory of a directory shared by
+// several processes
+func processDir(root string) string {
+	return filepath.Join(root, strconv.Itoa(os.Getpid()))
+}
+
+// sweepDeadProcessDirs removes the subdirectories of root that belong to
+// processes that are no longer running. A directory named with this
+// process's PID was left by an earlier process that had the same PID.
+func sweepDeadProcessDirs(root string) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || (pid != os.Getpid() && isProcessRunning(pid)) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(root, entry.Name())); err != nil {
+			slog.Warn("Failed to remove leftover directory", "path", filepath.Join(root, entry.Name()), "error", err)
+		}
+	}
+}
+
+// isProcessRunning reports whether a process with the given PID exists
+func isProcessRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// storageLayout returns the layout used for a database. STORAGE_LAYOUT sets
+// the default and STORAGE_LAYOUT_OVERRIDES ("a.db=chunked,b.db=wal")
+// selects it per database. Snapshots keep the layout of their source.
+func storageLayout(databaseName string) string {
+	if source, ok := snapshotSource(databaseName); ok {
+		databaseName = source
+	}
+	for _, pair := range strings.Split(os.Getenv("STORAGE_LAYOUT_OVERRIDES"), ",") {
+		name, layout, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && name == databaseName {
+			return layout
+		}
+	}
+	if layout := os.Getenv("STORAGE_LAYOUT"); layout != "" {
+		return layout
+	}
+	return layoutFile
+}
+
+// downloadDatabase fetches a new working copy of the database in its
+// configured layout; nothing is left behind if it fails
+func downloadDatabase(ctx context.Context, databaseName string) (localPath string, err error) {
+	layout := storageLayout(databaseName)
+	ctx, span := startSpan(ctx, "storage.download", semconv.DBNamespace(databaseName), attribute.String("cloudsqlite.layout", layout))
+	defer func() {
+		span.SetAttributes(attribute.Int64("cloudsqlite.bytes", fileSize(localPath)))
+		endSpan(span, err)
+	}()
+
+	localPath, err = newWorkingCopyPath(databaseName)
+	if err != nil {
+		return "", err
+	}
+
+	switch layout {
+	case layoutChunked:
+		err = downloadChunked(ctx, databaseName, localPath)
+	case layoutWAL:
+		err = downloadWAL(ctx, databaseName, localPath)
+	default:
+		err = downloadFromS3(ctx, databaseName, localPath)
+	}
+	if err != nil {
+		removeWorkingCopy(localPath)
+		return "", err
+	}
+	return localPath, nil
+}
+
+// uploadDatabase checks the working copy and stores it in the database's configured layout
+func uploadDatabase(ctx context.Context, localPath, databaseName string) (err error) {
+	layout := storageLayout(databaseName)
+	ctx, span := startSpan(ctx, "storage.upload", semconv.DBNamespace(databaseName),
+		attribute.String("cloudsqlite.layout", layout), attribute.Int64("cloudsqlite.bytes", fileSize(localPath)))
+	defer func() { endSpan(span, err) }()
+
+	if err := checkIntegrity(localPath); err != nil {
+		return err
+	}
+	// A writer that lost its lease must not overwrite newer commits
+	if err := fenceLease(ctx, databaseName); err != nil {
+		return err
+	}
+
+	switch layout {
+	case layoutChunked:
+		return uploadChunked(ctx, localPath, databaseName)
+	case layoutWAL:
+		return uploadWAL(ctx, localPath, databaseName)
+	default:
+		return uploadToS3(ctx, localPath, databaseName)
+	}
+}
+
+// newWorkingCopyPath returns a path for a working copy in a directory of its
+// own, so overlapping requests never share a file or its -wal and -journal sidecars
+func newWorkingCopyPath(databaseName string) (string, error) {
+	if err := os.MkdirAll(workingCopyDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create working directory: %v", err)
+	}
+	dir, err := os.MkdirTemp(workingCopyDir, "txn-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create working directory: %v", err)
+	}
+	return filepath.Join(dir, strings.ReplaceAll(databaseName, "/", "_")), nil
+}
+
+// removeWorkingCopy closes and deletes a working copy and its SQLite sidecar files
+func removeWorkingCopy(localPath string) {
+	if guard := takeWALGuard(localPath); guard != nil {
+		guard.close()
+	}
+	if dir := filepath.Dir(localPath); filepath.Dir(dir) == workingCopyDir {
+		os.RemoveAll(dir)
+		return
+	}
+	for _, suffix := range []string{"", "-wal", "-shm", "-journal"} {
+		os.Remove(localPath + suffix)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSweepDeadProcessDirs(t *testing.T) {
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Skipf("cannot run a short-lived process: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		dir  string
+		kept bool
+	}{
+		{name: "live process", dir: strconv.Itoa(os.Getppid()), kept: true},
+		{name: "exited process", dir: strconv.Itoa(exited.Process.Pid), kept: false},
+		{name: "earlier process with our PID", dir: strconv.Itoa(os.Getpid()), kept: false},
+		{name: "not a PID", dir: "shared", kept: true},
+	}
+
+	root := t.TempDir()
+	for _, tt := range tests {
+		if err := os.MkdirAll(filepath.Join(root, tt.dir, "nested"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sweepDeadProcessDirs(root)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := os.Stat(filepath.Join(root, tt.dir))
+			if kept := err == nil; kept != tt.kept {
+				t.Errorf("directory %s kept = %v, want %v", tt.dir, kept, tt.kept)
+			}
+		})
+	}
+}
+
+func TestProcessDir(t *testing.T) {
+	want := filepath.Join("/tmp/work", strconv.Itoa(os.Getpid()))
+	if got := processDir("/tmp/work"); got != want {
+		t.Errorf("processDir = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Service name reported with spans unless OTEL_SERVICE_NAME says otherwise
+const defaultServiceName = "cloudsqlite"
+
+var (
+	// tracer creates CloudSQLite's spans; it does nothing unless an OTLP
+	// endpoint is configured
+	tracer = otel.Tracer("cloudsqlite")
+
+	// tracerProvider exports spans, or is nil when tracing is off
+	tracerProvider *sdktrace.TracerProvider
+)
+
+func init() {
+	// Trace context arrives and leaves in W3C traceparent and baggage headers
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if !tracingEnabled() {
+		return
+	}
+	// The exporter reads the OTEL_EXPORTER_OTLP_* variables; an http://
+	// endpoint such as a local collector's is used without TLS
+	exporter, err := otlptracehttp.New(context.Background())
+	if err != nil {
+		slog.Warn("Tracing disabled: failed to create OTLP exporter", "error", err)
+		return
+	}
+	res, err := resource.New(context.Background(),
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName(defaultServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		slog.Warn("Incomplete tracing resource", "error", err)
+	}
+	tracerProvider = sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tracerProvider)
+}
+
+// tracingEnabled reports whether an OTLP endpoint is configured and the
+// SDK is not disabled
+func tracingEnabled() bool {
+	if os.Getenv("OTEL_SDK_DISABLED") == "true" {
+		return false
+	}
+	return os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// flushTracing exports the spans ended so far; Lambda may freeze the
+// process as soon as a request returns
+func flushTracing(ctx context.Context) {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 2*time.Second)
+	defer cancel()
+	if err := tracerProvider.ForceFlush(ctx); err != nil {
+		slog.Warn("Failed to export spans", "error", err)
+	}
+}
+
+// shutdownTracing exports the remaining spans before the process exits
+func shutdownTracing() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := tracerProvider.Shutdown(ctx); err != nil {
+		slog.Warn("Failed to export spans", "error", err)
+	}
+}
+
+// headerCarrier reads trace context from request headers, whose names may
+// arrive in any case from API Gateway or the HTTP server
+type headerCarrier map[string]string
+
+func (c headerCarrier) Get(key string) string {
+	if value, ok := c[key]; ok {
+		return value
+	}
+	for name, value := range c {
+		if strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for name := range c {
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// startRequestSpan continues the trace named in a request's traceparent
+// header, or starts a new one, with a span for the whole request
+func startRequestSpan(ctx context.Context, headers map[string]string, operation, databaseName string) (context.Context, trace.Span) {
+	ctx = otel.GetTextMapPropagator().Extract(ctx, headerCarrier(headers))
+	return tracer.Start(ctx, "cloudsqlite "+operation,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.DBSystemSqlite,
+			semconv.DBNamespace(databaseName),
+			attribute.String("cloudsqlite.operation", operation),
+		))
+}
+
+// startSpan starts a span for one step of a request
+func startSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan ends a span, marking it failed if err is set
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
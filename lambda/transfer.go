@@ -0,0 +1,444 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Default size of multipart upload parts and ranged download requests
+	defaultTransferPartSize = 16 * 1024 * 1024
+
+	// S3 rejects multipart parts smaller than this, except the last one
+	minTransferPartSize = 5 * 1024 * 1024
+
+	// S3 copies objects up to this size with a single CopyObject request
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+	// Most parts a multipart upload may have
+	maxMultipartParts = 10000
+
+	// Default number of parts transferred in parallel
+	defaultTransferConcurrency = 8
+
+	// Attempts at a part whose transfer failed outside a storage request
+	transferPartAttempts = 3
+)
+
+// TransferStats describes one upload or download
+type TransferStats struct {
+	Bytes    int64
+	Parts    int
+	Retries  int64
+	Duration time.Duration
+}
+
+// throughput returns the transfer rate in MB/s
+func (t TransferStats) throughput() float64 {
+	if t.Duration <= 0 {
+		return 0
+	}
+	return float64(t.Bytes) / (1024 * 1024) / t.Duration.Seconds()
+}
+
+// objectInfo describes a downloaded object
+type objectInfo struct {
+	ETag      string
+	VersionID string
+	Size      int64
+	Metadata  map[string]*string
+}
+
+// transferPartSize returns TRANSFER_PART_SIZE_BYTES or the default part size
+func transferPartSize() int64 {
+	if raw := os.Getenv("TRANSFER_PART_SIZE_BYTES"); raw != "" {
+		if size, err := strconv.ParseInt(raw, 10, 64); err == nil && size >= minTransferPartSize {
+			return size
+		}
+		slog.Warn("Ignoring invalid TRANSFER_PART_SIZE_BYTES", "value", raw, "minimum", minTransferPartSize)
+	}
+	return defaultTransferPartSize
+}
+
+// transferConcurrency returns TRANSFER_CONCURRENCY or the default
+func transferConcurrency() int {
+	if raw := os.Getenv("TRANSFER_CONCURRENCY"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			return n
+		}
+		slog.Warn("Ignoring invalid TRANSFER_CONCURRENCY", "value", raw)
+	}
+	return defaultTransferConcurrency
+}
+
+// retryPart runs one part of a transfer. Failed requests were already
+// retried by the storage retryer, so only failures it cannot see, such as a
+// response body cut off part way, are tried again here, keeping the parts
+// already done rather than starting the whole transfer again.
+func retryPart(retries *int64, fn func() error) error {
+	var err error
+	for attempt := 1; attempt <= transferPartAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) {
+			return err
+		}
+		if attempt < transferPartAttempts {
+			atomic.AddInt64(retries, 1)
+			time.Sleep(storageBackoff(attempt - 1))
+		}
+	}
+	return err
+}
+
+// putObjectFromFile uploads a file with a single PUT, or as a multipart
+// upload of concurrently sent parts when it is larger than one part
+func putObjectFromFile(key string, file *os.File, metadata map[string]*string) (string, TransferStats, error) {
+	started := time.Now()
+	info, err := file.Stat()
+	if err != nil {
+		return "", TransferStats{}, fmt.Errorf("failed to stat local file: %v", err)
+	}
+	size := info.Size()
+	partSize := transferPartSize()
+	uploadID := newUploadID()
+	metadata = mergeMetadata(metadata, map[string]*string{uploadIDMetadataKey: aws.String(uploadID)})
+
+	if size <= partSize {
+		etag, err := putVerified("PutObject", key, uploadID, func() (string, error) {
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				return "", fmt.Errorf("failed to rewind local file: %v", err)
+			}
+			output, err := s3Client.PutObject(&s3.PutObjectInput{
+				Bucket:   aws.String(s3BucketName),
+				Key:      aws.String(key),
+				Body:     file,
+				Metadata: metadata,
+			})
+			if err != nil {
+				return "", err
+			}
+			return aws.StringValue(output.ETag), nil
+		})
+		if err != nil {
+			return "", TransferStats{}, err
+		}
+		return etag, TransferStats{Bytes: size, Parts: 1, Duration: time.Since(started)}, nil
+	}
+
+	created, err := s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(key),
+		Metadata: metadata,
+	})
+	if err != nil {
+		return "", TransferStats{}, fmt.Errorf("failed to start multipart upload: %w", err)
+	}
+	multipartID := created.UploadId
+
+	stats := TransferStats{Bytes: size, Parts: int((size + partSize - 1) / partSize)}
+	parts := make([]*s3.CompletedPart, stats.Parts)
+	err = forEachConcurrently(stats.Parts, transferConcurrency(), func(i int) error {
+		offset := int64(i) * partSize
+		length := partSize
+		if offset+length > size {
+			length = size - offset
+		}
+		return retryPart(&stats.Retries, func() error {
+			output, err := s3Client.UploadPart(&s3.UploadPartInput{
+				Bucket:     aws.String(s3BucketName),
+				Key:        aws.String(key),
+				UploadId:   multipartID,
+				PartNumber: aws.Int64(int64(i + 1)),
+				Body:       io.NewSectionReader(file, offset, length),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to upload part %d: %w", i+1, err)
+			}
+			parts[i] = &s3.CompletedPart{ETag: output.ETag, PartNumber: aws.Int64(int64(i + 1))}
+			return nil
+		})
+	})
+	if err == nil {
+		var etag string
+		if etag, err = completeMultipartUpload(key, uploadID, multipartID, parts); err == nil {
+			stats.Duration = time.Since(started)
+			return etag, stats, nil
+		}
+	}
+	abortMultipartUpload(key, multipartID)
+	return "", stats, err
+}
+
+// copyObjectMultipart copies an object too large for CopyObject as a
+// multipart upload of concurrently copied parts. The source is given as a
+// CopySource value; head is its HeadObject output, whose metadata the copy
+// keeps.
+func copyObjectMultipart(source, key string, head *s3.HeadObjectOutput) (TransferStats, error) {
+	started := time.Now()
+	size := aws.Int64Value(head.ContentLength)
+	partSize := max(transferPartSize(), (size+maxMultipartParts-1)/maxMultipartParts)
+	uploadID := newUploadID()
+
+	created, err := s3Client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(s3BucketName),
+		Key:         aws.String(key),
+		ContentType: head.ContentType,
+		Metadata:    mergeMetadata(head.Metadata, map[string]*string{uploadIDMetadataKey: aws.String(uploadID)}),
+	})
+	if err != nil {
+		return TransferStats{}, fmt.Errorf("failed to start multipart copy: %w", err)
+	}
+	multipartID := created.UploadId
+
+	stats := TransferStats{Bytes: size, Parts: int((size + partSize - 1) / partSize)}
+	parts := make([]*s3.CompletedPart, stats.Parts)
+	err = forEachConcurrently(stats.Parts, transferConcurrency(), func(i int) error {
+		start := int64(i) * partSize
+		end := min(start+partSize, size) - 1
+		return retryPart(&stats.Retries, func() error {
+			output, err := s3Client.UploadPartCopy(&s3.UploadPartCopyInput{
+				Bucket:            aws.String(s3BucketName),
+				Key:               aws.String(key),
+				UploadId:          multipartID,
+				PartNumber:        aws.Int64(int64(i + 1)),
+				CopySource:        aws.String(source),
+				CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+				CopySourceIfMatch: head.ETag,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to copy part %d: %w", i+1, err)
+			}
+			parts[i] = &s3.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: aws.Int64(int64(i + 1))}
+			return nil
+		})
+	})
+	if err == nil {
+		if _, err = completeMultipartUpload(key, uploadID, multipartID, parts); err == nil {
+			stats.Duration = time.Since(started)
+			return stats, nil
+		}
+	}
+	abortMultipartUpload(key, multipartID)
+	return stats, err
+}
+
+// completeMultipartUpload publishes a multipart upload's parts as the
+// object and returns its ETag
+func completeMultipartUpload(key, uploadID string, multipartID *string, parts []*s3.CompletedPart) (string, error) {
+	etag, err := putVerified("CompleteMultipartUpload", key, uploadID, func() (string, error) {
+		output, err := s3Client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(s3BucketName),
+			Key:             aws.String(key),
+			UploadId:        multipartID,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+		if err != nil {
+			return "", err
+		}
+		return aws.StringValue(output.ETag), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to complete multipart upload: %w", err)
+	}
+	return etag, nil
+}
+
+// abortMultipartUpload drops the parts of a multipart upload that was not
+// published
+func abortMultipartUpload(key string, multipartID *string) {
+	if _, err := s3Client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(key),
+		UploadId: multipartID,
+	}); err != nil {
+		slog.Warn("Failed to abort multipart upload", "key", key, "error", err)
+	}
+}
+
+// getObjectToPath downloads an object to a local file. The first part is
+// fetched with the caller's conditions (an If-None-Match error is returned
+// unchanged); the rest is fetched with concurrent ranged GETs pinned to the
+// same version.
+func getObjectToPath(input *s3.GetObjectInput, localPath string) (*objectInfo, TransferStats, error) {
+	started := time.Now()
+	partSize := transferPartSize()
+
+	first := *input
+	first.Range = aws.String(fmt.Sprintf("bytes=0-%d", partSize-1))
+	result, err := s3Client.GetObject(&first)
+	if isInvalidRange(err) {
+		// An empty object has no bytes to range over
+		first.Range = nil
+		result, err = s3Client.GetObject(&first)
+	}
+	if err != nil {
+		return nil, TransferStats{}, err
+	}
+
+	info := &objectInfo{
+		ETag:      aws.StringValue(result.ETag),
+		VersionID: aws.StringValue(result.VersionId),
+		Size:      objectSize(result),
+		Metadata:  result.Metadata,
+	}
+
+	file, err := os.Create(localPath)
+	if err != nil {
+		result.Body.Close()
+		return nil, TransferStats{}, fmt.Errorf("failed to create local file: %v", err)
+	}
+	defer file.Close()
+
+	stats := TransferStats{Bytes: info.Size, Parts: 1}
+
+	// A first part cut short is resumed from where it stopped by the ranged GETs
+	written, err := io.Copy(file, result.Body)
+	result.Body.Close()
+	if err != nil {
+		slog.Warn("Resuming download", "key", aws.StringValue(input.Key), "offset", written, "error", err)
+		stats.Retries++
+	}
+
+	if written < info.Size {
+		remaining := info.Size - written
+		ranges := int((remaining + partSize - 1) / partSize)
+		stats.Parts += ranges
+
+		err = forEachConcurrently(ranges, transferConcurrency(), func(i int) error {
+			start := written + int64(i)*partSize
+			end := start + partSize - 1
+			if end >= info.Size {
+				end = info.Size - 1
+			}
+			return retryPart(&stats.Retries, func() error {
+				return getRange(input, info, start, end, file)
+			})
+		})
+		if err != nil {
+			return nil, stats, err
+		}
+	}
+
+	stats.Duration = time.Since(started)
+	return info, stats, nil
+}
+
+// getRange downloads one byte range of an object version into file
+func getRange(input *s3.GetObjectInput, info *objectInfo, start, end int64, file *os.File) error {
+	ranged := &s3.GetObjectInput{
+		Bucket: input.Bucket,
+		Key:    input.Key,
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	}
+	// Every range must come from the version the first part came from
+	if info.VersionID != "" && info.VersionID != "null" {
+		ranged.VersionId = aws.String(info.VersionID)
+	} else {
+		ranged.IfMatch = aws.String(info.ETag)
+	}
+
+	result, err := s3Client.GetObject(ranged)
+	if err != nil {
+		return fmt.Errorf("failed to get bytes %d-%d: %w", start, end, err)
+	}
+	defer result.Body.Close()
+
+	n, err := io.Copy(io.NewOffsetWriter(file, start), result.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read bytes %d-%d: %v", start, end, err)
+	}
+	if n != end-start+1 {
+		return fmt.Errorf("short read of bytes %d-%d: got %d bytes", start, end, n)
+	}
+	return nil
+}
+
+// objectSize returns an object's full size from a possibly ranged response
+func objectSize(result *s3.GetObjectOutput) int64 {
+	if contentRange := aws.StringValue(result.ContentRange); contentRange != "" {
+		if slash := strings.LastIndex(contentRange, "/"); slash >= 0 {
+			if size, err := strconv.ParseInt(contentRange[slash+1:], 10, 64); err == nil {
+				return size
+			}
+		}
+	}
+	return aws.Int64Value(result.ContentLength)
+}
+
+// isInvalidRange reports whether a ranged GET failed because the object is empty
+func isInvalidRange(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "InvalidRange" {
+		return true
+	}
+	reqErr, ok := err.(awserr.RequestFailure)
+	return ok && reqErr.StatusCode() == 416
+}
+
+// logTransfer reports a transfer's size and throughput
+func logTransfer(direction, key string, stats TransferStats) {
+	slog.Info("Transfer completed", "direction", direction, "key", key, "bytes", stats.Bytes, "parts", stats.Parts,
+		"retries", stats.Retries, "duration_ms", stats.Duration.Milliseconds(), "mb_per_second", stats.throughput())
+}
+
+// downloadObjectFile downloads an object to localPath, decoding it and
+// verifying its checksum. Errors from the first GET, such as a 304 for
+// If-None-Match, are returned unchanged.
+func downloadObjectFile(input *s3.GetObjectInput, localPath string) (*objectInfo, error) {
+	key := aws.StringValue(input.Key)
+	rawPath := localPath + ".download"
+	defer os.Remove(rawPath)
+
+	info, stats, err := getObjectToPath(input, rawPath)
+	if err != nil {
+		if stats.Parts == 0 {
+			return nil, err
+		}
+		return nil, fmt.Errorf("failed to download %s: %w", key, err)
+	}
+	logTransfer("Downloaded", key, stats)
+
+	if err := decodeFile(rawPath, info.Metadata, localPath); err != nil {
+		return nil, err
+	}
+	if err := verifyFileChecksum(key, info.Metadata, localPath); err != nil {
+		os.Remove(localPath)
+		return nil, err
+	}
+	return info, nil
+}
+
+// uploadObjectFile uploads a local file in the configured encodings with
+// its checksum and returns the new ETag
+func uploadObjectFile(key, localPath string) (string, error) {
+	checksum, err := fileChecksum(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	file, encoding, err := openEncoded(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	etag, stats, err := putObjectFromFile(key, file, objectMetadata(encoding, checksum))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s to S3: %w", key, err)
+	}
+	logTransfer("Uploaded", key, stats)
+	return etag, nil
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestCopyObjectMultipart(t *testing.T) {
+	t.Setenv("TRANSFER_PART_SIZE_BYTES", "5242880")
+	data := make([]byte, 2*minTransferPartSize+1000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	tests := []struct {
+		name      string
+		failPart  int
+		wantErr   bool
+		wantParts int
+	}{
+		{name: "copied in parts", wantParts: 3},
+		{name: "part fails", failPart: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeS3(t)
+			fake.failPart = tt.failPart
+			if _, err := s3Client.PutObject(&s3.PutObjectInput{
+				Bucket:   aws.String(s3BucketName),
+				Key:      aws.String("big.db"),
+				Body:     bytes.NewReader(data),
+				Metadata: map[string]*string{"Sha256": aws.String("abc")},
+			}); err != nil {
+				t.Fatal(err)
+			}
+			head, err := s3Client.HeadObject(&s3.HeadObjectInput{Bucket: aws.String(s3BucketName), Key: aws.String("big.db")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			source := (&url.URL{Path: s3BucketName + "/big.db"}).EscapedPath()
+
+			stats, err := copyObjectMultipart(source, "copy.db", head)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("copy succeeded")
+				}
+				if fake.aborted != 1 || len(fake.uploads) != 0 {
+					t.Errorf("%d uploads aborted, %d left open; want the upload aborted", fake.aborted, len(fake.uploads))
+				}
+				if fake.count("/"+s3BucketName+"/copy.db") != 0 {
+					t.Error("failed copy was published")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("copyObjectMultipart: %v", err)
+			}
+			if stats.Parts != tt.wantParts || stats.Bytes != int64(len(data)) {
+				t.Errorf("copied %d bytes in %d parts, want %d in %d", stats.Bytes, stats.Parts, len(data), tt.wantParts)
+			}
+			copied := fake.objects["/"+s3BucketName+"/copy.db"]
+			if !bytes.Equal(copied.data, data) {
+				t.Error("copy differs from the source")
+			}
+			if got := copied.header.Get("X-Amz-Meta-Sha256"); got != "abc" {
+				t.Errorf("copy metadata sha256 = %q, want the source's", got)
+			}
+		})
+	}
+}
+
+func TestPutObjectFromFile(t *testing.T) {
+	t.Setenv("TRANSFER_PART_SIZE_BYTES", "5242880")
+	data := make([]byte, 2*minTransferPartSize+1000)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	tests := []struct {
+		name      string
+		size      int
+		failPart  int
+		wantErr   bool
+		wantParts int
+	}{
+		{name: "single put", size: 1000, wantParts: 1},
+		{name: "exactly one part", size: minTransferPartSize, wantParts: 1},
+		{name: "multipart", size: len(data), wantParts: 3},
+		{name: "part fails", size: len(data), failPart: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := useFakeS3(t)
+			fake.failPart = tt.failPart
+			localPath := filepath.Join(t.TempDir(), "upload.db")
+			if err := os.WriteFile(localPath, data[:tt.size], 0644); err != nil {
+				t.Fatal(err)
+			}
+			file, err := os.Open(localPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer file.Close()
+
+			etag, stats, err := putObjectFromFile("upload.db", file, map[string]*string{"Sha256": aws.String("abc")})
+			stored, ok := fake.objects["/"+s3BucketName+"/upload.db"]
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("upload succeeded")
+				}
+				if fake.aborted != 1 || len(fake.uploads) != 0 {
+					t.Errorf("%d uploads aborted, %d left open; want the upload aborted", fake.aborted, len(fake.uploads))
+				}
+				if ok {
+					t.Error("failed upload was published")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("putObjectFromFile: %v", err)
+			}
+			if stats.Parts != tt.wantParts || stats.Bytes != int64(tt.size) {
+				t.Errorf("uploaded %d bytes in %d parts, want %d in %d", stats.Bytes, stats.Parts, tt.size, tt.wantParts)
+			}
+			if multipart := strings.HasSuffix(strings.Trim(etag, `"`), "-3"); multipart != (tt.wantParts == 3) {
+				t.Errorf("ETag %s does not match an upload of %d parts", etag, tt.wantParts)
+			}
+			if !bytes.Equal(stored.data, data[:tt.size]) {
+				t.Error("stored object differs from the file")
+			}
+			if got := stored.header.Get("X-Amz-Meta-Sha256"); got != "abc" {
+				t.Errorf("stored metadata sha256 = %q, want the caller's", got)
+			}
+			if len(fake.uploads) != 0 {
+				t.Errorf("%d multipart uploads left open", len(fake.uploads))
+			}
+		})
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// API operations
+	opQuery        = "query"
+	opListVersions = "list_versions"
+	opRestore      = "restore"
+)
+
+// DatabaseVersion is one S3 version of a database
+type DatabaseVersion struct {
+	VersionID    string    `json:"version_id"`
+	LastModified time.Time `json:"last_modified"`
+	Size         int64     `json:"size"`
+	IsLatest     bool      `json:"is_latest"`
+}
+
+// rootObjectKey returns the object whose versions are the database's versions:
+// the database file, the chunk manifest or the WAL state
+func rootObjectKey(databaseName string) string {
+	switch storageLayout(databaseName) {
+	case layoutChunked:
+		return manifestKey(databaseName)
+	case layoutWAL:
+		return walStateKey(databaseName)
+	default:
+		return databaseName
+	}
+}
+
+// listDatabaseVersions lists a database's versions, newest first
+func listDatabaseVersions(databaseName string) ([]DatabaseVersion, error) {
+	key := rootObjectKey(databaseName)
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(s3BucketName),
+		Prefix: aws.String(key),
+	}
+
+	var versions []DatabaseVersion
+	err := s3Client.ListObjectVersionsPages(input, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, v := range page.Versions {
+			if aws.StringValue(v.Key) != key {
+				continue
+			}
+			versions = append(versions, DatabaseVersion{
+				VersionID:    aws.StringValue(v.VersionId),
+				LastModified: aws.TimeValue(v.LastModified),
+				Size:         aws.Int64Value(v.Size),
+				IsLatest:     aws.BoolValue(v.IsLatest),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list versions: %w", err)
+	}
+	return versions, nil
+}
+
+// resolveVersion returns the version ID given directly, or the newest
+// version written at or before the as_of timestamp
+func resolveVersion(databaseName, versionID, asOf string) (string, error) {
+	if versionID != "" {
+		return versionID, nil
+	}
+
+	at, err := time.Parse(time.RFC3339, asOf)
+	if err != nil {
+		return "", fmt.Errorf("as_of must be an RFC 3339 timestamp: %v", err)
+	}
+
+	versions, err := listDatabaseVersions(databaseName)
+	if err != nil {
+		return "", err
+	}
+
+	var best *DatabaseVersion
+	for i := range versions {
+		v := &versions[i]
+		if !v.LastModified.After(at) && (best == nil || v.LastModified.After(best.LastModified)) {
+			best = v
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("database %s has no version at or before %s", databaseName, asOf)
+	}
+	return best.VersionID, nil
+}
+
+// downloadVersion materializes an earlier version of a database in a new
+// working copy; nothing is left behind if it fails
+func downloadVersion(databaseName, versionID string) (string, error) {
+	localPath, err := newWorkingCopyPath(databaseName + "." + versionID)
+	if err != nil {
+		return "", err
+	}
+	if err := writeVersion(databaseName, versionID, localPath); err != nil {
+		removeWorkingCopy(localPath)
+		return "", err
+	}
+
+	slog.Debug("Downloaded version", "database", databaseName, "version_id", versionID, "path", localPath)
+	return localPath, nil
+}
+
+// writeVersion writes an earlier version of a database to localPath
+func writeVersion(databaseName, versionID, localPath string) error {
+	switch storageLayout(databaseName) {
+	case layoutChunked:
+		manifest, _, err := getManifest(databaseName, versionID, "")
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			return fmt.Errorf("version %s of %s not found", versionID, databaseName)
+		}
+		_, err = applyManifest(databaseName, manifest, localPath)
+		return err
+
+	case layoutWAL:
+		state, err := getWALState(databaseName, versionID)
+		if err != nil {
+			return err
+		}
+		if state == nil {
+			return fmt.Errorf("version %s of %s not found", versionID, databaseName)
+		}
+		_, err = replayWAL(databaseName, localPath, state, false)
+		return err
+
+	default:
+		_, err := downloadObjectFile(&s3.GetObjectInput{
+			Bucket:    aws.String(s3BucketName),
+			Key:       aws.String(databaseName),
+			VersionId: aws.String(versionID),
+		}, localPath)
+		if err != nil {
+			return fmt.Errorf("failed to get version %s from S3: %w", versionID, err)
+		}
+		return nil
+	}
+}
+
+// restoreVersion makes an earlier version the current one; the caller holds the lock
+func restoreVersion(ctx context.Context, databaseName, versionID string) error {
+	defer databaseCache.invalidate(databaseName)
+	if err := fenceLease(ctx, databaseName); err != nil {
+		return err
+	}
+
+	switch storageLayout(databaseName) {
+	case layoutChunked:
+		// Chunks are immutable, so restoring only republishes the old manifest
+		old, _, err := getManifest(databaseName, versionID, "")
+		if err != nil {
+			return err
+		}
+		current, _, err := getManifest(databaseName, "", "")
+		if err != nil {
+			return err
+		}
+		if old == nil || current == nil {
+			return fmt.Errorf("version %s of %s not found", versionID, databaseName)
+		}
+		old.Generation = current.Generation + 1
+		old.UpdatedAt = time.Now().Unix()
+		_, err = putManifest(databaseName, old)
+		return err
+
+	case layoutWAL:
+		// Bases and segments are immutable too; start a new generation from the old state
+		old, err := getWALState(databaseName, versionID)
+		if err != nil {
+			return err
+		}
+		current, err := getWALState(databaseName, "")
+		if err != nil {
+			return err
+		}
+		if old == nil || current == nil {
+			return fmt.Errorf("version %s of %s not found", versionID, databaseName)
+		}
+		old.Generation = current.Generation + 1
+		old.UpdatedAt = time.Now().Unix()
+		return putWALState(databaseName, old)
+
+	default:
+		return copyObject(databaseName, versionID, databaseName)
+	}
+}
+
+// handleListVersions returns the versions of a database
+func handleListVersions(apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	versions, err := listDatabaseVersions(apiReq.DatabaseName)
+	if err != nil {
+		return createFailureResponse("Failed to list versions", err), nil
+	}
+
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Data:    versions,
+		Message: fmt.Sprintf("Database %s has %d versions", apiReq.DatabaseName, len(versions)),
+	}), nil
+}
+
+// handleHistoricalQuery runs a read-only query against an earlier version
+func handleHistoricalQuery(ctx context.Context, apiReq APIRequest, limits QueryLimits) (events.APIGatewayProxyResponse, error) {
+	if !isSelectStatement(apiReq.SQLStatement) {
+		return createErrorResponse(400, "Only SELECT queries can run against an earlier version"), nil
+	}
+
+	versionID, err := resolveVersion(apiReq.DatabaseName, apiReq.VersionID, apiReq.AsOf)
+	if err != nil {
+		return createErrorResponse(400, fmt.Sprintf("Failed to resolve version: %v", err)), nil
+	}
+
+	localDBPath, err := downloadVersion(apiReq.DatabaseName, versionID)
+	if err != nil {
+		return createFailureResponse("Failed to download version", err), nil
+	}
+	defer removeWorkingCopy(localDBPath)
+
+	// Read-only, so a write hidden behind a SELECT prefix fails
+	result, err := executeSQL(ctx, readOnlyDSN(localDBPath), apiReq.SQLStatement, limits)
+	if err != nil {
+		return createFailureResponse("SQL execution failed", err), nil
+	}
+	result.Message = fmt.Sprintf("%s (version %s)", result.Message, versionID)
+	return createSuccessResponse(result), nil
+}
+
+// handleRestore restores a database to an earlier version under the lock
+func handleRestore(ctx context.Context, apiReq APIRequest) (events.APIGatewayProxyResponse, error) {
+	if apiReq.VersionID == "" && apiReq.AsOf == "" {
+		return createErrorResponse(400, "version_id or as_of is required"), nil
+	}
+
+	versionID, err := resolveVersion(apiReq.DatabaseName, apiReq.VersionID, apiReq.AsOf)
+	if err != nil {
+		return createErrorResponse(400, fmt.Sprintf("Failed to resolve version: %v", err)), nil
+	}
+
+	instanceID := newInstanceID()
+	if waited, err := waitForDynamoLock(ctx, apiReq.DatabaseName, instanceID, leaseExclusive, lockWaitPolicy(apiReq)); err != nil {
+		return createLockErrorResponse(err, waited), nil
+	}
+	defer releaseDynamoLock(ctx, apiReq.DatabaseName, instanceID)
+	ctx = withLeaseFence(ctx, apiReq.DatabaseName, instanceID)
+
+	if err := restoreVersion(ctx, apiReq.DatabaseName, versionID); err != nil {
+		return createFailureResponse("Failed to restore version", err), nil
+	}
+
+	slog.InfoContext(ctx, "Restored database", "version_id", versionID)
+	return createSuccessResponse(&SQLResult{
+		Success: true,
+		Message: fmt.Sprintf("Database %s restored to version %s", apiReq.DatabaseName, versionID),
+	}), nil
+}
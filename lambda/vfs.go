@@ -0,0 +1,423 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/psanford/sqlite3vfs"
+)
+
+const (
+	// Name the S3 VFS is registered under with SQLite
+	s3VFSName = "cloudsqlite-s3"
+
+	// Bytes fetched per range GET; a multiple of every SQLite page size
+	remoteBlockSize = 64 << 10
+
+	// Default size of the shared remote page cache - 64MB
+	defaultRemoteCacheBytes = 64 << 20
+)
+
+// s3VFS is a read-only SQLite VFS that reads databases from S3 block by
+// block, so a query only downloads the pages it touches: database objects
+// with range GETs, and chunked databases a chunk at a time
+type s3VFS struct{}
+
+// s3File is an open database, pinned to the object version or manifest
+// seen at open
+type s3File struct {
+	key       string
+	versionID string
+	etag      string
+	size      int64
+	blockSize int64
+
+	// Set for a chunked database, whose blocks are its chunks
+	manifest *ChunkManifest
+	hash     func([]byte) string
+}
+
+// memFile holds SQLite temp files (sorters, temp tables) in memory
+type memFile struct {
+	mu   sync.Mutex
+	data []byte
+}
+
+// remoteBlockKey identifies one cached block of an object version
+type remoteBlockKey struct {
+	key     string
+	version string
+	index   int64
+}
+
+// remoteBlock is an entry in the remote page cache
+type remoteBlock struct {
+	id      remoteBlockKey
+	data    []byte
+	element *list.Element
+}
+
+// remotePageCache is an LRU of blocks shared by all open s3Files
+type remotePageCache struct {
+	mu        sync.Mutex
+	maxBytes  int64
+	usedBytes int64
+	blocks    map[remoteBlockKey]*remoteBlock
+	lru       *list.List
+}
+
+var remoteCache = &remotePageCache{
+	maxBytes: remoteCacheBytes(),
+	blocks:   make(map[remoteBlockKey]*remoteBlock),
+	lru:      list.New(),
+}
+
+func init() {
+	if err := sqlite3vfs.RegisterVFS(s3VFSName, &s3VFS{}); err != nil {
+		slog.Warn("Failed to register S3 VFS", "error", err)
+	}
+}
+
+// remoteCacheBytes returns REMOTE_CACHE_BYTES or the default cache size
+func remoteCacheBytes() int64 {
+	if raw := os.Getenv("REMOTE_CACHE_BYTES"); raw != "" {
+		if size, err := strconv.ParseInt(raw, 10, 64); err == nil {
+			return size
+		}
+		slog.Warn("Ignoring invalid REMOTE_CACHE_BYTES", "value", raw)
+	}
+	return defaultRemoteCacheBytes
+}
+
+// remoteReadMinBytes returns REMOTE_READ_MIN_BYTES; zero disables automatic remote reads
+func remoteReadMinBytes() int64 {
+	size, _ := strconv.ParseInt(os.Getenv("REMOTE_READ_MIN_BYTES"), 10, 64)
+	return size
+}
+
+// useRemoteRead decides whether a SELECT should read the database in place
+// through the S3 VFS instead of downloading it
+func useRemoteRead(apiReq APIRequest) bool {
+	if !isSelectStatement(apiReq.SQLStatement) {
+		return false
+	}
+	layout := storageLayout(apiReq.DatabaseName)
+	switch {
+	case layout == layoutChunked:
+		// Chunks are decoded one at a time, whatever their encoding
+	case layout != layoutFile || len(objectEncodings()) > 0:
+		// Range reads need the object stored as a plain database file
+		return false
+	}
+	if apiReq.RemoteRead {
+		return true
+	}
+
+	minBytes := remoteReadMinBytes()
+	if minBytes <= 0 {
+		return false
+	}
+	if layout == layoutChunked {
+		manifest, _, err := getManifest(apiReq.DatabaseName, "", "")
+		return err == nil && manifest != nil && manifest.Size >= minBytes
+	}
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(apiReq.DatabaseName),
+	})
+	if err != nil {
+		return false
+	}
+	return aws.Int64Value(head.ContentLength) >= minBytes
+}
+
+// executeRemoteSQL runs a read-only query against the database object in S3.
+// Reads are pinned to one object version, so no lock is needed.
+func executeRemoteSQL(ctx context.Context, databaseName, sqlStatement string, limits QueryLimits) (*SQLResult, error) {
+	dsn := fmt.Sprintf("file:%s?vfs=%s&mode=ro&immutable=1", url.PathEscape(databaseName), s3VFSName)
+	return executeSQL(ctx, dsn, sqlStatement, limits)
+}
+
+// Open opens the main database from S3; other files are temp files
+func (v *s3VFS) Open(name string, flags sqlite3vfs.OpenFlag) (sqlite3vfs.File, sqlite3vfs.OpenFlag, error) {
+	if flags&sqlite3vfs.OpenMainDB == 0 {
+		return &memFile{}, flags, nil
+	}
+
+	if storageLayout(name) == layoutChunked {
+		file, err := openChunkedFile(name)
+		if err != nil {
+			slog.Error("Remote open failed", "database", name, "error", err)
+			return nil, 0, sqlite3vfs.CantOpenError
+		}
+		// A database not yet migrated is still a single object
+		if file != nil {
+			return file, sqlite3vfs.OpenReadOnly, nil
+		}
+	}
+
+	head, err := s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(name),
+	})
+	if err != nil {
+		slog.Error("Remote open failed", "database", name, "error", err)
+		return nil, 0, sqlite3vfs.CantOpenError
+	}
+	if encoding := metadataValue(head.Metadata, encodingMetadataKey); encoding != "" {
+		slog.Error("Remote open failed: object is encoded", "database", name, "encoding", encoding)
+		return nil, 0, sqlite3vfs.CantOpenError
+	}
+
+	file := &s3File{
+		key:       name,
+		versionID: aws.StringValue(head.VersionId),
+		etag:      aws.StringValue(head.ETag),
+		size:      aws.Int64Value(head.ContentLength),
+		blockSize: remoteBlockSize,
+	}
+	return file, sqlite3vfs.OpenReadOnly, nil
+}
+
+// openChunkedFile opens a chunked database at its current manifest, or
+// returns nil if it has no manifest yet
+func openChunkedFile(name string) (*s3File, error) {
+	manifest, etag, err := getManifest(name, "", "")
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+	hash, err := chunkHasher(manifest.AddressKeyID)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{
+		key:       name,
+		etag:      etag,
+		size:      manifest.Size,
+		blockSize: manifest.ChunkSize,
+		manifest:  manifest,
+		hash:      hash,
+	}, nil
+}
+
+// Delete is only called for journals, which a read-only database never has
+func (v *s3VFS) Delete(name string, dirSync bool) error {
+	return nil
+}
+
+// Access reports that no journal or WAL files exist next to the database
+func (v *s3VFS) Access(name string, flags sqlite3vfs.AccessFlag) (bool, error) {
+	return false, nil
+}
+
+// FullPathname returns the object key unchanged
+func (v *s3VFS) FullPathname(name string) string {
+	return name
+}
+
+// ReadAt reads from the cached blocks covering the requested range
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off+int64(n) < f.size {
+		pos := off + int64(n)
+		block, err := f.block(pos / f.blockSize)
+		if err == nil && pos%f.blockSize >= int64(len(block)) {
+			err = fmt.Errorf("block %d is %d bytes, too short for the file size", pos/f.blockSize, len(block))
+		}
+		if err != nil {
+			slog.Error("Remote read failed", "key", f.key, "offset", pos, "error", err)
+			return n, sqlite3vfs.IOError
+		}
+		n += copy(p[n:], block[pos%f.blockSize:])
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns one block of the pinned object version or manifest,
+// fetching it on a miss
+func (f *s3File) block(index int64) ([]byte, error) {
+	if f.manifest != nil {
+		return f.chunk(index)
+	}
+
+	id := remoteBlockKey{key: f.key, version: f.versionID + f.etag, index: index}
+	if data, ok := remoteCache.get(id); ok {
+		return data, nil
+	}
+
+	start := index * remoteBlockSize
+	end := start + remoteBlockSize - 1
+	if end >= f.size {
+		end = f.size - 1
+	}
+
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(f.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", start, end)),
+	}
+	if f.versionID != "" {
+		input.VersionId = aws.String(f.versionID)
+	} else {
+		input.IfMatch = aws.String(f.etag)
+	}
+
+	result, err := s3Client.GetObject(input)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("short range read: got %d of %d bytes", len(data), end-start+1)
+	}
+
+	remoteCache.put(id, data)
+	return data, nil
+}
+
+// chunk returns one chunk of a chunked database. Chunks are cached by
+// address, since their contents never change.
+func (f *s3File) chunk(index int64) ([]byte, error) {
+	if index >= int64(len(f.manifest.Chunks)) {
+		return nil, fmt.Errorf("chunk %d is past the end of the manifest", index)
+	}
+	address := f.manifest.Chunks[index]
+	id := remoteBlockKey{key: chunkKey(f.key, address)}
+	if data, ok := remoteCache.get(id); ok {
+		return data, nil
+	}
+
+	data, err := getChunk(f.key, address, f.hash)
+	if err != nil {
+		return nil, err
+	}
+	remoteCache.put(id, data)
+	return data, nil
+}
+
+func (f *s3File) Close() error { return nil }
+
+func (f *s3File) WriteAt(p []byte, off int64) (int, error) { return 0, sqlite3vfs.ReadOnlyError }
+
+func (f *s3File) Truncate(size int64) error { return sqlite3vfs.ReadOnlyError }
+
+func (f *s3File) Sync(flag sqlite3vfs.SyncType) error { return nil }
+
+func (f *s3File) FileSize() (int64, error) { return f.size, nil }
+
+func (f *s3File) Lock(elock sqlite3vfs.LockType) error { return nil }
+
+func (f *s3File) Unlock(elock sqlite3vfs.LockType) error { return nil }
+
+func (f *s3File) CheckReservedLock() (bool, error) { return false, nil }
+
+func (f *s3File) SectorSize() int64 { return 0 }
+
+func (f *s3File) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic {
+	return sqlite3vfs.IocapImmutable
+}
+
+func (m *memFile) Close() error { return nil }
+
+func (m *memFile) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memFile) WriteAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if end := off + int64(len(p)); end > int64(len(m.data)) {
+		m.data = append(m.data, make([]byte, end-int64(len(m.data)))...)
+	}
+	return copy(m.data[off:], p), nil
+}
+
+func (m *memFile) Truncate(size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if size < int64(len(m.data)) {
+		m.data = m.data[:size]
+	}
+	return nil
+}
+
+func (m *memFile) Sync(flag sqlite3vfs.SyncType) error { return nil }
+
+func (m *memFile) FileSize() (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return int64(len(m.data)), nil
+}
+
+func (m *memFile) Lock(elock sqlite3vfs.LockType) error { return nil }
+
+func (m *memFile) Unlock(elock sqlite3vfs.LockType) error { return nil }
+
+func (m *memFile) CheckReservedLock() (bool, error) { return false, nil }
+
+func (m *memFile) SectorSize() int64 { return 0 }
+
+func (m *memFile) DeviceCharacteristics() sqlite3vfs.DeviceCharacteristic { return 0 }
+
+// get returns a cached block and marks it recently used
+func (c *remotePageCache) get(id remoteBlockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	block, ok := c.blocks[id]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(block.element)
+	return block.data, true
+}
+
+// put adds a block, evicting the least recently used blocks over the budget
+func (c *remotePageCache) put(id remoteBlockKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.blocks[id]; ok || int64(len(data)) > c.maxBytes {
+		return
+	}
+	block := &remoteBlock{id: id, data: data}
+	block.element = c.lru.PushFront(block)
+	c.blocks[id] = block
+	c.usedBytes += int64(len(data))
+
+	for c.usedBytes > c.maxBytes {
+		oldest := c.lru.Back().Value.(*remoteBlock)
+		c.lru.Remove(oldest.element)
+		delete(c.blocks, oldest.id)
+		c.usedBytes -= int64(len(oldest.data))
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/psanford/sqlite3vfs"
+)
+
+func TestRemotePageCacheLRU(t *testing.T) {
+	cache := &remotePageCache{maxBytes: 30, blocks: make(map[remoteBlockKey]*remoteBlock), lru: list.New()}
+	block := func(index int64) remoteBlockKey { return remoteBlockKey{key: "lru.db", version: "v1", index: index} }
+
+	cache.put(block(0), make([]byte, 10))
+	cache.put(block(1), make([]byte, 10))
+	cache.put(block(2), make([]byte, 10))
+	cache.get(block(0)) // block 1 is now the least recently used
+	cache.put(block(3), make([]byte, 10))
+	cache.put(block(4), make([]byte, 31)) // larger than the whole cache
+
+	for index, want := range []bool{true, false, true, true, false} {
+		if _, ok := cache.get(block(int64(index))); ok != want {
+			t.Errorf("block %d cached = %v, want %v", index, ok, want)
+		}
+	}
+	if cache.usedBytes != 30 || cache.lru.Len() != 3 {
+		t.Errorf("cache holds %d blocks of %d bytes, want 3 of 30", cache.lru.Len(), cache.usedBytes)
+	}
+}
+
+func TestRemoteReadRanges(t *testing.T) {
+	fake := useFakeS3(t)
+	databaseName := fmt.Sprintf("ranges-%s.db", filepath.Base(t.TempDir()))
+	data := make([]byte, 2*remoteBlockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	if _, err := s3Client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(databaseName),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	opened, _, err := (&s3VFS{}).Open(databaseName, sqlite3vfs.OpenMainDB)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	file := opened.(*s3File)
+	if size, _ := file.FileSize(); size != int64(len(data)) {
+		t.Fatalf("FileSize = %d, want %d", size, len(data))
+	}
+
+	// gets returns how many range GETs have been made for the database
+	gets := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.gets["/"+s3BucketName+"/"+databaseName]
+	}
+
+	tests := []struct {
+		name    string
+		offset  int64
+		length  int
+		wantN   int
+		wantEOF bool
+		gets    int // total range GETs after the read
+	}{
+		{name: "inside a block", offset: 100, length: 50, wantN: 50, gets: 1},
+		{name: "across a block boundary", offset: remoteBlockSize - 10, length: 20, wantN: 20, gets: 2},
+		{name: "cached block", offset: 0, length: 10, wantN: 10, gets: 2},
+		{name: "past the end", offset: 2*remoteBlockSize + 90, length: 20, wantN: 10, wantEOF: true, gets: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := make([]byte, tt.length)
+			n, err := file.ReadAt(p, tt.offset)
+			if n != tt.wantN || (err == io.EOF) != tt.wantEOF || (err != nil && err != io.EOF) {
+				t.Fatalf("ReadAt = %d, %v; want %d bytes, EOF %v", n, err, tt.wantN, tt.wantEOF)
+			}
+			if !bytes.Equal(p[:n], data[tt.offset:tt.offset+int64(n)]) {
+				t.Error("read bytes differ from the object")
+			}
+			if got := gets(); got != tt.gets {
+				t.Errorf("%d range GETs, want %d", got, tt.gets)
+			}
+		})
+	}
+}
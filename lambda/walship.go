@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	// SQLite driver with CloudSQLite's connection settings
+	sqliteDriverName = "sqlite3_cloudsqlite"
+
+	// WAL state format written by this version
+	walFormatVersion = 1
+
+	// A WAL file holding only its header has no frames
+	walHeaderSize = 32
+
+	// Segments shipped before they are folded into a new base snapshot
+	defaultWALCompactSegments = 16
+
+	// Unreferenced bases and segments younger than this are kept, since a
+	// reader may still be replaying the state that used them
+	walGCGrace = time.Hour
+)
+
+// WALState lists the base snapshot and the WAL segments, in commit order,
+// that together make up the current database
+type WALState struct {
+	FormatVersion int      `json:"format_version"`
+	Generation    int64    `json:"generation"`
+	Base          string   `json:"base"`
+	Segments      []string `json:"segments"`
+	UpdatedAt     int64    `json:"updated_at"`
+}
+
+// walGuard holds a working copy open so the WAL written by executeSQL
+// is not checkpointed away before it is shipped
+type walGuard struct {
+	db    *sql.DB
+	conn  *sql.Conn
+	state *WALState
+}
+
+var (
+	walGuardsMu sync.Mutex
+	walGuards   = make(map[string]*walGuard)
+)
+
+func init() {
+	// Checkpoints only happen when a guard closes, so the WAL always holds
+	// every frame written since the working copy was opened
+	sql.Register(sqliteDriverName, &sqlite3.SQLiteDriver{
+		ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+			_, err := conn.Exec("PRAGMA wal_autocheckpoint = 0", nil)
+			return err
+		},
+	})
+}
+
+// walStateKey returns the object key of a database's WAL state
+func walStateKey(databaseName string) string {
+	return databaseName + "/wal/state.json"
+}
+
+// walBaseKey returns the object key of a generation's base snapshot
+func walBaseKey(databaseName string, generation int64) string {
+	return fmt.Sprintf("%s/wal/base-%08d.db", databaseName, generation)
+}
+
+// walSegmentKey returns the object key of a numbered WAL segment
+func walSegmentKey(databaseName string, generation int64, sequence int) string {
+	return fmt.Sprintf("%s/wal/%08d-%08d.wal", databaseName, generation, sequence)
+}
+
+// walCacheTag identifies how far a cached working copy has been replayed
+func walCacheTag(state *WALState) string {
+	return fmt.Sprintf("wal:%d:%d", state.Generation, len(state.Segments))
+}
+
+// walCompactSegments returns WAL_COMPACT_SEGMENTS or the default
+func walCompactSegments() int {
+	if raw := os.Getenv("WAL_COMPACT_SEGMENTS"); raw != "" {
+		if n, err := strconv.Atoi(raw); err == nil && n > 0 {
+			return n
+		}
+		slog.Warn("Ignoring invalid WAL_COMPACT_SEGMENTS", "value", raw)
+	}
+	return defaultWALCompactSegments
+}
+
+// getWALState fetches a database's WAL state, or an earlier version of it,
+// or nil if it has none yet
+func getWALState(databaseName, versionID string) (*WALState, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(walStateKey(databaseName)),
+	}
+	if versionID != "" {
+		input.VersionId = aws.String(versionID)
+	}
+
+	result, err := s3Client.GetObject(input)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get WAL state from S3: %w", err)
+	}
+	defer result.Body.Close()
+
+	var state WALState
+	if err := json.NewDecoder(result.Body).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode WAL state: %v", err)
+	}
+	if state.FormatVersion > walFormatVersion {
+		return nil, fmt.Errorf("WAL state format %d is newer than supported format %d",
+			state.FormatVersion, walFormatVersion)
+	}
+	return &state, nil
+}
+
+// putWALState replaces a database's WAL state, publishing a commit
+func putWALState(databaseName string, state *WALState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal WAL state: %v", err)
+	}
+
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s3BucketName),
+		Key:         aws.String(walStateKey(databaseName)),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload WAL state to S3: %w", err)
+	}
+	return nil
+}
+
+// downloadWAL reconstructs the database at localPath from its base snapshot
+// and segments and opens it in WAL mode, ready for executeSQL
+func downloadWAL(ctx context.Context, databaseName, localPath string) error {
+	state, err := getWALState(databaseName, "")
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		// Not migrated yet; the first commit uploads a base snapshot
+		if err := downloadFromS3(ctx, databaseName, localPath); err != nil {
+			return err
+		}
+	} else if err := restoreWAL(databaseName, localPath, state); err != nil {
+		return err
+	}
+
+	return openWALGuard(localPath, state)
+}
+
+// restoreWAL writes the state's database to localPath, replaying only the
+// segments the cached copy has not seen yet
+func restoreWAL(databaseName, localPath string, state *WALState) error {
+	start, err := replayWAL(databaseName, localPath, state, true)
+	if err != nil {
+		return err
+	}
+
+	if err := databaseCache.storeFile(databaseName, walCacheTag(state), localPath); err != nil {
+		slog.Warn("Failed to cache database", "database", databaseName, "error", err)
+	}
+
+	slog.Debug("Restored WAL database", "database", databaseName, "generation", state.Generation,
+		"segments_replayed", len(state.Segments)-start, "segments", len(state.Segments))
+	return nil
+}
+
+// replayWAL writes the base snapshot, or the cached copy when useCache is set
+// and it belongs to the same generation, and applies the remaining segments.
+// It returns the number of segments that were already in the starting copy.
+func replayWAL(databaseName, localPath string, state *WALState, useCache bool) (int, error) {
+	start := -1
+	cached, tag := databaseCache.open(databaseName)
+	if cached != nil && !useCache {
+		cached.Close()
+		cached = nil
+	}
+	if cached != nil {
+		defer cached.Close()
+
+		var generation int64
+		var applied int
+		if _, err := fmt.Sscanf(tag, "wal:%d:%d", &generation, &applied); err == nil &&
+			generation == state.Generation && applied <= len(state.Segments) {
+			if err := writeLocalFile(localPath, cached); err != nil {
+				return 0, err
+			}
+			start = applied
+		}
+	}
+
+	if start < 0 {
+		if err := getObjectToFile(state.Base, localPath); err != nil {
+			return 0, err
+		}
+		start = 0
+	}
+
+	for _, key := range state.Segments[start:] {
+		segment, err := getObjectBytes(key)
+		if err != nil {
+			return 0, err
+		}
+		if err := applyWALSegment(localPath, segment); err != nil {
+			return 0, fmt.Errorf("failed to apply segment %s: %v", key, err)
+		}
+	}
+	return start, nil
+}
+
+// applyWALSegment checkpoints one shipped WAL file into the local database
+func applyWALSegment(localPath string, segment []byte) error {
+	if err := os.WriteFile(localPath+"-wal", segment, 0644); err != nil {
+		return err
+	}
+
+	release, _ := enterHeapLimit(context.Background(), QueryLimits{})
+	defer release()
+
+	db, err := sql.Open(sqliteDriverName, localPath)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var busy, logFrames, checkpointed int
+	if err := db.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)").Scan(&busy, &logFrames, &checkpointed); err != nil {
+		return err
+	}
+	if busy != 0 || checkpointed != logFrames {
+		return fmt.Errorf("checkpoint incomplete (%d of %d frames)", checkpointed, logFrames)
+	}
+	return nil
+}
+
+// openWALGuard switches the working copy to WAL mode and keeps it open
+// until the commit is shipped or the working copy is removed
+func openWALGuard(localPath string, state *WALState) error {
+	db, err := sql.Open(sqliteDriverName, localPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		db.Close()
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+
+	var mode string
+	if err := conn.QueryRowContext(context.Background(), "PRAGMA journal_mode = WAL").Scan(&mode); err != nil || mode != "wal" {
+		conn.Close()
+		db.Close()
+		return fmt.Errorf("failed to enable WAL mode (mode %q): %v", mode, err)
+	}
+
+	walGuardsMu.Lock()
+	walGuards[localPath] = &walGuard{db: db, conn: conn, state: state}
+	walGuardsMu.Unlock()
+	return nil
+}
+
+// takeWALGuard removes and returns the guard for a working copy, if any
+func takeWALGuard(localPath string) *walGuard {
+	walGuardsMu.Lock()
+	defer walGuardsMu.Unlock()
+
+	guard := walGuards[localPath]
+	delete(walGuards, localPath)
+	return guard
+}
+
+// close releases the last connection, which checkpoints the WAL into the file
+func (g *walGuard) close() {
+	if g.conn != nil {
+		g.conn.Close()
+		g.conn = nil
+	}
+	if g.db != nil {
+		g.db.Close()
+		g.db = nil
+	}
+}
+
+// uploadWAL ships the frames written by this request as a new segment and
+// folds the segments into a new base snapshot when there are enough of them
+func uploadWAL(ctx context.Context, localPath, databaseName string) error {
+	guard := takeWALGuard(localPath)
+	if guard == nil {
+		return fmt.Errorf("no WAL session for %s", localPath)
+	}
+	defer guard.close()
+
+	segment, err := os.ReadFile(localPath + "-wal")
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read WAL: %v", err)
+	}
+
+	state := guard.state
+	if state == nil {
+		// First commit in this layout: the whole file becomes generation 1
+		guard.close()
+		return uploadWALBase(ctx, localPath, databaseName, 1)
+	}
+
+	if len(segment) <= walHeaderSize {
+		slog.Debug("No changes to ship", "database", databaseName)
+		return nil
+	}
+
+	key := walSegmentKey(databaseName, state.Generation, len(state.Segments)+1)
+	if err := putObjectBytes(key, segment); err != nil {
+		return err
+	}
+
+	if len(state.Segments)+1 >= walCompactSegments() {
+		guard.close()
+		return uploadWALBase(ctx, localPath, databaseName, state.Generation+1)
+	}
+
+	next := &WALState{
+		FormatVersion: walFormatVersion,
+		Generation:    state.Generation,
+		Base:          state.Base,
+		Segments:      append(append([]string(nil), state.Segments...), key),
+		UpdatedAt:     time.Now().Unix(),
+	}
+	// The segment upload can outlast the lease; confirm it before publishing
+	if err := fenceLease(ctx, databaseName); err != nil {
+		return err
+	}
+	if err := putWALState(databaseName, next); err != nil {
+		databaseCache.invalidate(databaseName)
+		return err
+	}
+
+	guard.close()
+	if err := databaseCache.storeFile(databaseName, walCacheTag(next), localPath); err != nil {
+		slog.Warn("Failed to cache uploaded database", "database", databaseName, "error", err)
+		databaseCache.invalidate(databaseName)
+	}
+
+	slog.Debug("Shipped WAL segment", "database", databaseName, "segment", len(next.Segments), "bytes", len(segment))
+	return nil
+}
+
+// uploadWALBase uploads the checkpointed working copy as a new generation's
+// base snapshot and starts an empty segment list
+func uploadWALBase(ctx context.Context, localPath, databaseName string, generation int64) error {
+	key := walBaseKey(databaseName, generation)
+	if err := putObjectFile(key, localPath); err != nil {
+		return err
+	}
+
+	next := &WALState{
+		FormatVersion: walFormatVersion,
+		Generation:    generation,
+		Base:          key,
+		UpdatedAt:     time.Now().Unix(),
+	}
+	if err := fenceLease(ctx, databaseName); err != nil {
+		return err
+	}
+	if err := putWALState(databaseName, next); err != nil {
+		databaseCache.invalidate(databaseName)
+		return err
+	}
+
+	if err := databaseCache.storeFile(databaseName, walCacheTag(next), localPath); err != nil {
+		slog.Warn("Failed to cache uploaded database", "database", databaseName, "error", err)
+		databaseCache.invalidate(databaseName)
+	}
+
+	slog.Info("Compacted WAL database into a new base snapshot", "database", databaseName, "generation", generation)
+
+	if generation > 1 {
+		deleted, err := collectWALObjects(databaseName, next)
+		if err != nil {
+			slog.Warn("Failed to collect old WAL generations", "database", databaseName, "error", err)
+		} else if deleted > 0 {
+			slog.Info("Collected old WAL generations", "database", databaseName, "deleted", deleted)
+		}
+	}
+	return nil
+}
+
+// collectWALObjects deletes the bases and segments of a database that
+// neither the given state nor any retained state version refers to, and
+// returns how many it deleted. Like collectChunks it runs under the
+// writer's lease and deletes every version of each object.
+func collectWALObjects(databaseName string, current *WALState) (int, error) {
+	referenced := map[string]bool{walStateKey(databaseName): true}
+	mark := func(state *WALState) {
+		referenced[state.Base] = true
+		for _, key := range state.Segments {
+			referenced[key] = true
+		}
+	}
+	mark(current)
+
+	// Earlier state versions can still be read or restored
+	versions, err := listDatabaseVersions(databaseName)
+	if err != nil {
+		return 0, err
+	}
+	for _, v := range versions {
+		if v.IsLatest {
+			continue
+		}
+		state, err := getWALState(databaseName, v.VersionID)
+		if err != nil {
+			return 0, err
+		}
+		if state != nil {
+			mark(state)
+		}
+	}
+
+	return deleteUnreferencedObjects(databaseName+"/wal/", func(key string) bool {
+		return referenced[key]
+	}, walGCGrace)
+}
+
+// getObjectBytes downloads a small object into memory
+func getObjectBytes(key string) ([]byte, error) {
+	result, err := s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s from S3: %w", key, err)
+	}
+	defer result.Body.Close()
+
+	data, err := io.ReadAll(result.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", key, err)
+	}
+	if data, err = decodeBytes(data, result.Metadata); err != nil {
+		return nil, err
+	}
+	if err := verifyChecksum(key, result.Metadata, bytesChecksum(data)); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// getObjectToFile downloads an object to a local file
+func getObjectToFile(key, localPath string) error {
+	_, err := downloadObjectFile(&s3.GetObjectInput{
+		Bucket: aws.String(s3BucketName),
+		Key:    aws.String(key),
+	}, localPath)
+	return err
+}
+
+// putObjectFile uploads a local file
+func putObjectFile(key, localPath string) error {
+	_, err := uploadObjectFile(key, localPath)
+	return err
+}
+
+// putObjectBytes uploads an in-memory object
+func putObjectBytes(key string, data []byte) error {
+	encoded, encoding, err := encodeBytes(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = s3Client.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String(s3BucketName),
+		Key:      aws.String(key),
+		Body:     bytes.NewReader(encoded),
+		Metadata: objectMetadata(encoding, bytesChecksum(data)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to S3: %w", key, err)
+	}
+	return nil
+}
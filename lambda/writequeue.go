@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// DynamoDB table holding queued writes, keyed by database and request
+	writeQueueTableName = "CloudSQLite-WriteQueue"
+
+	// Default time a write waits for others to join its batch
+	defaultWriteBatchWindow = 20 * time.Millisecond
+
+	// Default time a write waits for a lock holder to apply it
+	defaultWriteQueueWait = 30 * time.Second
+
+	// Most writes applied in one download-execute-upload cycle
+	maxWriteBatchSize = 100
+
+	// Interval between checks on a queued write
+	writeQueuePollInterval = 50 * time.Millisecond
+
+	// Queued writes are removed by the table's TTL if nobody collects them
+	writeQueueItemTTL = time.Hour
+
+	// Queued write states
+	writePending = "pending"
+	writeClaimed = "claimed"
+	writeDone    = "done"
+)
+
+// QueuedWrite is a write request waiting in the queue, and its result once applied
+type QueuedWrite struct {
+	DatabaseName string `dynamodbav:"database_name"`
+	RequestID    string `dynamodbav:"request_id"`
+	SQLStatement string `dynamodbav:"sql_statement"`
+	TimeoutMs    int64  `dynamodbav:"timeout_ms"`
+	MaxHeapBytes int64  `dynamodbav:"max_heap_bytes"`
+	Status       string `dynamodbav:"status"`
+	LeaderID     string `dynamodbav:"leader_id,omitempty"`
+	StatusCode   int    `dynamodbav:"status_code,omitempty"`
+	ResponseBody string `dynamodbav:"response_body,omitempty"`
+	ExpiresAt    int64  `dynamodbav:"expires_at"`
+}
+
+// writeQueueEnabled reports whether writes go through the queue (WRITE_QUEUE=on)
+func writeQueueEnabled() bool {
+	return os.Getenv("WRITE_QUEUE") == "on"
+}
+
+// writeBatchWindow returns WRITE_BATCH_WINDOW_MS or the default window
+func writeBatchWindow() time.Duration {
+	return envMilliseconds("WRITE_BATCH_WINDOW_MS", defaultWriteBatchWindow)
+}
+
+// writeQueueWait returns WRITE_QUEUE_WAIT_MS or the default wait
+func writeQueueWait() time.Duration {
+	return envMilliseconds("WRITE_QUEUE_WAIT_MS", defaultWriteQueueWait)
+}
+
+// envMilliseconds reads a duration in milliseconds from the environment
+func envMilliseconds(name string, fallback time.Duration) time.Duration {
+	if raw := os.Getenv(name); raw != "" {
+		if ms, err := strconv.ParseInt(raw, 10, 64); err == nil && ms >= 0 {
+			return time.Duration(ms) * time.Millisecond
+		}
+		slog.Warn("Ignoring invalid "+name, "value", raw)
+	}
+	return fallback
+}
+
+// newQueuedRequestID returns a request ID that sorts in arrival order
+func newQueuedRequestID() string {
+	return fmt.Sprintf("%020d-%08x", time.Now().UnixNano(), rand.Uint32())
+}
+
+// handleQueuedWrite queues a write and waits for it to be applied. Whichever
+// waiting request takes the lock applies every queued write for the database
+// in one download-execute-upload cycle, and each caller gets its own result.
+func handleQueuedWrite(ctx context.Context, apiReq APIRequest, limits QueryLimits) (events.APIGatewayProxyResponse, error) {
+	write := QueuedWrite{
+		DatabaseName: apiReq.DatabaseName,
+		RequestID:    newQueuedRequestID(),
+		SQLStatement: apiReq.SQLStatement,
+		TimeoutMs:    limits.Timeout.Milliseconds(),
+		MaxHeapBytes: limits.MaxHeapBytes,
+		Status:       writePending,
+		ExpiresAt:    time.Now().Add(writeQueueItemTTL).Unix(),
+	}
+	if err := enqueueWrite(write); err != nil {
+		return createFailureResponse("", err), nil
+	}
+
+	// Give concurrent writes a moment to join the batch
+	sleepContext(ctx, writeBatchWindow())
+
+	// Time spent waiting for the lock is bounded by the lock wait policy,
+	// and the whole wait, including the batch being applied, by the queue's
+	policy := lockWaitPolicy(apiReq)
+	var lockWaited time.Duration
+	deadline := time.Now().Add(writeQueueWait())
+	for {
+		current, err := getQueuedWrite(write.DatabaseName, write.RequestID)
+		if err != nil {
+			return createFailureResponse("", err), nil
+		}
+		if current == nil {
+			return createErrorResponse(500, "Queued write disappeared before it was applied"), nil
+		}
+
+		switch current.Status {
+		case writeDone:
+			deleteQueuedWrite(write.DatabaseName, write.RequestID, "")
+			return queuedWriteResponse(current), nil
+
+		case writeClaimed:
+			// A lock holder that lost the lock without recording results may
+			// or may not have uploaded the batch
+			if !lockHeldBy(write.DatabaseName, current.LeaderID) {
+				if again, err := getQueuedWrite(write.DatabaseName, write.RequestID); err == nil && again != nil && again.Status == writeDone {
+					deleteQueuedWrite(write.DatabaseName, write.RequestID, "")
+					return queuedWriteResponse(again), nil
+				}
+				deleteQueuedWrite(write.DatabaseName, write.RequestID, "")
+				return createErrorResponse(500, fmt.Sprintf("Commit outcome unknown: lock holder %s stopped before reporting", current.LeaderID)), nil
+			}
+			if ctx.Err() != nil {
+				return createErrorResponse(500, "Commit outcome unknown: request ended while the write was being applied"), nil
+			}
+
+		case writePending:
+			instanceID := newInstanceID()
+			attempt := policy
+			attempt.MaxWait = min(policy.MaxWait-lockWaited, time.Until(deadline))
+			waited, err := waitForDynamoLock(ctx, write.DatabaseName, instanceID, leaseExclusive, attempt)
+			lockWaited += waited
+			if err == nil {
+				drainWriteQueue(ctx, write.DatabaseName, instanceID)
+				releaseDynamoLock(ctx, write.DatabaseName, instanceID)
+				continue
+			}
+
+			var lockErr *LockWaitError
+			if !errors.As(err, &lockErr) || lockWaited >= policy.MaxWait || time.Now().After(deadline) || ctx.Err() != nil {
+				// Withdraw the write unless a lock holder has just claimed it
+				if deleteQueuedWrite(write.DatabaseName, write.RequestID, writePending) {
+					return createLockErrorResponse(err, lockWaited), nil
+				}
+				continue
+			}
+		}
+
+		sleepContext(ctx, writeQueuePollInterval)
+	}
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// enqueueWrite adds a write to the queue
+func enqueueWrite(write QueuedWrite) error {
+	item, err := dynamodbattribute.MarshalMap(write)
+	if err != nil {
+		return fmt.Errorf("failed to marshal queued write: %v", err)
+	}
+	if _, err := dynamoClient.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(writeQueueTableName),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("failed to queue write: %w", err)
+	}
+	return nil
+}
+
+// queuedWriteKey returns the table key of a queued write
+func queuedWriteKey(databaseName, requestID string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"database_name": {S: aws.String(databaseName)},
+		"request_id":    {S: aws.String(requestID)},
+	}
+}
+
+// getQueuedWrite reads a queued write, returning nil if it is gone
+func getQueuedWrite(databaseName, requestID string) (*QueuedWrite, error) {
+	result, err := dynamoClient.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(writeQueueTableName),
+		Key:            queuedWriteKey(databaseName, requestID),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check queued write: %w", err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	var write QueuedWrite
+	if err := dynamodbattribute.UnmarshalMap(result.Item, &write); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal queued write: %v", err)
+	}
+	return &write, nil
+}
+
+// deleteQueuedWrite removes a queued write, only while it has the given
+// status if one is given, and reports whether it was removed
+func deleteQueuedWrite(databaseName, requestID, status string) bool {
+	input := &dynamodb.DeleteItemInput{
+		TableName: aws.String(writeQueueTableName),
+		Key:       queuedWriteKey(databaseName, requestID),
+	}
+	if status != "" {
+		input.ConditionExpression = aws.String("#status = :status")
+		input.ExpressionAttributeNames = map[string]*string{"#status": aws.String("status")}
+		input.ExpressionAttributeValues = map[string]*dynamodb.AttributeValue{
+			":status": {S: aws.String(status)},
+		}
+	}
+
+	if _, err := dynamoClient.DeleteItem(input); err != nil {
+		if !isConditionalCheckFailed(err) {
+			slog.Warn("Failed to remove queued write", "database", databaseName, "write_id", requestID, "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// lockHeldBy reports whether instanceID still holds a database's exclusive
+// lease. Errors count as held so a write is not abandoned on a transient failure.
+func lockHeldBy(databaseName, instanceID string) bool {
+	lock, _, err := loadLock(databaseName)
+	if err != nil {
+		slog.Warn("Failed to check lock", "database", databaseName, "error", err)
+		return true
+	}
+	lock.active(time.Now().Unix())
+	return lock.Mode == leaseExclusive && lock.InstanceID == instanceID
+}
+
+// isConditionalCheckFailed reports whether a DynamoDB condition was not met
+func isConditionalCheckFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
+
+// queuedWriteResponse returns the response recorded for an applied write
+func queuedWriteResponse(write *QueuedWrite) events.APIGatewayProxyResponse {
+	return events.APIGatewayProxyResponse{
+		StatusCode: write.StatusCode,
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+		Body: write.ResponseBody,
+	}
+}
+
+// pendingWrites returns the oldest writes waiting for a database
+func pendingWrites(databaseName string) ([]QueuedWrite, error) {
+	var writes []QueuedWrite
+	var unmarshalErr error
+	err := dynamoClient.QueryPages(&dynamodb.QueryInput{
+		TableName:              aws.String(writeQueueTableName),
+		KeyConditionExpression: aws.String("database_name = :database_name"),
+		FilterExpression:       aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":database_name": {S: aws.String(databaseName)},
+			":pending":       {S: aws.String(writePending)},
+		},
+		ConsistentRead: aws.Bool(true),
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		var items []QueuedWrite
+		if unmarshalErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &items); unmarshalErr != nil {
+			return false
+		}
+		writes = append(writes, items...)
+		return len(writes) < maxWriteBatchSize
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read write queue: %w", err)
+	}
+	if unmarshalErr != nil {
+		return nil, fmt.Errorf("failed to unmarshal queued writes: %v", unmarshalErr)
+	}
+	if len(writes) > maxWriteBatchSize {
+		writes = writes[:maxWriteBatchSize]
+	}
+	return writes, nil
+}
+
+// claimWrite marks a pending write as taken by a lock holder
+func claimWrite(write QueuedWrite, leaderID string) bool {
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(writeQueueTableName),
+		Key:                 queuedWriteKey(write.DatabaseName, write.RequestID),
+		UpdateExpression:    aws.String("SET #status = :claimed, leader_id = :leader_id"),
+		ConditionExpression: aws.String("#status = :pending"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":claimed":   {S: aws.String(writeClaimed)},
+			":pending":   {S: aws.String(writePending)},
+			":leader_id": {S: aws.String(leaderID)},
+		},
+	})
+	if err != nil {
+		if !isConditionalCheckFailed(err) {
+			slog.Warn("Failed to claim queued write", "database", write.DatabaseName, "write_id", write.RequestID, "error", err)
+		}
+		return false
+	}
+	return true
+}
+
+// completeWrite records the response for a claimed write
+func completeWrite(write QueuedWrite, leaderID string, response events.APIGatewayProxyResponse) {
+	_, err := dynamoClient.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:           aws.String(writeQueueTableName),
+		Key:                 queuedWriteKey(write.DatabaseName, write.RequestID),
+		UpdateExpression:    aws.String("SET #status = :done, status_code = :status_code, response_body = :response_body"),
+		ConditionExpression: aws.String("leader_id = :leader_id"),
+		ExpressionAttributeNames: map[string]*string{
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":done":          {S: aws.String(writeDone)},
+			":status_code":   {N: aws.String(strconv.Itoa(response.StatusCode))},
+			":response_body": {S: aws.String(response.Body)},
+			":leader_id":     {S: aws.String(leaderID)},
+		},
+	})
+	if err != nil {
+		slog.Warn("Failed to record result of queued write", "database", write.DatabaseName, "write_id", write.RequestID, "error", err)
+	}
+}
+
+// drainWriteQueue applies the queued writes of a database while holding its
+// lock: they are claimed, executed against one working copy, uploaded once,
+// and each one's response is recorded for its caller
+func drainWriteQueue(ctx context.Context, databaseName, leaderID string) {
+	ctx = withLogAttrs(ctx, slog.String("lock_holder", leaderID))
+	ctx = withLeaseFence(ctx, databaseName, leaderID)
+	pending, err := pendingWrites(databaseName)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to list queued writes", "error", err)
+		return
+	}
+
+	var batch []QueuedWrite
+	for _, write := range pending {
+		if claimWrite(write, leaderID) {
+			batch = append(batch, write)
+		}
+	}
+	if len(batch) == 0 {
+		return
+	}
+
+	failAll := func(message string, err error) {
+		response := createFailureResponse(message, err)
+		for _, write := range batch {
+			completeWrite(write, leaderID, response)
+		}
+	}
+
+	started := time.Now()
+	localDBPath, err := downloadDatabase(ctx, databaseName)
+	logPhase(ctx, phaseDownload, started, err, "bytes", fileSize(localDBPath), "layout", storageLayout(databaseName))
+	if err != nil {
+		failAll("Failed to download database", err)
+		return
+	}
+	defer removeWorkingCopy(localDBPath)
+	recordBytes(ctx, directionDownload, fileSize(localDBPath))
+
+	started = time.Now()
+	responses, err := executeWriteBatch(ctx, localDBPath, batch)
+	logPhase(ctx, phaseExecute, started, err, "writes", len(batch))
+	if err != nil {
+		failAll("SQL execution failed", err)
+		return
+	}
+
+	started = time.Now()
+	err = uploadDatabase(ctx, localDBPath, databaseName)
+	logPhase(ctx, phaseUpload, started, err, "bytes", fileSize(localDBPath), "layout", storageLayout(databaseName))
+	if err != nil {
+		failAll("Failed to upload database", err)
+		return
+	}
+	recordBytes(ctx, directionUpload, fileSize(localDBPath))
+
+	for i, write := range batch {
+		completeWrite(write, leaderID, responses[i])
+	}
+	slog.InfoContext(ctx, "Group commit", "writes", len(batch))
+}
+
+// executeWriteBatch runs each write in its own transaction on one
+// connection, so a failing write is rolled back without affecting the rest
+func executeWriteBatch(ctx context.Context, dbPath string, batch []QueuedWrite) ([]events.APIGatewayProxyResponse, error) {
+	db, err := sql.Open(sqliteDriverName, dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	responses := make([]events.APIGatewayProxyResponse, len(batch))
+	for i, write := range batch {
+		limits := QueryLimits{
+			Timeout:      time.Duration(write.TimeoutMs) * time.Millisecond,
+			MaxHeapBytes: write.MaxHeapBytes,
+		}
+		result, err := executeQueuedWrite(ctx, db, write.SQLStatement, limits)
+		if err != nil {
+			responses[i] = createFailureResponse("SQL execution failed", err)
+			continue
+		}
+		result.Message = fmt.Sprintf("%s (group commit of %d writes)", result.Message, len(batch))
+		responses[i] = createSuccessResponse(result)
+	}
+	return responses, nil
+}
+
+// executeQueuedWrite runs one write of a batch in a transaction
+func executeQueuedWrite(ctx context.Context, db *sql.DB, sqlStatement string, limits QueryLimits) (*SQLResult, error) {
+	if limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+		defer cancel()
+	}
+
+	release, err := enterHeapLimit(ctx, limits)
+	if err != nil {
+		return nil, limitOrError(ctx, err, limits, "failed to start statement")
+	}
+	defer release()
+
+	if err := applyConnectionLimits(ctx, db, limits); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	result, err := tx.ExecContext(ctx, sqlStatement)
+	if err != nil {
+		tx.Rollback()
+		return nil, limitOrError(ctx, err, limits, "query execution failed")
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, limitOrError(ctx, err, limits, "commit failed")
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	return &SQLResult{
+		Success: true,
+		Message: fmt.Sprintf("Query executed successfully, %d rows affected", rowsAffected),
+	}, nil
+}
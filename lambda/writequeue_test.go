@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// useQueuedDatabase uploads a database with an empty table t to an
+// in-memory S3 and returns its name
+func useQueuedDatabase(t *testing.T) string {
+	t.Helper()
+	useFakeS3(t)
+	t.Setenv("WRITE_BATCH_WINDOW_MS", "0")
+	dir := t.TempDir()
+	databaseName := fmt.Sprintf("queue-%s.db", filepath.Base(dir))
+	t.Cleanup(func() { databaseCache.invalidate(databaseName) })
+
+	localPath := filepath.Join(dir, "seed.db")
+	if _, err := executeSQL(context.Background(), localPath, "CREATE TABLE t (x INTEGER PRIMARY KEY)", QueryLimits{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadToS3(context.Background(), localPath, databaseName); err != nil {
+		t.Fatal(err)
+	}
+	return databaseName
+}
+
+// queuedRows returns the rows of table t in the stored database
+func queuedRows(t *testing.T, databaseName string) []int {
+	t.Helper()
+	localPath, err := downloadDatabase(context.Background(), databaseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeWorkingCopy(localPath)
+
+	db, err := sql.Open(sqliteDriverName, readOnlyDSN(localPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT x FROM t ORDER BY x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var values []int
+	for rows.Next() {
+		var x int
+		if err := rows.Scan(&x); err != nil {
+			t.Fatal(err)
+		}
+		values = append(values, x)
+	}
+	return values
+}
+
+// queueWrite adds a pending write as another caller would and returns its ID
+func queueWrite(t *testing.T, databaseName, sqlStatement string) string {
+	t.Helper()
+	write := QueuedWrite{
+		DatabaseName: databaseName,
+		RequestID:    newQueuedRequestID(),
+		SQLStatement: sqlStatement,
+		Status:       writePending,
+		ExpiresAt:    time.Now().Add(writeQueueItemTTL).Unix(),
+	}
+	if err := enqueueWrite(write); err != nil {
+		t.Fatal(err)
+	}
+	return write.RequestID
+}
+
+// decodeResult parses the SQLResult in a response body
+func decodeResult(t *testing.T, body string) SQLResult {
+	t.Helper()
+	var result SQLResult
+	if err := json.Unmarshal([]byte(body), &result); err != nil {
+		t.Fatalf("response body %q: %v", body, err)
+	}
+	return result
+}
+
+func TestQueuedWriteBatch(t *testing.T) {
+	useFakeDynamoDB(t)
+	databaseName := useQueuedDatabase(t)
+
+	// Two callers queue first; the third takes the lock and applies all three
+	first := queueWrite(t, databaseName, "INSERT INTO t VALUES (1)")
+	failing := queueWrite(t, databaseName, "INSERT INTO missing VALUES (2)")
+	response, err := handleQueuedWrite(context.Background(), APIRequest{
+		DatabaseName: databaseName,
+		SQLStatement: "INSERT INTO t VALUES (3)",
+	}, QueryLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result := decodeResult(t, response.Body); !result.Success || !strings.Contains(result.Message, "group commit of 3 writes") {
+		t.Errorf("caller's result = %+v, want success in a batch of 3", result)
+	}
+	for _, tt := range []struct {
+		requestID string
+		success   bool
+	}{
+		{first, true},
+		{failing, false},
+	} {
+		write, err := getQueuedWrite(databaseName, tt.requestID)
+		if err != nil || write == nil {
+			t.Fatalf("queued write %s = %v, %v", tt.requestID, write, err)
+		}
+		if write.Status != writeDone {
+			t.Errorf("write %s is %s, want %s", tt.requestID, write.Status, writeDone)
+			continue
+		}
+		if result := decodeResult(t, write.ResponseBody); result.Success != tt.success {
+			t.Errorf("write %s result = %+v, want success %v", tt.requestID, result, tt.success)
+		}
+	}
+	if got := queuedRows(t, databaseName); fmt.Sprint(got) != "[1 3]" {
+		t.Errorf("rows after the batch = %v, want [1 3]", got)
+	}
+	lock, _, err := loadLock(databaseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lock.active(time.Now().Unix()); lock.Mode != "" {
+		t.Errorf("lock still held in %s mode after the batch", lock.Mode)
+	}
+}
+
+func TestQueuedWriteLeaderLost(t *testing.T) {
+	t.Run("caller reports an unknown outcome", func(t *testing.T) {
+		fake := useFakeDynamoDB(t)
+		databaseName := useQueuedDatabase(t)
+
+		// Another request claims the write as soon as it is queued, and
+		// never reports back
+		fake.intercept = func(operation string, body []byte) *fakeDynamoError {
+			if operation == "GetItem" && strings.Contains(string(body), writeQueueTableName) {
+				claimAll(fake, "lambda-gone")
+			}
+			return nil
+		}
+		response, err := handleQueuedWrite(context.Background(), APIRequest{
+			DatabaseName: databaseName,
+			SQLStatement: "INSERT INTO t VALUES (1)",
+		}, QueryLimits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.StatusCode != 500 || !strings.Contains(response.Body, "Commit outcome unknown") {
+			t.Errorf("response = %d %s, want an unknown commit outcome", response.StatusCode, response.Body)
+		}
+		if n := queueLength(fake); n != 0 {
+			t.Errorf("%d queued writes left behind", n)
+		}
+	})
+
+	t.Run("leader fails the batch", func(t *testing.T) {
+		fake := useFakeDynamoDB(t)
+		databaseName := useQueuedDatabase(t)
+		requestID := queueWrite(t, databaseName, "INSERT INTO t VALUES (1)")
+		leaderID := newInstanceID()
+		if err := acquireDynamoLease(context.Background(), databaseName, leaderID, leaseExclusive); err != nil {
+			t.Fatal(err)
+		}
+
+		// The lease is force-released once the write is claimed
+		fake.intercept = func(operation string, body []byte) *fakeDynamoError {
+			if operation == "UpdateItem" && strings.Contains(string(body), ":claimed") {
+				fake.mu.Lock()
+				delete(fake.tables[lockTableName], databaseName)
+				fake.mu.Unlock()
+			}
+			return nil
+		}
+		drainWriteQueue(context.Background(), databaseName, leaderID)
+
+		write, err := getQueuedWrite(databaseName, requestID)
+		if err != nil || write == nil {
+			t.Fatalf("queued write = %v, %v", write, err)
+		}
+		if write.Status != writeDone || decodeResult(t, write.ResponseBody).Success {
+			t.Errorf("write is %s with %s, want a recorded failure", write.Status, write.ResponseBody)
+		}
+		if got := queuedRows(t, databaseName); len(got) != 0 {
+			t.Errorf("rows after losing the lease = %v, want none uploaded", got)
+		}
+	})
+}
+
+func TestQueuedWriteWithdrawnOnLockTimeout(t *testing.T) {
+	fake := useFakeDynamoDB(t)
+	databaseName := useQueuedDatabase(t)
+	t.Setenv("LOCK_WAIT_MS", "20")
+	t.Setenv("LOCK_BACKOFF_INITIAL_MS", "1")
+	t.Setenv("LOCK_BACKOFF_MAX_MS", "5")
+	if err := acquireDynamoLease(context.Background(), databaseName, "other", leaseExclusive); err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := handleQueuedWrite(context.Background(), APIRequest{
+		DatabaseName: databaseName,
+		SQLStatement: "INSERT INTO t VALUES (1)",
+	}, QueryLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != 409 {
+		t.Errorf("response = %d %s, want 409", response.StatusCode, response.Body)
+	}
+	if n := queueLength(fake); n != 0 {
+		t.Errorf("%d queued writes left behind after the caller gave up", n)
+	}
+}
+
+// claimAll marks every pending write as claimed by leaderID
+func claimAll(fake *fakeDynamoDB, leaderID string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	for _, item := range fake.tables[writeQueueTableName] {
+		if aws.StringValue(item["status"].S) == writePending {
+			item["status"] = &dynamodb.AttributeValue{S: aws.String(writeClaimed)}
+			item["leader_id"] = &dynamodb.AttributeValue{S: aws.String(leaderID)}
+		}
+	}
+}
+
+// queueLength returns how many writes are in the queue
+func queueLength(fake *fakeDynamoDB) int {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return len(fake.tables[writeQueueTableName])
+}
@@ -1,13 +1,21 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math/rand"
 	"os"
+	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -20,8 +28,37 @@ const (
 	dbFile   = "test.db"
 	lockFile = "lock.json"
 
+	// Directory under s3Path keeping replaced versions of each object
+	versionsDir = ".versions"
+
+	// Suffix of the file holding an object's SHA-256, standing in for S3 metadata
+	checksumSuffix = ".sha256"
+
 	// Lock timeout - consider lock stale after 30 seconds
 	lockTimeout = 30 * time.Second
+
+	// Directory under s3Path holding the tickets of processes waiting in turn
+	lockTicketsDir = "lock.tickets"
+
+	// Directory under s3Path holding one file per shared (reader) lease, and
+	// the file recording a writer waiting for the readers to finish
+	lockReadersDir    = "lock.readers"
+	writerWaitingFile = "lock.writer-waiting.json"
+
+	// How long a waiting writer keeps new readers out without renewing its claim
+	writerWaitTimeout = 10 * time.Second
+
+	// Default lock wait policy
+	defaultLockWait           = 10 * time.Second
+	defaultLockBackoffInitial = 50 * time.Millisecond
+	defaultLockBackoffMax     = time.Second
+
+	// Phases of a run, logged with how long each took
+	phaseLock     = "lock"
+	phaseDownload = "download"
+	phaseExecute  = "execute"
+	phaseUpload   = "upload"
+	phaseRelease  = "release"
 )
 
 // LockInfo represents the lock file structure
@@ -29,6 +66,79 @@ type LockInfo struct {
 	PID       int       `json:"pid"`
 	Timestamp time.Time `json:"timestamp"`
 	Process   string    `json:"process"`
+
+	// Who holds the lock, for conflict errors
+	Hostname string `json:"hostname,omitempty"`
+	User     string `json:"user,omitempty"`
+	Command  string `json:"command,omitempty"`
+
+	// ProcessStart tells a live holder from a later process that reused its
+	// PID; Heartbeat is renewed while the lock is held, so holders on other
+	// hosts are judged by it alone
+	ProcessStart time.Time `json:"process_start,omitempty"`
+	Heartbeat    time.Time `json:"heartbeat,omitempty"`
+}
+
+// newLockInfo describes this process as a lock holder
+func newLockInfo() LockInfo {
+	hostname, _ := os.Hostname()
+	username := os.Getenv("USER")
+	if current, err := user.Current(); err == nil {
+		username = current.Username
+	}
+	now := time.Now()
+	info := LockInfo{
+		PID:       os.Getpid(),
+		Timestamp: now,
+		Process:   filepath.Base(os.Args[0]),
+		Hostname:  hostname,
+		User:      username,
+		Command:   strings.Join(os.Args, " "),
+		Heartbeat: now,
+	}
+	if started, err := processStartTime(info.PID); err == nil {
+		info.ProcessStart = started
+	}
+	return info
+}
+
+// staleReason returns why a lock, lease, ticket or waiting-writer file no
+// longer belongs to a live holder, or "" if it still does. A holder whose
+// heartbeat is older than lockTimeout is gone wherever it ran; PIDs are only
+// checked for holders on this host, where they mean something.
+func (l LockInfo) staleReason() string {
+	lastSeen := l.Heartbeat
+	if lastSeen.IsZero() {
+		lastSeen = l.Timestamp
+	}
+	if age := time.Since(lastSeen); age > lockTimeout {
+		return fmt.Sprintf("no heartbeat for %v", age.Round(time.Second))
+	}
+
+	hostname, _ := os.Hostname()
+	if l.Hostname != "" && l.Hostname != hostname {
+		return ""
+	}
+	if !isProcessRunning(l.PID) {
+		return fmt.Sprintf("process %d is no longer running", l.PID)
+	}
+	if !l.ProcessStart.IsZero() {
+		if started, err := processStartTime(l.PID); err == nil && !started.Equal(l.ProcessStart) {
+			return fmt.Sprintf("PID %d now belongs to a process started at %v", l.PID, started)
+		}
+	}
+	return ""
+}
+
+// sameProcess reports whether two lock records were written by the same
+// process; PIDs repeat across the hosts sharing the mount
+func (l LockInfo) sameProcess(other LockInfo) bool {
+	return l.PID == other.PID && l.Hostname == other.Hostname
+}
+
+// String names the holder in conflict errors
+func (l LockInfo) String() string {
+	return fmt.Sprintf("process %d (%s) on %s run by %s, %q", l.PID, l.Process, l.Hostname, l.User, l.Command)
 }
 
 // acquireLock attempts to acquire a lock on the database
@@ -44,38 +154,303 @@ func acquireLock() error {
 	}
 
 	// Create lock file
-	lockInfo := LockInfo{
-		PID:       os.Getpid(),
-		Timestamp: time.Now(),
-		Process:   "cloudsqlite",
-	}
+	lockInfo := newLockInfo()
 
 	lockData, err := json.Marshal(lockInfo)
 	if err != nil {
 		return fmt.Errorf("failed to marshal lock info: %v", err)
 	}
 
-	if err := os.WriteFile(lockPath, lockData, 0644); err != nil {
+	// Another writer already waiting for the readers goes first
+	if waiting := waitingWriter(); waiting != nil && !waiting.sameProcess(lockInfo) {
+		return fmt.Errorf("writer %s is waiting for the lock", waiting)
+	}
+
+	// O_EXCL makes creation atomic, so two waiters cannot both take the lock
+	if err := createExclusive(lockPath, lockData); err != nil {
+		if os.IsExist(err) {
+			if holder, readErr := readLockInfo(lockPath); readErr == nil {
+				return fmt.Errorf("lock was just taken by %s", holder)
+			}
+			return fmt.Errorf("lock was just taken by another process")
+		}
 		return fmt.Errorf("failed to create lock file: %v", err)
 	}
 
-	fmt.Printf("Lock acquired by PID %d\n", lockInfo.PID)
+	// Readers register before checking for a writer, and the writer creates
+	// the lock before checking for readers, so one of them always backs off
+	if readers := activeReaders(); readers > 0 {
+		os.Remove(lockPath)
+		if err := os.WriteFile(filepath.Join(s3Path, writerWaitingFile), lockData, 0644); err != nil {
+			slog.Warn("Failed to record waiting writer", "error", err)
+		}
+		return fmt.Errorf("database has %d readers", readers)
+	}
+	if waiting := waitingWriter(); waiting != nil && waiting.sameProcess(lockInfo) {
+		os.Remove(filepath.Join(s3Path, writerWaitingFile))
+	}
+
+	// Confirm the lock file is still ours, in case another process judged
+	// it stale and replaced it
+	if holder, err := readLockInfo(lockPath); err != nil || !holder.Timestamp.Equal(lockInfo.Timestamp) || !holder.sameProcess(lockInfo) {
+		return fmt.Errorf("lock was taken over by another process")
+	}
+
+	slog.Debug("Lock acquired", "holder", lockInfo.String())
 	return nil
 }
 
+// createExclusive writes a file that must not already exist
+func createExclusive(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// acquireSharedLock takes a reader lease, which any number of processes may
+// hold at once while no writer holds or is waiting for the lock. It returns
+// the lease file to pass to releaseSharedLock.
+func acquireSharedLock() (string, error) {
+	if waiting := waitingWriter(); waiting != nil {
+		return "", fmt.Errorf("writer %s is waiting for the lock", waiting)
+	}
+
+	dir := filepath.Join(s3Path, lockReadersDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create readers directory: %v", err)
+	}
+	lockInfo := newLockInfo()
+	lockData, err := json.Marshal(lockInfo)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal lock info: %v", err)
+	}
+	readerPath := filepath.Join(dir, fmt.Sprintf("%020d-%d.json", lockInfo.Timestamp.UnixNano(), lockInfo.PID))
+	if err := createExclusive(readerPath, lockData); err != nil {
+		return "", fmt.Errorf("failed to create reader lease: %v", err)
+	}
+
+	lockPath := filepath.Join(s3Path, lockFile)
+	if _, err := os.Stat(lockPath); err == nil {
+		if err := checkLockValidity(lockPath); err != nil {
+			os.Remove(readerPath)
+			return "", fmt.Errorf("lock is held by another process: %v", err)
+		}
+	}
+
+	slog.Debug("Shared lock acquired", "holder", lockInfo.String())
+	return readerPath, nil
+}
+
+// releaseSharedLock removes a reader lease
+func releaseSharedLock(readerPath string) error {
+	if err := os.Remove(readerPath); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to release shared lock: %v", err)
+	}
+	slog.Debug("Shared lock released")
+	return nil
+}
+
+// activeReaders counts the reader leases of running processes, removing
+// stale ones
+func activeReaders() int {
+	dir := filepath.Join(s3Path, lockReadersDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	readers := 0
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		info, err := readLockInfo(path)
+		if err != nil || info.staleReason() != "" {
+			os.Remove(path)
+			continue
+		}
+		readers++
+	}
+	return readers
+}
+
+// waitingWriter returns the writer waiting for readers to finish, if its
+// claim is recent and its holder is alive
+func waitingWriter() *LockInfo {
+	path := filepath.Join(s3Path, writerWaitingFile)
+	info, err := readLockInfo(path)
+	if err != nil {
+		return nil
+	}
+	if time.Since(info.Timestamp) > writerWaitTimeout || info.staleReason() != "" {
+		os.Remove(path)
+		return nil
+	}
+	return info
+}
+
+// withdrawWriterClaim removes the waiting-writer file if this process wrote it
+func withdrawWriterClaim() {
+	path := filepath.Join(s3Path, writerWaitingFile)
+	hostname, _ := os.Hostname()
+	if info, err := readLockInfo(path); err == nil && info.PID == os.Getpid() && info.Hostname == hostname {
+		os.Remove(path)
+	}
+}
+
+// readLockInfo reads a lock, lease or waiting-writer file
+func readLockInfo(path string) (*LockInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var info LockInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal lock info: %v", err)
+	}
+	return &info, nil
+}
+
+// lockWaitPolicy returns the wait from LOCK_WAIT, backoff bounds from
+// LOCK_BACKOFF_INITIAL and LOCK_BACKOFF_MAX, and whether LOCK_FAIR=on
+func lockWaitPolicy() (maxWait, initialBackoff, maxBackoff time.Duration, fair bool) {
+	maxWait = envDuration("LOCK_WAIT", defaultLockWait)
+	initialBackoff = envDuration("LOCK_BACKOFF_INITIAL", defaultLockBackoffInitial)
+	maxBackoff = envDuration("LOCK_BACKOFF_MAX", defaultLockBackoffMax)
+	if initialBackoff <= 0 {
+		initialBackoff = defaultLockBackoffInitial
+	}
+	if maxBackoff < initialBackoff {
+		maxBackoff = initialBackoff
+	}
+	return maxWait, initialBackoff, maxBackoff, os.Getenv("LOCK_FAIR") == "on"
+}
+
+// envDuration reads a Go duration from the environment
+func envDuration(name string, fallback time.Duration) time.Duration {
+	if raw := os.Getenv(name); raw != "" {
+		if d, err := time.ParseDuration(raw); err == nil && d >= 0 {
+			return d
+		}
+		slog.Warn("Ignoring invalid "+name, "value", raw)
+	}
+	return fallback
+}
+
+// waitForLock runs acquire, retrying with exponential backoff and jitter
+// while the lock is held, and returns how long it waited. With LOCK_FAIR=on
+// writers take tickets and only the oldest live ticket tries for the lock;
+// readers are held back by waiting writers instead, so a writer that gives
+// up withdraws its claim.
+func waitForLock(acquire func() error, shared bool) (time.Duration, error) {
+	maxWait, initialBackoff, maxBackoff, fair := lockWaitPolicy()
+	fair = fair && !shared
+	started := time.Now()
+	deadline := started.Add(maxWait)
+
+	var ticket string
+	if fair {
+		var err error
+		if ticket, err = takeLockTicket(); err != nil {
+			return 0, err
+		}
+		defer os.Remove(ticket)
+	}
+
+	for attempt := 0; ; attempt++ {
+		var err error
+		if fair && !isFirstLockTicket(ticket) {
+			err = fmt.Errorf("waiting for earlier tickets")
+		} else if err = acquire(); err == nil {
+			return time.Since(started), nil
+		}
+
+		// Full jitter: a random delay up to the exponential backoff
+		ceiling := maxBackoff
+		if attempt < 30 {
+			if exp := initialBackoff << attempt; exp > 0 && exp < ceiling {
+				ceiling = exp
+			}
+		}
+		delay := time.Duration(rand.Int63n(int64(ceiling)) + 1)
+		if time.Now().Add(delay).After(deadline) {
+			if !shared {
+				withdrawWriterClaim()
+			}
+			return time.Since(started), fmt.Errorf("gave up after waiting %v: %v", time.Since(started).Round(time.Millisecond), err)
+		}
+		time.Sleep(delay)
+	}
+}
+
+// takeLockTicket creates a ticket file named so tickets sort in arrival order
+func takeLockTicket() (string, error) {
+	dir := filepath.Join(s3Path, lockTicketsDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create lock tickets directory: %v", err)
+	}
+	info := newLockInfo()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal lock info: %v", err)
+	}
+	ticket := filepath.Join(dir, fmt.Sprintf("%020d-%d.json", info.Timestamp.UnixNano(), info.PID))
+	if err := os.WriteFile(ticket, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to take lock ticket: %v", err)
+	}
+	return ticket, nil
+}
+
+// isFirstLockTicket reports whether ticket is the oldest ticket whose
+// holder is still alive, removing stale tickets. It renews the ticket's own
+// heartbeat so waiters on other hosts keep it.
+func isFirstLockTicket(ticket string) bool {
+	renewHeartbeat(ticket)
+
+	dir := filepath.Dir(ticket)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return true
+	}
+	for _, entry := range entries { // sorted by name, so in arrival order
+		path := filepath.Join(dir, entry.Name())
+		if path == ticket {
+			return true
+		}
+		if info, err := readLockInfo(path); err != nil || info.staleReason() != "" {
+			os.Remove(path)
+			continue
+		}
+		return false
+	}
+	return true
+}
+
 // releaseLock removes the lock file
 func releaseLock() error {
 	lockPath := filepath.Join(s3Path, lockFile)
 	if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to release lock: %v", err)
 	}
-	fmt.Println("Lock released")
+	slog.Debug("Lock released")
 	return nil
 }
 
-// checkLockValidity checks if the existing lock is valid (not stale)
+// checkLockValidity checks if the existing lock is valid (not stale). A
+// stale lock is first renamed to a name only this process uses and checked
+// again there, so when two processes find the same stale lock, the slower
+// one cannot remove the lock the faster one has just taken.
 func checkLockValidity(lockPath string) error {
 	data, err := os.ReadFile(lockPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read lock file: %v", err)
 	}
@@ -85,51 +460,325 @@ func checkLockValidity(lockPath string) error {
 		return fmt.Errorf("failed to unmarshal lock info: %v", err)
 	}
 
-	// Check if lock is stale
-	if time.Since(lockInfo.Timestamp) > lockTimeout {
-		fmt.Printf("Lock is stale (age: %v), removing it\n", time.Since(lockInfo.Timestamp))
-		return os.Remove(lockPath)
+	reason := lockInfo.staleReason()
+	if reason == "" {
+		return fmt.Errorf("lock is held by %s since %v", lockInfo, lockInfo.Timestamp)
 	}
 
-	// Check if the process is still running
-	if !isProcessRunning(lockInfo.PID) {
-		fmt.Printf("Process %d is no longer running, removing stale lock\n", lockInfo.PID)
-		return os.Remove(lockPath)
+	claimed := fmt.Sprintf("%s.stale-%d-%d", lockPath, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(lockPath, claimed); err != nil {
+		if os.IsNotExist(err) {
+			return nil // another process removed it first
+		}
+		return fmt.Errorf("failed to remove stale lock: %v", err)
+	}
+	claimedData, err := os.ReadFile(claimed)
+	if err != nil {
+		return fmt.Errorf("failed to read lock file: %v", err)
+	}
+	if !bytes.Equal(claimedData, data) {
+		// The stale lock was replaced by a new holder's before the rename,
+		// so put that one back; a link never overwrites an existing lock
+		if err := os.Link(claimed, lockPath); err != nil {
+			slog.Warn("Failed to restore lock taken by another process", "error", err)
+		}
+		os.Remove(claimed)
+		return fmt.Errorf("lock was just taken by another process")
 	}
 
-	return fmt.Errorf("lock is held by active process %d since %v", lockInfo.PID, lockInfo.Timestamp)
+	slog.Warn("Removing stale lock", "reason", reason, "holder", lockInfo.String())
+	return os.Remove(claimed)
 }
 
 // isProcessRunning checks if a process with the given PID is running
 func isProcessRunning(pid int) bool {
-	// Try to send signal 0 to check if process exists
+	// Try to send signal 0 to check if process exists; EPERM means it
+	// exists but belongs to another user
 	err := syscall.Kill(pid, 0)
-	return err == nil
+	return err == nil || err == syscall.EPERM
+}
+
+// processStartTime returns when a process on this host started, from
+// /proc/<pid>/stat and the boot time in /proc/stat
+func processStartTime(pid int) (time.Time, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return time.Time{}, err
+	}
+	// The command name may contain spaces, so count fields after its ")"
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 20 {
+		return time.Time{}, fmt.Errorf("unexpected format of /proc/%d/stat", pid)
+	}
+	ticks, err := strconv.ParseInt(fields[19], 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid start time in /proc/%d/stat: %v", pid, err)
+	}
+
+	procStat, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	for _, line := range strings.Split(string(procStat), "\n") {
+		if rest, ok := strings.CutPrefix(line, "btime "); ok {
+			boot, err := strconv.ParseInt(strings.TrimSpace(rest), 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid boot time in /proc/stat: %v", err)
+			}
+			// Start times are in clock ticks, which Linux reports at 100 per second
+			return time.Unix(boot, 0).Add(time.Duration(ticks) * time.Second / 100).UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("no boot time in /proc/stat")
+}
+
+// renewHeartbeat records that the holder of a lock, lease or ticket file is
+// still alive. The file is replaced atomically so readers never see it half
+// written, and left alone if it no longer belongs to this process.
+func renewHeartbeat(path string) error {
+	info, err := readLockInfo(path)
+	if err != nil {
+		return err
+	}
+	hostname, _ := os.Hostname()
+	if info.PID != os.Getpid() || info.Hostname != hostname {
+		return fmt.Errorf("%s is no longer held by this process", path)
+	}
+
+	info.Heartbeat = time.Now()
+	data, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("failed to marshal lock info: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".heartbeat-*")
+	if err != nil {
+		return fmt.Errorf("failed to renew heartbeat: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to renew heartbeat: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to renew heartbeat: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// startHeartbeat renews the heartbeat of a held lock or lease every third of
+// lockTimeout until the returned function is called, which must happen
+// before the lock is released
+func startHeartbeat(path string) func() {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(lockTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := renewHeartbeat(path); err != nil {
+					slog.Warn("Failed to renew lock heartbeat", "path", path, "error", err)
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+// setupLogging sends structured JSON logs to stderr at LOG_LEVEL (debug,
+// info, warn or error; default info). Every record carries an ID for this
+// run, the database and the lock holder identity this process uses.
+func setupLogging() {
+	var level slog.Level
+	if raw := os.Getenv("LOG_LEVEL"); raw != "" {
+		if err := level.UnmarshalText([]byte(raw)); err != nil {
+			level = slog.LevelInfo
+			defer slog.Warn("Ignoring invalid LOG_LEVEL", "value", raw)
+		}
+	}
+	hostname, _ := os.Hostname()
+	logger := slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})).With(
+		"request_id", fmt.Sprintf("local-%d-%d", os.Getpid(), time.Now().UnixNano()),
+		"database", dbFile,
+		"lock_holder", fmt.Sprintf("%s:%d", hostname, os.Getpid()),
+	)
+	slog.SetDefault(logger)
+}
+
+// logPhase logs and records the end of a phase of the run, with how long it
+// took and whether it failed
+func logPhase(phase string, started time.Time, err error, args ...any) {
+	duration := time.Since(started)
+	recordMetric(strings.ToUpper(phase[:1])+phase[1:]+"Ms", "Milliseconds", float64(duration.Milliseconds()))
+	args = append(args, "phase", phase, "duration_ms", duration.Milliseconds())
+	if err != nil {
+		slog.Error("Phase failed", append(args, "error", err)...)
+		return
+	}
+	slog.Info("Phase completed", args...)
+}
+
+// fatal logs an error, prints the run's metrics and exits
+func fatal(message string, err error) {
+	slog.Error(message, "error", err)
+	writeRunMetrics(os.Stdout)
+	os.Exit(1)
+}
+
+var (
+	// The run's metrics and their units, printed when it ends
+	runOperation   = "transaction"
+	runMetrics     = make(map[string]float64)
+	runMetricUnits = make(map[string]string)
+)
+
+// recordMetric adds a value to the run's metrics
+func recordMetric(name, unit string, value float64) {
+	runMetrics[name] += value
+	runMetricUnits[name] = unit
+}
+
+// writeRunMetrics prints the run's metrics as a CloudWatch Embedded Metric
+// Format record, which the CloudWatch agent turns into metrics
+func writeRunMetrics(w io.Writer) {
+	names := make([]string, 0, len(runMetrics))
+	for name := range runMetrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]map[string]string, 0, len(names))
+	record := map[string]interface{}{
+		"Operation": runOperation,
+		"Database":  dbFile,
+		"PID":       os.Getpid(),
+	}
+	for _, name := range names {
+		definitions = append(definitions, map[string]string{"Name": name, "Unit": runMetricUnits[name]})
+		record[name] = runMetrics[name]
+	}
+	record["_aws"] = map[string]interface{}{
+		"Timestamp": time.Now().UnixMilli(),
+		"CloudWatchMetrics": []map[string]interface{}{{
+			"Namespace":  "CloudSQLite",
+			"Dimensions": [][]string{{"Operation"}},
+			"Metrics":    definitions,
+		}},
+	}
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Warn("Failed to marshal metrics", "error", err)
+		return
+	}
+	fmt.Fprintln(w, string(line))
+}
+
+// logSQLArgs returns SQL parameter values as they may be logged: replaced
+// with ? unless LOG_SQL=full
+func logSQLArgs(args ...any) []any {
+	if os.Getenv("LOG_SQL") == "full" {
+		return args
+	}
+	redacted := make([]any, len(args))
+	for i := range redacted {
+		redacted[i] = "?"
+	}
+	return redacted
+}
+
+// recordLockWait records how long the run waited for the lock, and whether
+// it gave up because the lock stayed held
+func recordLockWait(waited time.Duration, err error) {
+	recordMetric("LockWaitMs", "Milliseconds", float64(waited.Milliseconds()))
+	if err != nil {
+		recordMetric("LockConflicts", "Count", 1)
+	}
+}
+
+// fileSize returns the size of a file, or 0 if it cannot be read
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
 }
 
 func main() {
+	setupLogging()
+
 	// Create S3 simulation directory
 	if err := os.MkdirAll(s3Path, 0755); err != nil {
-		log.Fatalf("Failed to create S3 directory: %v", err)
+		fatal("Failed to create S3 directory", err)
 	}
 
 	// Initialize database if it doesn't exist
 	if err := initializeDatabase(); err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		fatal("Failed to initialize database", err)
 	}
 
-	// Acquire lock before transaction
-	if err := acquireLock(); err != nil {
-		log.Fatalf("Failed to acquire lock: %v", err)
+	// "read" runs a read-only query under a shared lock
+	if len(os.Args) > 1 && os.Args[1] == "read" {
+		runOperation = "read"
 	}
-	defer releaseLock() // Ensure lock is released
+	defer writeRunMetrics(os.Stdout)
+
+	if runOperation == "read" {
+		var readerPath string
+		acquire := func() (err error) {
+			readerPath, err = acquireSharedLock()
+			return err
+		}
+		started := time.Now()
+		waited, err := waitForLock(acquire, true)
+		recordLockWait(waited, err)
+		logPhase(phaseLock, started, err, "mode", "shared", "lock_wait_ms", waited.Milliseconds())
+		if err != nil {
+			fatal("Failed to acquire shared lock", err)
+		}
+		defer func() {
+			started := time.Now()
+			logPhase(phaseRelease, started, releaseSharedLock(readerPath), "mode", "shared")
+		}()
+		defer startHeartbeat(readerPath)()
+
+		if err := performRead(); err != nil {
+			fatal("Read failed", err)
+		}
+		return
+	}
+
+	// Acquire lock before transaction, waiting for it if it is held
+	started := time.Now()
+	waited, err := waitForLock(acquireLock, false)
+	recordLockWait(waited, err)
+	logPhase(phaseLock, started, err, "mode", "exclusive", "lock_wait_ms", waited.Milliseconds())
+	if err != nil {
+		fatal("Failed to acquire lock", err)
+	}
+	// Ensure lock is released
+	defer func() {
+		started := time.Now()
+		logPhase(phaseRelease, started, releaseLock(), "mode", "exclusive")
+	}()
+
+	// Keep the lock alive while we hold it; this stops before the release
+	defer startHeartbeat(filepath.Join(s3Path, lockFile))()
 
 	// Simulate database transaction
 	if err := performTransaction(); err != nil {
-		log.Fatalf("Transaction failed: %v", err)
+		fatal("Transaction failed", err)
 	}
 
-	fmt.Println("Transaction completed successfully!")
+	slog.Info("Transaction completed successfully")
 }
 
 // initializeDatabase creates the initial database with a logs table
@@ -138,7 +787,7 @@ func initializeDatabase() error {
 
 	// Check if database already exists
 	if _, err := os.Stat(dbPath); err == nil {
-		fmt.Println("Database already exists, skipping initialization")
+		slog.Debug("Database already exists, skipping initialization")
 		return nil
 	}
 
@@ -161,35 +810,98 @@ func initializeDatabase() error {
 		return fmt.Errorf("failed to create table: %v", err)
 	}
 
-	fmt.Println("Database initialized successfully")
+	slog.Info("Database initialized successfully")
 	return nil
 }
 
 // performTransaction downloads, modifies, and uploads the database
 func performTransaction() error {
+	// Each transaction works in a directory of its own, so concurrent processes
+	// never share a working copy or its -wal and -journal sidecars
+	workDir, err := os.MkdirTemp("", "cloudsqlite-txn-")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %v", err)
+	}
+	defer os.RemoveAll(workDir) // Clean up the working copy and sidecars
+
 	// Step 1: Download database from S3 (simulate)
-	fmt.Println("Downloading database from S3...")
-	localDBPath := "./temp_" + dbFile
-	if err := copyFile(filepath.Join(s3Path, dbFile), localDBPath); err != nil {
-		return fmt.Errorf("failed to download database: %v", err)
+	localDBPath := filepath.Join(workDir, dbFile)
+	if err := downloadObject(dbFile, localDBPath); err != nil {
+		return err
 	}
-	defer os.Remove(localDBPath) // Clean up temp file
 
 	// Step 2: Perform SQL operation
-	fmt.Println("Performing SQL operation...")
-	if err := modifyDatabase(localDBPath); err != nil {
+	started := time.Now()
+	err = modifyDatabase(localDBPath)
+	logPhase(phaseExecute, started, err)
+	if err != nil {
 		return fmt.Errorf("failed to modify database: %v", err)
 	}
 
-	// Step 3: Upload modified database back to S3 (simulate)
-	fmt.Println("Uploading modified database to S3...")
-	if err := copyFile(localDBPath, filepath.Join(s3Path, dbFile)); err != nil {
+	// Step 3: Check the modified database before it replaces the stored copy
+	if err := checkIntegrity(localDBPath); err != nil {
+		return fmt.Errorf("integrity check failed: %v", err)
+	}
+
+	// Step 4: Upload modified database back to S3 (simulate)
+	started = time.Now()
+	err = uploadObject(localDBPath, dbFile)
+	logPhase(phaseUpload, started, err, "bytes", fileSize(localDBPath))
+	if err != nil {
 		return fmt.Errorf("failed to upload database: %v", err)
 	}
+	recordMetric("BytesUploaded", "Bytes", float64(fileSize(localDBPath)))
 
 	return nil
 }
 
+// downloadObject copies an object to localPath and verifies its checksum
+func downloadObject(key, localPath string) error {
+	started := time.Now()
+	err := copyFile(filepath.Join(s3Path, key), localPath)
+	if err != nil {
+		err = fmt.Errorf("failed to download database: %v", err)
+	} else if err = verifyChecksum(filepath.Join(s3Path, key), localPath); err != nil {
+		err = fmt.Errorf("failed to verify download: %v", err)
+	}
+	logPhase(phaseDownload, started, err, "bytes", fileSize(localPath))
+	if err == nil {
+		recordMetric("BytesDownloaded", "Bytes", float64(fileSize(localPath)))
+	}
+	return err
+}
+
+// performRead downloads the database and counts its log entries
+func performRead() error {
+	workDir, err := os.MkdirTemp("", "cloudsqlite-txn-")
+	if err != nil {
+		return fmt.Errorf("failed to create working directory: %v", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	localDBPath := filepath.Join(workDir, dbFile)
+	if err := downloadObject(dbFile, localDBPath); err != nil {
+		return err
+	}
+
+	started := time.Now()
+	db, err := sql.Open("sqlite3", localDBPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM logs").Scan(&count)
+	logPhase(phaseExecute, started, err, "sql", "SELECT COUNT(*) FROM logs")
+	if err != nil {
+		return fmt.Errorf("failed to count log entries: %v", err)
+	}
+	recordMetric("RowsReturned", "Count", 1)
+	slog.Info("Read completed", "log_entries", count)
+	return nil
+}
+
 // modifyDatabase performs the actual SQL operation
 func modifyDatabase(dbPath string) error {
 	db, err := sql.Open("sqlite3", dbPath)
@@ -201,6 +913,7 @@ func modifyDatabase(dbPath string) error {
 	// Insert a test log entry
 	insertSQL := `INSERT INTO logs (message) VALUES (?)`
 	message := fmt.Sprintf("Test log entry at %s", time.Now().Format(time.RFC3339))
+	slog.Debug("Executing SQL", "sql", insertSQL, "args", logSQLArgs(message))
 
 	if _, err := db.Exec(insertSQL, message); err != nil {
 		return fmt.Errorf("failed to insert log: %v", err)
@@ -212,11 +925,55 @@ func modifyDatabase(dbPath string) error {
 		return fmt.Errorf("failed to count logs: %v", err)
 	}
 
-	fmt.Printf("Successfully inserted log entry. Total logs: %d\n", count)
+	slog.Info("Inserted log entry", "total_logs", count)
 	return nil
 }
 
-// copyFile copies a file from src to dst
+// uploadObject stores a local file as an object, keeping the version it replaces
+func uploadObject(localPath, key string) error {
+	objectPath := filepath.Join(s3Path, key)
+	if err := keepVersion(objectPath, key); err != nil {
+		return fmt.Errorf("failed to keep previous version: %v", err)
+	}
+	// The checksum goes first and also names the object it replaces, so a
+	// crash before the object is renamed leaves the previous version readable
+	if err := writeChecksum(localPath, objectPath); err != nil {
+		return fmt.Errorf("failed to record checksum: %v", err)
+	}
+	return copyFile(localPath, objectPath)
+}
+
+// keepVersion preserves the current object, and its checksum, under
+// s3_storage/.versions/<key>/<timestamp> before it is replaced
+func keepVersion(objectPath, key string) error {
+	if _, err := os.Stat(objectPath); os.IsNotExist(err) {
+		return nil
+	}
+
+	dir := filepath.Join(s3Path, versionsDir, key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	versionPath := filepath.Join(dir, time.Now().UTC().Format("20060102T150405.000000000Z"))
+
+	for _, suffix := range []string{"", checksumSuffix} {
+		if _, err := os.Stat(objectPath + suffix); os.IsNotExist(err) {
+			continue
+		}
+		// A hard link keeps the old contents once the object is renamed over
+		if err := os.Link(objectPath+suffix, versionPath+suffix); err != nil {
+			if err := copyFile(objectPath+suffix, versionPath+suffix); err != nil {
+				return err
+			}
+		}
+	}
+	slog.Debug("Kept previous version", "key", key, "path", versionPath)
+	return nil
+}
+
+// copyFile copies a file from src to dst atomically: the copy is written to
+// a temp file in dst's directory, synced, then renamed over dst, so dst is
+// always either the old file or the complete new one
 func copyFile(src, dst string) error {
 	sourceFile, err := os.Open(src)
 	if err != nil {
@@ -224,12 +981,166 @@ func copyFile(src, dst string) error {
 	}
 	defer sourceFile.Close()
 
-	destFile, err := os.Create(dst)
+	tempFile, err := os.CreateTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-*")
 	if err != nil {
 		return err
 	}
-	defer destFile.Close()
+	tempPath := tempFile.Name()
+	defer os.Remove(tempPath) // No-op once renamed
 
-	_, err = io.Copy(destFile, sourceFile)
-	return err
+	if _, err := io.Copy(tempFile, sourceFile); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, dst); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dst))
+}
+
+// syncDir flushes a directory so a rename in it survives a crash
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// checkIntegrity runs PRAGMA quick_check, or integrity_check when
+// INTEGRITY_CHECK=full; INTEGRITY_CHECK=off skips it
+func checkIntegrity(dbPath string) error {
+	pragma := "PRAGMA quick_check"
+	switch os.Getenv("INTEGRITY_CHECK") {
+	case "off":
+		return nil
+	case "full":
+		pragma = "PRAGMA integrity_check"
+	}
+
+	db, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(pragma)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("database is corrupt: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// fileChecksum returns the hex SHA-256 of a file
+func fileChecksum(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// writeChecksum records the checksum of a file about to be uploaded next to
+// the stored object, followed by the checksum of the object it replaces
+func writeChecksum(localPath, objectPath string) error {
+	checksum, err := fileChecksum(localPath)
+	if err != nil {
+		return err
+	}
+	record := checksum + "\n"
+	if _, err := os.Stat(objectPath); err == nil {
+		if err := verifyChecksum(objectPath, objectPath); err != nil {
+			return fmt.Errorf("stored object is damaged: %v", err)
+		}
+		previous, err := fileChecksum(objectPath)
+		if err != nil {
+			return err
+		}
+		record += previous + "\n"
+	}
+
+	tempPath := objectPath + checksumSuffix + ".tmp"
+	tempFile, err := os.Create(tempPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempPath) // No-op once renamed
+	if _, err := tempFile.WriteString(record); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tempPath, objectPath+checksumSuffix); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(objectPath))
+}
+
+// verifyChecksum checks a downloaded file against the checksum recorded on
+// upload. A file matching the replaced object's checksum is the version
+// before an upload that did not finish. Objects stored before checksums
+// were recorded are accepted.
+func verifyChecksum(objectPath, localPath string) error {
+	recorded, err := os.ReadFile(objectPath + checksumSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read checksum: %v", err)
+	}
+
+	actual, err := fileChecksum(localPath)
+	if err != nil {
+		return err
+	}
+	checksums := strings.Fields(string(recorded))
+	if len(checksums) == 0 {
+		return fmt.Errorf("checksum file %s is empty", objectPath+checksumSuffix)
+	}
+	switch {
+	case actual == checksums[0]:
+		return nil
+	case len(checksums) > 1 && actual == checksums[1]:
+		slog.Warn("Object is the version before an interrupted upload", "path", objectPath)
+		return nil
+	}
+	return fmt.Errorf("checksum mismatch: expected %s, got %s", checksums[0], actual)
 }
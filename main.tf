@@ -77,6 +77,35 @@ resource "aws_dynamodb_table" "locks" {
   }
 }
 
+# DynamoDB table for queued writes awaiting group commit
+resource "aws_dynamodb_table" "write_queue" {
+  name           = var.write_queue_table_name
+  billing_mode   = "PAY_PER_REQUEST"
+  hash_key       = "database_name"
+  range_key      = "request_id"
+
+  attribute {
+    name = "database_name"
+    type = "S"
+  }
+
+  attribute {
+    name = "request_id"
+    type = "S"
+  }
+
+  ttl {
+    attribute_name = "expires_at"
+    enabled        = true
+  }
+
+  tags = {
+    Name        = "CloudSQLite Write Queue"
+    Environment = "production"
+    Project     = "CloudSQLite"
+  }
+}
+
 # IAM Role for Lambda function
 resource "aws_iam_role" "lambda_execution_role" {
   name = "CloudSQLite-Lambda-Role"
@@ -119,21 +148,106 @@ resource "aws_iam_role_policy" "lambda_cloudsqlite_policy" {
         Effect = "Allow"
         Action = [
           "s3:GetObject",
+          "s3:GetObjectVersion",
           "s3:PutObject",
-          "s3:DeleteObject"
+          "s3:DeleteObject",
+          "s3:DeleteObjectVersion",
+          "s3:AbortMultipartUpload"
         ]
         Resource = "${aws_s3_bucket.sqlite_databases.arn}/*"
       },
+      {
+        Effect = "Allow"
+        Action = [
+          "s3:ListBucket",
+          "s3:ListBucketVersions"
+        ]
+        Resource = aws_s3_bucket.sqlite_databases.arn
+      },
       {
         Effect = "Allow"
         Action = [
           "dynamodb:GetItem",
           "dynamodb:PutItem",
           "dynamodb:DeleteItem",
+          "dynamodb:UpdateItem",
           "dynamodb:Query",
           "dynamodb:Scan"
         ]
-        Resource = aws_dynamodb_table.locks.arn
+        Resource = [
+          aws_dynamodb_table.locks.arn,
+          aws_dynamodb_table.write_queue.arn
+        ]
+      }
+    ]
+  })
+}
+
+# Shared filesystem for databases with the "efs" storage layout, created
+# only when subnets are given
+locals {
+  efs_enabled = length(var.efs_subnet_ids) > 0
+}
+
+resource "aws_efs_file_system" "databases" {
+  count     = local.efs_enabled ? 1 : 0
+  encrypted = true
+
+  tags = {
+    Name        = "CloudSQLite Databases"
+    Environment = "production"
+    Project     = "CloudSQLite"
+  }
+}
+
+resource "aws_efs_mount_target" "databases" {
+  for_each        = local.efs_enabled ? toset(var.efs_subnet_ids) : toset([])
+  file_system_id  = aws_efs_file_system.databases[0].id
+  subnet_id       = each.value
+  security_groups = var.efs_security_group_ids
+}
+
+resource "aws_efs_access_point" "databases" {
+  count          = local.efs_enabled ? 1 : 0
+  file_system_id = aws_efs_file_system.databases[0].id
+
+  posix_user {
+    uid = 1000
+    gid = 1000
+  }
+
+  root_directory {
+    path = "/cloudsqlite"
+    creation_info {
+      owner_uid   = 1000
+      owner_gid   = 1000
+      permissions = "755"
+    }
+  }
+}
+
+# A function in a VPC needs to manage its network interfaces
+resource "aws_iam_role_policy_attachment" "lambda_vpc_access" {
+  count      = local.efs_enabled ? 1 : 0
+  role       = aws_iam_role.lambda_execution_role.name
+  policy_arn = "arn:aws:iam::aws:policy/service-role/AWSLambdaVPCAccessExecutionRole"
+}
+
+resource "aws_iam_role_policy" "lambda_efs_policy" {
+  count = local.efs_enabled ? 1 : 0
+  name  = "CloudSQLiteEFSPolicy"
+  role  = aws_iam_role.lambda_execution_role.id
+
+  policy = jsonencode({
+    Version = "2012-10-17"
+    Statement = [
+      {
+        Effect = "Allow"
+        Action = [
+          "elasticfilesystem:ClientMount",
+          "elasticfilesystem:ClientWrite"
+        ]
+        Resource = aws_efs_file_system.databases[0].arn
       }
     ]
   })
@@ -142,13 +256,13 @@ resource "aws_iam_role_policy" "lambda_cloudsqlite_policy" {
 # Build the Go Lambda function
 resource "null_resource" "build_lambda" {
   triggers = {
-    source_code_hash = filemd5("${path.module}/lambda/main.go")
+    source_code_hash = sha1(join("", [for f in fileset("${path.module}/lambda", "*.go") : filemd5("${path.module}/lambda/${f}")]))
   }
 
   provisioner "local-exec" {
     command = <<-EOT
       cd ${path.module}/lambda
-      GOOS=linux GOARCH=amd64 go build -o lambda_handler main.go
+      GOOS=linux GOARCH=amd64 go build -o lambda_handler .
     EOT
   }
 }
@@ -176,9 +290,28 @@ resource "aws_lambda_function" "cloudsqlite_lambda" {
     variables = {
       S3_BUCKET_NAME      = aws_s3_bucket.sqlite_databases.bucket
       DYNAMODB_TABLE_NAME = aws_dynamodb_table.locks.name
+      EFS_MOUNT_PATH      = "/mnt/cloudsqlite"
     }
   }
 
+  dynamic "vpc_config" {
+    for_each = local.efs_enabled ? [1] : []
+    content {
+      subnet_ids         = var.efs_subnet_ids
+      security_group_ids = var.efs_security_group_ids
+    }
+  }
+
+  dynamic "file_system_config" {
+    for_each = local.efs_enabled ? [1] : []
+    content {
+      arn              = aws_efs_access_point.databases[0].arn
+      local_mount_path = "/mnt/cloudsqlite"
+    }
+  }
+
+  depends_on = [aws_efs_mount_target.databases]
+
   tags = {
     Name        = "CloudSQLite Lambda Function"
     Environment = "production"
@@ -268,6 +401,11 @@ output "dynamodb_table_name" {
   value       = aws_dynamodb_table.locks.name
 }
 
+output "write_queue_table_name" {
+  description = "DynamoDB table name for queued writes"
+  value       = aws_dynamodb_table.write_queue.name
+}
+
 output "lambda_function_arn" {
   description = "Lambda function ARN"
   value       = aws_lambda_function.cloudsqlite_lambda.arn
@@ -18,6 +18,24 @@ variable "dynamodb_table_name" {
   default     = "CloudSQLite-Locks"
 }
 
+variable "write_queue_table_name" {
+  description = "Name of the DynamoDB table for queued writes"
+  type        = string
+  default     = "CloudSQLite-WriteQueue"
+}
+
+variable "efs_subnet_ids" {
+  description = "VPC subnets for the EFS mount targets and the Lambda function; leave empty to keep every database in S3"
+  type        = list(string)
+  default     = []
+}
+
+variable "efs_security_group_ids" {
+  description = "Security groups for the Lambda function and the EFS mount targets; they must allow NFS (TCP 2049) between them"
+  type        = list(string)
+  default     = []
+}
+
 variable "lambda_function_name" {
   description = "Name of the Lambda function"
   type        = string